@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-omaha/omaha"
+	"github.com/coreos/go-omaha/omaha/client"
+)
+
+var (
+	server    = flag.String("server", "", "URL of the omaha server")
+	appID     = flag.String("app", "{e96281a6-d1af-4bde-9a0a-97b76e56dc57}", "Application ID")
+	version   = flag.String("version", "0.0.0", "Current application version")
+	track     = flag.String("track", "", "Application track or group")
+	oem       = flag.String("oem", "", "Application OEM name")
+	machineID = flag.String("machine-id", "", "Machine ID, defaults to /etc/machine-id")
+	deltaOK   = flag.Bool("delta-ok", false, "Accept delta payloads")
+	jsonOut   = flag.Bool("json", false, "Print responses as JSON instead of XML")
+	token     = flag.String("token", "", "Bearer token to authenticate with")
+)
+
+// shorthand names for the events update_engine sends.
+var events = map[string]*omaha.EventRequest{
+	"downloading": client.EventDownloading,
+	"downloaded":  client.EventDownloaded,
+	"installed":   client.EventInstalled,
+	"complete":    client.EventComplete,
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] COMMAND [args]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		fmt.Fprintf(os.Stderr, "  check                         Check for an update and print the response\n")
+		fmt.Fprintf(os.Stderr, "  ping                          Send a ping\n")
+		fmt.Fprintf(os.Stderr, "  event NAME | TYPE RESULT [CODE]\n")
+		fmt.Fprintf(os.Stderr, "                                Send an event by name (downloading, downloaded,\n")
+		fmt.Fprintf(os.Stderr, "                                installed, complete) or by numeric values\n")
+		fmt.Fprintf(os.Stderr, "  download DIR                  Check for an update and download it into DIR\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *server == "" {
+		fmt.Println("server is a required flag")
+		os.Exit(1)
+	}
+
+	ac, err := newAppClient()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+	switch cmd {
+	case "check":
+		err = check(ac, args)
+	case "ping":
+		err = ping(ac, args)
+	case "event":
+		err = event(ac, args)
+	case "download":
+		err = download(ac, args)
+	default:
+		err = fmt.Errorf("unknown command %q", cmd)
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func newAppClient() (*client.AppClient, error) {
+	id := *machineID
+	if id == "" {
+		b, err := ioutil.ReadFile("/etc/machine-id")
+		if err != nil {
+			return nil, fmt.Errorf("machine-id is required: %v", err)
+		}
+		id = strings.TrimSpace(string(b))
+	}
+
+	ac, err := client.NewAppClient(*server, id, *appID, *version)
+	if err != nil {
+		return nil, err
+	}
+	ac.SetClientVersion("omaha-cli")
+
+	if *track != "" {
+		if err := ac.SetTrack(*track); err != nil {
+			return nil, err
+		}
+	}
+	ac.SetOEM(*oem)
+	ac.SetDeltaOK(*deltaOK)
+	ac.SetBearerToken(*token)
+	return ac, nil
+}
+
+func check(ac *client.AppClient, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("check takes no arguments")
+	}
+
+	update, err := ac.UpdateCheck()
+	if err == omaha.NoUpdate {
+		fmt.Println(err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return printResponse(update)
+}
+
+func ping(ac *client.AppClient, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("ping takes no arguments")
+	}
+
+	if err := ac.Ping(); err != nil {
+		return err
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+func event(ac *client.AppClient, args []string) error {
+	var ev *omaha.EventRequest
+	switch len(args) {
+	case 1:
+		var ok bool
+		if ev, ok = events[args[0]]; !ok {
+			return fmt.Errorf("unknown event %q", args[0])
+		}
+	case 2, 3:
+		var nums [3]int
+		for i, arg := range args {
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				return fmt.Errorf("invalid event value %q", arg)
+			}
+			nums[i] = n
+		}
+		ev = &omaha.EventRequest{
+			Type:      omaha.EventType(nums[0]),
+			Result:    omaha.EventResult(nums[1]),
+			ErrorCode: nums[2],
+		}
+	default:
+		return fmt.Errorf("event requires a name or a type and result")
+	}
+
+	if err := <-ac.Event(ev); err != nil {
+		return err
+	}
+	fmt.Println(client.EventString(ev))
+	return nil
+}
+
+func download(ac *client.AppClient, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("download requires a directory")
+	}
+
+	update, err := ac.UpdateCheck()
+	if err != nil {
+		return err
+	}
+
+	paths, err := ac.Download(update, args[0])
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		fmt.Println(path)
+	}
+	return nil
+}
+
+func printResponse(update *omaha.UpdateResponse) error {
+	var out []byte
+	var err error
+	if *jsonOut {
+		out, err = json.MarshalIndent(update, "", "  ")
+	} else {
+		out, err = xml.MarshalIndent(update, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(out))
+	return nil
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/coreos/go-omaha/omaha"
+	"github.com/coreos/go-omaha/omaha/client"
+)
+
+// extensions lists the non-standard attributes update_engine uses, by
+// element name. They are reported but not considered errors.
+var extensions = map[string][]string{
+	"request": {"updaterversion"},
+	"app": {"board", "delta_okay", "from_track", "track",
+		"alephversion", "bootid", "machineid", "oem", "oemversion"},
+	"updatecheck": {"_rollback"},
+	"action": {"DisplayVersion", "sha256", "needsadmin", "IsDeltaPayload",
+		"DisablePayloadBackoff", "MaxFailureCountPerUrl",
+		"MetadataSignatureRsa", "MetadataSize", "deadline", "MoreInfo",
+		"Prompt", omaha.PayloadSignatureAttr},
+}
+
+// Elements that are always lists when converted to JSON.
+var jsonArrays = map[string]bool{
+	"app":     true,
+	"event":   true,
+	"url":     true,
+	"package": true,
+	"action":  true,
+}
+
+func main() {
+	toJSON := flag.Bool("json", false, "Print the document converted to JSON")
+	toXML := flag.Bool("xml", false, "Print the document converted to XML")
+	quiet := flag.Bool("q", false, "Only report errors")
+	strict := flag.Bool("strict", false, "Also require versions to be semver")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [FILE...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Validates omaha XML or JSON documents, reading stdin if no FILE is given.\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *toJSON && *toXML {
+		fmt.Println("json and xml are mutually exclusive")
+		os.Exit(1)
+	}
+
+	files := flag.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	level := omaha.ValidateBasic
+	if *strict {
+		level = omaha.ValidateStrict
+	}
+
+	failed := false
+	for _, file := range files {
+		doc, err := load(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			failed = true
+			continue
+		}
+
+		if !inspect(file, doc, level, *quiet || *toJSON || *toXML) {
+			failed = true
+		}
+
+		var out []byte
+		switch {
+		case *toJSON:
+			out, err = json.MarshalIndent(map[string]*node{doc.Name: doc}, "", "  ")
+		case *toXML:
+			out, err = doc.encodeXML("  ")
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			failed = true
+		} else if out != nil {
+			fmt.Println(string(out))
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func load(file string) (*node, error) {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) != 0 && trimmed[0] == '{' {
+		return decodeJSON(data)
+	}
+	return decodeXML(data)
+}
+
+// inspect validates doc and prints a summary and any problems found,
+// returning false if the document is invalid.
+func inspect(file string, doc *node, level omaha.Strictness, quiet bool) bool {
+	report := func(format string, args ...interface{}) {
+		if !quiet {
+			fmt.Printf(format+"\n", args...)
+		}
+	}
+	problem := func(format string, args ...interface{}) {
+		fmt.Fprintf(os.Stderr, "%s: "+format+"\n", append([]interface{}{file}, args...)...)
+	}
+
+	// Protocol 4 documents are checked against the 3.x rules, since
+	// the parser does not accept them otherwise.
+	check := doc
+	if p := doc.attr("protocol"); strings.HasPrefix(p, "4.") {
+		check = doc.withAttr("protocol", "3.1")
+		report("%s: protocol %s checked as 3.1", file, p)
+	}
+
+	raw, err := check.encodeXML("")
+	if err != nil {
+		problem("%v", err)
+		return false
+	}
+
+	valid := true
+	var typ reflect.Type
+	switch doc.Name {
+	case "request":
+		req, err := omaha.ParseRequest("", bytes.NewReader(raw))
+		if err != nil {
+			problem("invalid request: %v", err)
+			return false
+		}
+		typ = reflect.TypeOf(req)
+		report("%s: request, protocol %s, %d app(s)", file, doc.attr("protocol"), len(req.Apps))
+		for _, app := range req.Apps {
+			report("  app %s version %s track %q", app.ID, app.Version, app.Track)
+			if app.UpdateCheck != nil {
+				report("    updatecheck")
+			}
+			if app.Ping != nil {
+				report("    ping")
+			}
+			for _, e := range app.Events {
+				report("    event %d (%s), result %d (%s)", e.Type, e.Type, e.Result, e.Result)
+				if e.ErrorCode != 0 {
+					code := client.ExitCode(e.ErrorCode)
+					report("      error code %d (%s)", e.ErrorCode, code)
+				}
+			}
+		}
+
+		// Check apps one by one to report every invalid app.
+		if len(req.Apps) == 0 {
+			if err := req.Validate(level); err != nil {
+				problem("%v", err)
+				valid = false
+			}
+		}
+		for _, app := range req.Apps {
+			if err := req.ValidateApp(app, level); err != nil {
+				problem("%v (%s)", err, string(err.(*omaha.ValidationError).Status))
+				valid = false
+			}
+		}
+	case "response":
+		resp, err := omaha.ParseResponse("", bytes.NewReader(raw))
+		if err != nil {
+			problem("invalid response: %v", err)
+			return false
+		}
+		typ = reflect.TypeOf(resp)
+		report("%s: response, protocol %s, %d app(s)", file, doc.attr("protocol"), len(resp.Apps))
+		for _, app := range resp.Apps {
+			report("  app %s status %s", app.ID, string(app.Status))
+			if uc := app.UpdateCheck; uc != nil {
+				report("    updatecheck status %s", string(uc.Status))
+				if uc.Manifest != nil {
+					report("    manifest version %s, %d package(s)", uc.Manifest.Version, len(uc.Manifest.Packages))
+				}
+			}
+		}
+		if err := resp.Validate(level); err != nil {
+			problem("%v", err)
+			valid = false
+		}
+	default:
+		problem("unknown document type %q", doc.Name)
+		return false
+	}
+
+	for _, w := range checkAttrs(doc, newSchema(typ), "/"+doc.Name) {
+		problem("%s", w)
+	}
+	for _, n := range findExtensions(doc, "/"+doc.Name) {
+		report("  %s", n)
+	}
+
+	return valid
+}
+
+// node is a generic omaha document element.
+type node struct {
+	Name     string
+	Attrs    []xml.Attr
+	Children []*node
+
+	// Text is the element's character data, such as the contents of
+	// a data element, without surrounding whitespace.
+	Text string
+}
+
+// jsonText is the member holding an element's text in JSON, as in
+// protocol 4's data elements.
+const jsonText = "#text"
+
+func (n *node) attr(name string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// withAttr returns a shallow copy of n with the attribute replaced.
+func (n *node) withAttr(name, value string) *node {
+	c := *n
+	c.Attrs = nil
+	for _, a := range n.Attrs {
+		if a.Name.Local == name {
+			a.Value = value
+		}
+		c.Attrs = append(c.Attrs, a)
+	}
+	return &c
+}
+
+func decodeXML(data []byte) (*node, error) {
+	var root *node
+	var stack []*node
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &node{Name: t.Name.Local, Attrs: t.Attr}
+			if len(stack) == 0 {
+				if root != nil {
+					return nil, fmt.Errorf("multiple root elements")
+				}
+				root = n
+			} else {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, n)
+			}
+			stack = append(stack, n)
+		case xml.CharData:
+			if len(stack) != 0 {
+				stack[len(stack)-1].Text += string(t)
+			}
+		case xml.EndElement:
+			n := stack[len(stack)-1]
+			n.Text = strings.TrimSpace(n.Text)
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+	if root == nil {
+		return nil, fmt.Errorf("empty document")
+	}
+	return root, nil
+}
+
+func (n *node) encodeXML(indent string) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", indent)
+	if err := n.writeXML(enc); err != nil {
+		return nil, err
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (n *node) writeXML(enc *xml.Encoder) error {
+	start := xml.StartElement{Name: xml.Name{Local: n.Name}, Attr: n.Attrs}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	if n.Text != "" {
+		if err := enc.EncodeToken(xml.CharData(n.Text)); err != nil {
+			return err
+		}
+	}
+	for _, c := range n.Children {
+		if err := c.writeXML(enc); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// MarshalJSON converts the element to the JSON shape used by protocol 4:
+// attributes become string members and child elements become objects,
+// or lists of objects if they may repeat. Text is kept as "#text".
+func (n *node) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	first := true
+	member := func(key string, value interface{}) error {
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+		return nil
+	}
+
+	for _, a := range n.Attrs {
+		if err := member(a.Name.Local, a.Value); err != nil {
+			return nil, err
+		}
+	}
+	if n.Text != "" {
+		if err := member(jsonText, n.Text); err != nil {
+			return nil, err
+		}
+	}
+
+	// Group children by name, in order of first appearance.
+	var names []string
+	groups := make(map[string][]*node)
+	for _, c := range n.Children {
+		if _, ok := groups[c.Name]; !ok {
+			names = append(names, c.Name)
+		}
+		groups[c.Name] = append(groups[c.Name], c)
+	}
+	for _, name := range names {
+		var err error
+		if g := groups[name]; len(g) == 1 && !jsonArrays[name] {
+			err = member(name, g[0])
+		} else {
+			err = member(name, g)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func decodeJSON(data []byte) (*node, error) {
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if len(doc) != 1 {
+		return nil, fmt.Errorf("expected a single request or response object")
+	}
+
+	for name, value := range doc {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: expected an object", name)
+		}
+		return jsonNode(name, obj)
+	}
+	panic("unreachable")
+}
+
+func jsonNode(name string, obj map[string]interface{}) (*node, error) {
+	n := &node{Name: name}
+
+	// JSON objects are unordered, sort for stable output.
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if text, ok := obj[k].(string); ok && k == jsonText {
+			n.Text = text
+			continue
+		}
+
+		switch v := obj[k].(type) {
+		case map[string]interface{}:
+			c, err := jsonNode(k, v)
+			if err != nil {
+				return nil, err
+			}
+			n.Children = append(n.Children, c)
+		case []interface{}:
+			for i, item := range v {
+				o, ok := item.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("%s/%s[%d]: expected an object", name, k, i)
+				}
+				c, err := jsonNode(k, o)
+				if err != nil {
+					return nil, err
+				}
+				n.Children = append(n.Children, c)
+			}
+		case nil:
+		default:
+			n.Attrs = append(n.Attrs, xml.Attr{
+				Name:  xml.Name{Local: k},
+				Value: fmt.Sprint(v),
+			})
+		}
+	}
+
+	return n, nil
+}
+
+// schema lists the attributes and elements the omaha package knows.
+type schema struct {
+	attrs map[string]bool
+	elems map[string]*schema
+}
+
+func newSchema(t reflect.Type) *schema {
+	s := &schema{
+		attrs: make(map[string]bool),
+		elems: make(map[string]*schema),
+	}
+
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return s
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("xml")
+		if tag == "-" || f.Name == "XMLName" {
+			continue
+		}
+
+		// Embedded structs such as omaha.Extensions are flattened.
+		if f.Anonymous && tag == "" {
+			embedded := newSchema(f.Type)
+			for name := range embedded.attrs {
+				s.attrs[name] = true
+			}
+			for name, es := range embedded.elems {
+				s.elems[name] = es
+			}
+			continue
+		}
+
+		opts := strings.Split(tag, ",")
+		name, opts := opts[0], opts[1:]
+		if name == "" {
+			name = f.Name
+		}
+		if hasOpt(opts, "chardata", "innerxml", "comment", "any") {
+			continue
+		}
+		if hasOpt(opts, "attr") {
+			s.attrs[name] = true
+			continue
+		}
+
+		// Handle nested element paths such as "urls>url".
+		cur := s
+		parts := strings.Split(name, ">")
+		for _, p := range parts[:len(parts)-1] {
+			next, ok := cur.elems[p]
+			if !ok {
+				next = newSchema(reflect.TypeOf(struct{}{}))
+				cur.elems[p] = next
+			}
+			cur = next
+		}
+		cur.elems[parts[len(parts)-1]] = newSchema(f.Type)
+	}
+
+	return s
+}
+
+func hasOpt(opts []string, want ...string) bool {
+	for _, o := range opts {
+		for _, w := range want {
+			if o == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkAttrs reports attributes and elements not known to the schema.
+func checkAttrs(n *node, s *schema, path string) []string {
+	var problems []string
+	for _, a := range n.Attrs {
+		if !s.attrs[a.Name.Local] {
+			problems = append(problems, fmt.Sprintf("%s/@%s: unknown attribute", path, a.Name.Local))
+		}
+	}
+	for _, c := range n.Children {
+		cs, ok := s.elems[c.Name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s/%s: unknown element", path, c.Name))
+			continue
+		}
+		problems = append(problems, checkAttrs(c, cs, path+"/"+c.Name)...)
+	}
+	return problems
+}
+
+// findExtensions lists update_engine extension attributes in use.
+func findExtensions(n *node, path string) []string {
+	var found []string
+	for _, a := range n.Attrs {
+		for _, ext := range extensions[n.Name] {
+			if a.Name.Local == ext {
+				found = append(found, fmt.Sprintf("%s/@%s: update_engine extension", path, ext))
+			}
+		}
+	}
+	for _, c := range n.Children {
+		found = append(found, findExtensions(c, path+"/"+c.Name)...)
+	}
+	return found
+}
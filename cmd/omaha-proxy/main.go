@@ -0,0 +1,442 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+	"github.com/coreos/go-omaha/omaha/client"
+)
+
+const (
+	payloadPrefix = "/payloads/"
+
+	// Expired update checks are removed from the cache at most this
+	// often, when new ones are added.
+	sweepInterval = time.Minute
+
+	// Pings and events waiting to be forwarded upstream, more are
+	// dropped.
+	forwardQueue = 1000
+)
+
+func main() {
+	upstream := flag.String("upstream", "", "URL of the upstream omaha server")
+	listenAddress := flag.String("listen-address", ":8000", "Host and IP to listen on")
+	cacheDir := flag.String("cache-dir", "", "Directory to cache update payloads in")
+	ttl := flag.Duration("ttl", 5*time.Minute, "How long to cache update responses")
+	errorTTL := flag.Duration("error-ttl", 10*time.Second, "How long to cache failed upstream update checks")
+	forwarders := flag.Int("forwarders", 8, "How many pings and events to forward upstream at once")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -upstream URL -cache-dir DIR [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Serves omaha clients from a cache of an upstream server's responses.\n")
+		fmt.Fprintf(os.Stderr, "Update checks are answered per app, track and version so per machine\n")
+		fmt.Fprintf(os.Stderr, "decisions made by the upstream server apply to all machines alike.\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *upstream == "" {
+		fmt.Println("upstream is a required flag")
+		os.Exit(1)
+	}
+
+	if *cacheDir == "" {
+		fmt.Println("cache-dir is a required flag")
+		os.Exit(1)
+	}
+
+	// The user ID is never sent, Forward passes on the clients' own.
+	c, err := client.New(*upstream, "omaha-proxy")
+	if err != nil {
+		fmt.Printf("invalid upstream: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *forwarders < 1 {
+		fmt.Println("forwarders must be at least 1")
+		os.Exit(1)
+	}
+
+	p := &proxy{
+		upstream: c,
+		dir:      *cacheDir,
+		ttl:      *ttl,
+		errorTTL: *errorTTL,
+		cache:    make(map[cacheKey]*cacheEntry),
+		payloads: make(map[string]*payload),
+		forwards: make(chan *omaha.Request, forwardQueue),
+	}
+	for i := 0; i < *forwarders; i++ {
+		go p.forwarder()
+	}
+
+	server, err := omaha.NewServer(*listenAddress, p)
+	if err != nil {
+		fmt.Printf("failed to make new server: %v\n", err)
+		os.Exit(1)
+	}
+	server.Mux.HandleFunc(payloadPrefix, p.servePayload)
+
+	err = server.Serve()
+	if err != nil {
+		fmt.Printf("server exited with an error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// proxy is an omaha.Updater answering from upstream responses.
+type proxy struct {
+	upstream *client.Client
+	dir      string
+	ttl      time.Duration
+	errorTTL time.Duration
+
+	forwards chan *omaha.Request
+
+	mu        sync.Mutex
+	cache     map[cacheKey]*cacheEntry
+	lastSweep time.Time
+	payloads  map[string]*payload
+}
+
+// cacheKey covers everything in an update check that affects the answer,
+// apart from the machine's identity.
+type cacheKey struct {
+	appID    string
+	track    string
+	version  string
+	prefix   string
+	deltaOK  bool
+	rollback bool
+}
+
+// cacheEntry is an upstream update check, done is closed once finished.
+// Failures are cached too, for errorTTL, so an upstream outage does not
+// turn every client request into another upstream request.
+type cacheEntry struct {
+	done         chan struct{}
+	err          error
+	expires      time.Time
+	appStatus    omaha.AppStatus
+	updateStatus omaha.UpdateStatus
+	update       *omaha.Update
+}
+
+// payload is a download into the cache, done is closed once finished.
+type payload struct {
+	pkgs []*omaha.Package
+	done chan struct{}
+	err  error
+}
+
+func (p *proxy) CheckApp(req *omaha.Request, app *omaha.AppRequest) error {
+	if app.UpdateCheck == nil {
+		return nil
+	}
+
+	e, err := p.lookup(req, app)
+	if err != nil {
+		return err
+	}
+	if e.appStatus != omaha.AppOK {
+		return e.appStatus
+	}
+	return nil
+}
+
+func (p *proxy) CheckUpdate(req *omaha.Request, app *omaha.AppRequest) (*omaha.Update, error) {
+	e, err := p.lookup(req, app)
+	if err != nil {
+		return nil, err
+	}
+	if e.updateStatus != omaha.UpdateOK {
+		return nil, e.updateStatus
+	}
+	return e.update, nil
+}
+
+func (p *proxy) Event(req *omaha.Request, app *omaha.AppRequest, event *omaha.EventRequest) {
+	up, a := upstreamRequest(req, app)
+	a.Events = []*omaha.EventRequest{event}
+	p.forward(up)
+}
+
+func (p *proxy) Ping(req *omaha.Request, app *omaha.AppRequest) {
+	up, a := upstreamRequest(req, app)
+	a.Ping = app.Ping
+	p.forward(up)
+}
+
+// forward queues pings and events to send upstream so it still sees
+// every client. If upstream falls too far behind they are dropped.
+func (p *proxy) forward(req *omaha.Request) {
+	select {
+	case p.forwards <- req:
+	default:
+		log.Printf("omaha-proxy: forwarding queue full, dropped request for %s", req.Apps[0].ID)
+	}
+}
+
+// forwarder sends queued requests upstream, one at a time.
+func (p *proxy) forwarder() {
+	for req := range p.forwards {
+		if _, err := p.upstream.Forward(req); err != nil {
+			log.Printf("omaha-proxy: forwarding to upstream failed: %v", err)
+		}
+	}
+}
+
+// upstreamRequest copies req with only app, stripped of its ping, events
+// and update check for the caller to fill in.
+func upstreamRequest(req *omaha.Request, app *omaha.AppRequest) (*omaha.Request, *omaha.AppRequest) {
+	up := *req
+	a := *app
+	a.Ping = nil
+	a.Events = nil
+	a.UpdateCheck = nil
+	up.Apps = []*omaha.AppRequest{&a}
+	return &up, &a
+}
+
+func (p *proxy) lookup(req *omaha.Request, app *omaha.AppRequest) (*cacheEntry, error) {
+	key := cacheKey{
+		appID:   strings.ToLower(app.ID),
+		track:   app.Track,
+		version: app.Version,
+		deltaOK: app.DeltaOK,
+	}
+	if uc := app.UpdateCheck; uc != nil {
+		key.prefix = uc.TargetVersionPrefix
+		key.rollback = uc.RollbackAllowed
+	}
+
+	// Concurrent requests for the same key share one upstream check.
+	p.mu.Lock()
+	e, ok := p.cache[key]
+	if !ok || e.expired() {
+		p.sweep()
+		e = &cacheEntry{done: make(chan struct{})}
+		p.cache[key] = e
+		p.mu.Unlock()
+		p.fill(e, req, app)
+	} else {
+		p.mu.Unlock()
+	}
+
+	<-e.done
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e, nil
+}
+
+// sweep removes expired checks from the cache. Clients choose the
+// versions in the key so without it the cache grows without bound.
+// p.mu must be held.
+func (p *proxy) sweep() {
+	now := time.Now()
+	if now.Sub(p.lastSweep) < sweepInterval {
+		return
+	}
+	p.lastSweep = now
+
+	for key, e := range p.cache {
+		if e.expired() {
+			delete(p.cache, key)
+		}
+	}
+}
+
+// expired reports whether a finished check is too old to use.
+func (e *cacheEntry) expired() bool {
+	select {
+	case <-e.done:
+		return !time.Now().Before(e.expires)
+	default:
+		return false
+	}
+}
+
+func (p *proxy) fill(e *cacheEntry, req *omaha.Request, app *omaha.AppRequest) {
+	defer close(e.done)
+
+	if e.err = p.fetch(e, req, app); e.err != nil {
+		log.Printf("omaha-proxy: update check for %s failed: %v", app.ID, e.err)
+		e.expires = time.Now().Add(p.errorTTL)
+		return
+	}
+	e.expires = time.Now().Add(p.ttl)
+}
+
+func (p *proxy) fetch(e *cacheEntry, req *omaha.Request, app *omaha.AppRequest) error {
+	up, a := upstreamRequest(req, app)
+	a.UpdateCheck = app.UpdateCheck
+	if a.UpdateCheck == nil {
+		a.UpdateCheck = &omaha.UpdateRequest{}
+	}
+
+	resp, err := p.upstream.Forward(up)
+	if err != nil {
+		return err
+	}
+
+	appResp := resp.GetApp(app.ID)
+	if appResp == nil {
+		return fmt.Errorf("app %s missing from response", app.ID)
+	}
+
+	e.appStatus = appResp.Status
+	if appResp.Status != omaha.AppOK {
+		return nil
+	}
+
+	uc := appResp.UpdateCheck
+	if uc == nil {
+		return errors.New("update check missing from response")
+	}
+
+	e.updateStatus = uc.Status
+	if uc.Status == omaha.UpdateOK {
+		if e.update, err = p.cacheUpdate(app.ID, uc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cacheUpdate starts downloading the update's packages and returns an
+// update pointing clients at the local copies.
+func (p *proxy) cacheUpdate(appID string, uc *omaha.UpdateResponse) (*omaha.Update, error) {
+	if uc.Manifest == nil || len(uc.Manifest.Packages) == 0 {
+		return nil, errors.New("update without packages")
+	}
+
+	dir, err := payloadDir(uc.Manifest.Packages[0])
+	if err != nil {
+		return nil, err
+	}
+	p.download(dir, uc)
+
+	return &omaha.Update{
+		ID:       appID,
+		URL:      omaha.URL{CodeBase: payloadPrefix + dir + "/"},
+		Manifest: *uc.Manifest,
+		Rollback: uc.Rollback,
+	}, nil
+}
+
+// payloadDir names the cache directory after the payload's hash.
+func payloadDir(pkg *omaha.Package) (string, error) {
+	hash := pkg.SHA256
+	if hash == "" {
+		hash = pkg.SHA1
+	}
+
+	b, err := base64.StdEncoding.DecodeString(hash)
+	if err != nil || len(b) == 0 {
+		return "", fmt.Errorf("package %q has an invalid hash", pkg.Name)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// download fetches the update's packages into dir once. Packages that
+// are already cached and valid are not downloaded again.
+func (p *proxy) download(dir string, uc *omaha.UpdateResponse) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.payloads[dir]; ok {
+		return
+	}
+
+	pl := &payload{
+		pkgs: uc.Manifest.Packages,
+		done: make(chan struct{}),
+	}
+	p.payloads[dir] = pl
+
+	go func() {
+		pl.err = p.fetchPackages(filepath.Join(p.dir, dir), uc)
+		close(pl.done)
+
+		// Try again on the next update check.
+		if pl.err != nil {
+			log.Printf("omaha-proxy: downloading %s failed: %v", dir, pl.err)
+			p.mu.Lock()
+			delete(p.payloads, dir)
+			p.mu.Unlock()
+		}
+	}()
+}
+
+func (p *proxy) fetchPackages(path string, uc *omaha.UpdateResponse) error {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+
+	for _, pkg := range uc.Manifest.Packages {
+		if pkg.Verify(path) == nil {
+			continue
+		}
+		if _, err := p.upstream.DownloadPackage(uc, pkg, path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// servePayload serves cached packages, waiting for downloads in progress.
+func (p *proxy) servePayload(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, payloadPrefix), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	dir, name := parts[0], parts[1]
+	p.mu.Lock()
+	pl, ok := p.payloads[dir]
+	p.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var pkg *omaha.Package
+	for _, pp := range pl.pkgs {
+		if pp.Name == name {
+			pkg = pp
+		}
+	}
+	if pkg == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	select {
+	case <-pl.done:
+	case <-r.Context().Done():
+		return
+	}
+
+	if pl.err != nil {
+		http.Error(w, "payload download failed", http.StatusBadGateway)
+		return
+	}
+
+	h := omaha.NewPackageHandler(filepath.Join(p.dir, dir, name), pkg)
+	h.ServeHTTP(w, r)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+func main() {
+	server := flag.String("server", "", "Replay against the omaha server at this URL")
+	pkgfile := flag.String("package-file", "", "Replay against a local server offering this update payload")
+	version := flag.String("package-version", "", "Semantic version of the package provided")
+	compare := flag.Bool("compare", false, "Report responses that differ from the recording")
+	fixtures := flag.String("save-fixtures", "", "Save each replayed exchange as a fixture directory under this path")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] RECORDING|FIXTURE-DIR...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Replays recorded omaha requests, printing the new exchanges as records.\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	records, err := load(flag.Args())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var replay func(*omaha.Record) *omaha.Record
+	switch {
+	case *server != "" && *pkgfile != "":
+		fmt.Println("server and package-file are mutually exclusive")
+		os.Exit(1)
+	case *server != "":
+		endpoint, err := endpointURL(*server)
+		if err != nil {
+			fmt.Printf("invalid server URL: %v\n", err)
+			os.Exit(1)
+		}
+		replay = func(rec *omaha.Record) *omaha.Record {
+			return post(endpoint, rec)
+		}
+	case *pkgfile != "":
+		if *version == "" {
+			fmt.Println("package-version is required with package-file")
+			os.Exit(1)
+		}
+		// The server is only used for its Updater, it never listens.
+		ts, err := omaha.NewTrivialServer("127.0.0.1:0")
+		if err != nil {
+			fmt.Printf("failed to make new server: %v\n", err)
+			os.Exit(1)
+		}
+		defer ts.Destroy()
+		ts.SetVersion(*version)
+		if err := ts.AddPackage(*pkgfile, "update.gz"); err != nil {
+			fmt.Printf("failed to add package: %v\n", err)
+			os.Exit(1)
+		}
+		replay = func(rec *omaha.Record) *omaha.Record {
+			return omaha.Replay(ts.Updater, rec)
+		}
+	default:
+		replay = func(rec *omaha.Record) *omaha.Record {
+			return omaha.Replay(omaha.UpdaterStub{}, rec)
+		}
+	}
+
+	out := omaha.NewRecorder(os.Stdout)
+	differ := 0
+	for i, rec := range records {
+		replayed := replay(rec)
+		if err := out.Record(replayed); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		if *fixtures != "" {
+			dir := filepath.Join(*fixtures, fmt.Sprintf("%03d", i))
+			if err := replayed.WriteFixture(dir); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+
+		if *compare && !sameResponse(rec, replayed) {
+			fmt.Fprintf(os.Stderr, "record %d: response differs\n", i)
+			differ++
+		}
+	}
+
+	if differ != 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d responses differ\n", differ, len(records))
+		os.Exit(2)
+	}
+}
+
+// load reads records from recording files and fixture directories.
+func load(paths []string) ([]*omaha.Record, error) {
+	var records []*omaha.Record
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if fi.IsDir() {
+			rec, err := omaha.LoadFixture(path)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, rec)
+			continue
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		recs, err := omaha.ReadRecords(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		records = append(records, recs...)
+	}
+	return records, nil
+}
+
+// endpointURL assumes /v1/update/ if the URL has no path, like the client.
+func endpointURL(server string) (string, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/update/"
+	}
+	return u.String(), nil
+}
+
+// post sends the recorded request to a real server.
+func post(endpoint string, rec *omaha.Record) *omaha.Record {
+	replayed := &omaha.Record{
+		Time:    time.Now().UTC(),
+		URL:     endpoint,
+		Request: rec.Request,
+	}
+
+	resp, err := http.Post(endpoint, "text/xml; charset=utf-8",
+		bytes.NewReader([]byte(rec.Request)))
+	if err != nil {
+		replayed.Error = err.Error()
+		return replayed
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		replayed.Error = err.Error()
+	}
+	replayed.Status = resp.StatusCode
+	replayed.Response = string(body)
+	return replayed
+}
+
+// sameResponse compares the parsed responses, ignoring the time of day.
+// Unparsable responses must match exactly.
+func sameResponse(a, b *omaha.Record) bool {
+	if a.Status != 0 && a.Status != b.Status {
+		return false
+	}
+
+	ra, erra := a.ParseResponse()
+	rb, errb := b.ParseResponse()
+	if erra != nil || errb != nil {
+		return a.Response == b.Response
+	}
+
+	ra.DayStart, rb.DayStart = omaha.DayStart{}, omaha.DayStart{}
+	return reflect.DeepEqual(ra, rb)
+}
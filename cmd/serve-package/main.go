@@ -12,6 +12,19 @@ func main() {
 	pkgfile := flag.String("package-file", "", "Path to the update payload")
 	version := flag.String("package-version", "", "Semantic version of the package provided")
 	listenAddress := flag.String("listen-address", ":8000", "Host and IP to listen on")
+	signingKey := flag.String("signing-key", "", "Path to a PEM private key used to sign the package")
+	record := flag.String("record", "", "Append all omaha requests and responses to this file")
+	cacheControl := flag.String("cache-control", "", "Cache-Control header to send with the package")
+	rateLimit := flag.Int64("rate-limit", 0, "Limit each package download to this many bytes per second")
+	hashCache := flag.String("hash-cache", "", "Remember package hashes in this file to speed up restarts")
+	clientRate := flag.Float64("client-rate", 0, "Limit each client address and machine to this many requests per second")
+	authToken := flag.String("auth-token", "", "Only serve clients sending this bearer token")
+	eventLog := flag.String("event-log", "", "Append client events to this file as JSON lines")
+	eventWebhook := flag.String("event-webhook", "", "POST batches of client events to this URL")
+	hashChunkSize := flag.Int("hash-chunk-size", 0, "Hash packages concurrently in chunks of this many bytes")
+	adminToken := flag.String("admin-token", "", "Serve the admin API at "+omaha.AdminPrefix+" protected by this bearer token")
+	appID := flag.String("app-id", "{e96281a6-d1af-4bde-9a0a-97b76e56dc57}", "Application ID to serve the package to when the admin API is enabled")
+	track := flag.String("track", "stable", "Track to serve the package on when the admin API is enabled")
 
 	flag.Parse()
 
@@ -32,12 +45,85 @@ func main() {
 	}
 
 	server.SetVersion(*version)
+	if *signingKey != "" {
+		key, err := omaha.LoadPrivateKey(*signingKey)
+		if err != nil {
+			fmt.Printf("failed to load signing key: %v\n", err)
+			os.Exit(1)
+		}
+		if err := server.SetSigningKey(key); err != nil {
+			fmt.Printf("failed to set signing key: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *record != "" {
+		f, err := os.OpenFile(*record, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			fmt.Printf("failed to open record file: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		server.SetRecorder(omaha.NewRecorder(f))
+	}
+
+	if *clientRate > 0 {
+		limit := omaha.RateLimit{Rate: *clientRate, Burst: 10}
+		server.SetLimiter(omaha.NewLimiter(omaha.Limits{
+			PerIP:      limit,
+			PerMachine: limit,
+			MaxApps:    100,
+			MaxEvents:  100,
+		}))
+	}
+
+	if *authToken != "" {
+		server.SetAuthenticator(omaha.NewTokenAuth(*authToken))
+	}
+
+	if *eventLog != "" || *eventWebhook != "" {
+		bus := omaha.NewEventBus()
+		if *eventLog != "" {
+			sink, err := omaha.NewFileSink(*eventLog)
+			if err != nil {
+				fmt.Printf("failed to open event log: %v\n", err)
+				os.Exit(1)
+			}
+			bus.AddSink(sink, 1000)
+		}
+		if *eventWebhook != "" {
+			bus.AddSink(omaha.NewWebhookSink(*eventWebhook), 1000)
+		}
+		defer bus.Close()
+		server.SetEventBus(bus)
+	}
+
+	if *hashCache != "" || *hashChunkSize != 0 {
+		hc, err := omaha.NewHashCache(*hashCache)
+		if err != nil {
+			fmt.Printf("failed to load hash cache: %v\n", err)
+			os.Exit(1)
+		}
+		hc.ChunkSize = *hashChunkSize
+		server.SetHashCache(hc)
+	}
+
+	server.SetCacheControl(*cacheControl)
+	server.SetRateLimit(*rateLimit)
+
 	err = server.AddPackage(*pkgfile, "update.gz")
 	if err != nil {
 		fmt.Printf("failed to add package: %v\n", err)
 		os.Exit(1)
 	}
 
+	if *adminToken != "" {
+		if _, err := server.HandleAdmin(*appID, *track, *adminToken); err != nil {
+			fmt.Printf("failed to enable admin API: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	err = server.Serve()
 	if err != nil {
 		fmt.Printf("server exited with an error: %v\n", err)
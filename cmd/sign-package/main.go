@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+func main() {
+	keyfile := flag.String("key", "", "Path to the PEM private key")
+	genkey := flag.Bool("genkey", false, "Generate a new Ed25519 key, writing the public key to KEY.pub")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -key KEY [-genkey | FILE]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Prints the signature of FILE for the postinstall PayloadSignature attribute.\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *keyfile == "" {
+		fmt.Println("key is a required flag")
+		os.Exit(1)
+	}
+
+	if *genkey {
+		if err := generateKey(*keyfile); err != nil {
+			fmt.Printf("failed to generate key: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	key, err := omaha.LoadPrivateKey(*keyfile)
+	if err != nil {
+		fmt.Printf("failed to load key: %v\n", err)
+		os.Exit(1)
+	}
+
+	m := omaha.Manifest{}
+	if _, err := m.AddPackageFromPath(flag.Arg(0)); err != nil {
+		fmt.Printf("failed to hash package: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := m.Sign(key); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	sig, _ := m.PostinstallAction().Attr(omaha.PayloadSignatureAttr)
+	fmt.Println(sig)
+}
+
+func generateKey(path string) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+
+	privPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})
+	if err := ioutil.WriteFile(path, privPEM, 0600); err != nil {
+		return err
+	}
+
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+	if err := ioutil.WriteFile(path+".pub", pubPEM, 0644); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,640 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"crypto"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const AdminPrefix = "/v1/admin/"
+
+// AdminHandler is a JSON API for managing a Catalog while it is serving.
+// Every request must carry the token as "Authorization: Bearer <token>".
+// Paths are relative to AdminPrefix:
+//
+//	GET    apps                                 list applications
+//	POST   apps                                 add an application: {"id": ...}
+//	GET    apps/<app>                           show an application
+//	PUT    apps/<app>                           replace its tracks and pins
+//	DELETE apps/<app>                           remove an application
+//	GET    apps/<app>/stats                     instance and event counts
+//	GET    apps/<app>/instances                 last check in of each instance
+//	GET    apps/<app>/tracks/<track>            show a track
+//	PUT    apps/<app>/tracks/<track>            set its version: {"version": ...}
+//	                                            or replace it if updates are given
+//	DELETE apps/<app>/tracks/<track>            remove a track
+//	POST   apps/<app>/tracks/<track>/pause      stop offering updates
+//	POST   apps/<app>/tracks/<track>/resume     start offering updates again,
+//	                                            including halted versions
+//	POST   apps/<app>/tracks/<track>/updates    add an update, creating the track
+//	PUT    apps/<app>/tracks/<track>/updates    add or replace an update
+//	DELETE apps/<app>/tracks/<track>/updates/<version>[?previous=<version>]
+//	                                            remove updates to a version
+//	PUT    apps/<app>/pins/<machine>            pin a machine: {"version": ...}
+//	DELETE apps/<app>/pins/<machine>            unpin a machine
+//	GET    overrides                            list overrides
+//	PUT    overrides/<name>                     add or replace an Override
+//	DELETE overrides/<name>                     remove an override
+//	GET    limits                               rate limits and rejections
+//	GET    health                               release health of all apps
+//	GET    apps/<app>/health                    release health of an app
+type AdminHandler struct {
+	Catalog *Catalog
+	Token   string
+
+	// Blobs, if not nil, allows packages to be added by blob key.
+	Blobs *BlobStore
+
+	// Overrides, if not nil, enables managing overrides.
+	Overrides *OverrideUpdater
+
+	// Limiter, if not nil, enables reporting rate limit statistics.
+	Limiter *Limiter
+
+	// Health, if not nil, enables reporting release health.
+	Health *HealthAggregator
+
+	// Key, if not nil, signs the payload of updates that are added
+	// without a PayloadSignature attribute.
+	Key crypto.Signer
+
+	// Validate, if not nil, is called with every update added through
+	// the API, which is rejected if it returns an error.
+	Validate func(*Update) error
+}
+
+func NewAdminHandler(c *Catalog, token string) *AdminHandler {
+	return &AdminHandler{Catalog: c, Token: token}
+}
+
+type adminApp struct {
+	ID     string            `json:"id"`
+	Tracks []*adminTrack     `json:"tracks"`
+	Pins   map[string]string `json:"pins,omitempty"`
+}
+
+type adminTrack struct {
+	Name    string         `json:"name"`
+	Version string         `json:"version"`
+	Paused  bool           `json:"paused"`
+	Halted  []string       `json:"halted,omitempty"`
+	Updates []*adminUpdate `json:"updates"`
+}
+
+type adminUpdate struct {
+	Version         string          `json:"version"`
+	PreviousVersion string          `json:"previous_version,omitempty"`
+	Delta           bool            `json:"delta,omitempty"`
+	CodeBase        string          `json:"codebase"`
+	Packages        []*adminPackage `json:"packages"`
+
+	// Attrs are extra attributes of the postinstall action, such as
+	// PayloadSignature or update_engine's MetadataSize.
+	Attrs map[string]string `json:"attrs,omitempty"`
+}
+
+type adminPackage struct {
+	Name     string `json:"name"`
+	SHA1     string `json:"sha1,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+	Size     uint64 `json:"size,omitempty"`
+	Required bool   `json:"required,omitempty"`
+
+	// Blob fills in the hashes and size from a stored blob.
+	Blob string `json:"blob,omitempty"`
+}
+
+type adminVersion struct {
+	Version string `json:"version"`
+}
+
+type adminLimits struct {
+	Limits Limits     `json:"limits"`
+	Stats  LimitStats `json:"stats"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func (ah *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !ah.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="omaha"`)
+		adminReply(w, http.StatusUnauthorized, &adminError{"unauthorized"})
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, AdminPrefix), "/")
+	parts := strings.Split(path, "/")
+	if parts[0] == "overrides" && ah.Overrides != nil {
+		ah.serveOverrides(w, r, parts[1:])
+		return
+	}
+	if len(parts) == 1 && parts[0] == "limits" && ah.Limiter != nil {
+		adminGet(w, r, func() interface{} {
+			return &adminLimits{ah.Limiter.Limits(), ah.Limiter.Stats()}
+		})
+		return
+	}
+	if len(parts) == 1 && parts[0] == "health" && ah.Health != nil {
+		adminGet(w, r, func() interface{} { return ah.Health.Releases("") })
+		return
+	}
+	if parts[0] != "apps" {
+		adminReply(w, http.StatusNotFound, &adminError{"not found"})
+		return
+	}
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case "GET":
+			ah.listApps(w)
+		case "POST":
+			ah.addApp(w, r)
+		default:
+			adminMethodNotAllowed(w, "GET, POST")
+		}
+		return
+	}
+
+	app := ah.Catalog.App(parts[1])
+	if app == nil {
+		adminReply(w, http.StatusNotFound, &adminError{"unknown app " + parts[1]})
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && r.Method == "PUT":
+		ah.replaceApp(w, r, app.ID)
+	case len(parts) == 2 && r.Method == "DELETE":
+		if err := ah.Catalog.RemoveApp(app.ID); err != nil {
+			adminReply(w, http.StatusNotFound, &adminError{err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && r.Method != "GET":
+		adminMethodNotAllowed(w, "GET, PUT, DELETE")
+	case len(parts) == 2:
+		adminGet(w, r, func() interface{} { return newAdminApp(app) })
+	case len(parts) == 3 && parts[2] == "stats":
+		adminGet(w, r, func() interface{} { return ah.Catalog.Stats(app.ID) })
+	case len(parts) == 3 && parts[2] == "instances":
+		adminGet(w, r, func() interface{} { return ah.Catalog.Instances(app.ID) })
+	case len(parts) == 3 && parts[2] == "health" && ah.Health != nil:
+		adminGet(w, r, func() interface{} { return ah.Health.Releases(app.ID) })
+	case len(parts) >= 4 && parts[2] == "tracks":
+		ah.serveTrack(w, r, app, parts[3], parts[4:])
+	case len(parts) == 4 && parts[2] == "pins":
+		ah.servePin(w, r, app, parts[3])
+	default:
+		adminReply(w, http.StatusNotFound, &adminError{"not found"})
+	}
+}
+
+func (ah *AdminHandler) authorized(r *http.Request) bool {
+	// An empty token would let anyone in.
+	if ah.Token == "" {
+		return false
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(ah.Token)) == 1
+}
+
+func (ah *AdminHandler) listApps(w http.ResponseWriter) {
+	apps := []*adminApp{}
+	for _, app := range ah.Catalog.Apps() {
+		apps = append(apps, newAdminApp(app))
+	}
+	adminReply(w, http.StatusOK, apps)
+}
+
+func (ah *AdminHandler) addApp(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ID string `json:"id"`
+	}
+	if !adminDecode(w, r, &body) {
+		return
+	}
+
+	if err := ah.Catalog.AddApp(body.ID); err != nil {
+		adminReply(w, http.StatusBadRequest, &adminError{err.Error()})
+		return
+	}
+
+	adminReply(w, http.StatusCreated, newAdminApp(ah.Catalog.App(body.ID)))
+}
+
+func (ah *AdminHandler) replaceApp(w http.ResponseWriter, r *http.Request, appID string) {
+	var body struct {
+		Tracks []*adminTrack     `json:"tracks"`
+		Pins   map[string]string `json:"pins"`
+	}
+	if !adminDecode(w, r, &body) {
+		return
+	}
+
+	app := &CatalogApp{ID: appID, Pins: body.Pins}
+	for _, at := range body.Tracks {
+		ct, err := ah.newTrack(appID, at)
+		if err != nil {
+			adminReply(w, http.StatusBadRequest, &adminError{err.Error()})
+			return
+		}
+		app.Tracks = append(app.Tracks, ct)
+	}
+
+	if err := ah.Catalog.ReplaceApp(app); err != nil {
+		adminReply(w, http.StatusBadRequest, &adminError{err.Error()})
+		return
+	}
+
+	adminReply(w, http.StatusOK, newAdminApp(ah.Catalog.App(appID)))
+}
+
+// newTrack converts a track from the admin API, building its updates
+// with newUpdate.
+func (ah *AdminHandler) newTrack(appID string, at *adminTrack) (*CatalogTrack, error) {
+	ct := &CatalogTrack{
+		Name:    at.Name,
+		Version: at.Version,
+		Paused:  at.Paused,
+		Halted:  at.Halted,
+	}
+	for _, au := range at.Updates {
+		u, err := ah.newUpdate(appID, au)
+		if err != nil {
+			return nil, err
+		}
+		ct.Updates = append(ct.Updates, u)
+	}
+	return ct, nil
+}
+
+func (ah *AdminHandler) serveTrack(w http.ResponseWriter, r *http.Request, app *CatalogApp, name string, rest []string) {
+	var track *CatalogTrack
+	for _, t := range app.Tracks {
+		if t.Name == name {
+			track = t
+		}
+	}
+
+	// Adding an update or replacing a track creates it.
+	if len(rest) == 1 && rest[0] == "updates" {
+		switch r.Method {
+		case "POST":
+			ah.addUpdate(w, r, app.ID, name, false)
+		case "PUT":
+			ah.addUpdate(w, r, app.ID, name, true)
+		default:
+			adminMethodNotAllowed(w, "POST, PUT")
+		}
+		return
+	}
+	if len(rest) == 0 && r.Method == "PUT" {
+		ah.putTrack(w, r, app.ID, name, track != nil)
+		return
+	}
+
+	if track == nil {
+		adminReply(w, http.StatusNotFound, &adminError{fmt.Sprintf("unknown track %q", name)})
+		return
+	}
+
+	var err error
+	switch {
+	case len(rest) == 0 && r.Method == "GET":
+		adminReply(w, http.StatusOK, newAdminTrack(track))
+		return
+	case len(rest) == 0 && r.Method == "DELETE":
+		if err := ah.Catalog.RemoveTrack(app.ID, name); err != nil {
+			adminReply(w, http.StatusNotFound, &adminError{err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case len(rest) == 0:
+		adminMethodNotAllowed(w, "GET, PUT, DELETE")
+		return
+	case len(rest) == 2 && rest[0] == "updates":
+		if r.Method != "DELETE" {
+			adminMethodNotAllowed(w, "DELETE")
+			return
+		}
+		previous := r.URL.Query().Get("previous")
+		err = ah.Catalog.RemoveUpdate(app.ID, name, rest[1], previous)
+	case len(rest) == 1 && (rest[0] == "pause" || rest[0] == "resume"):
+		if r.Method != "POST" {
+			adminMethodNotAllowed(w, "POST")
+			return
+		}
+		if rest[0] == "pause" {
+			err = ah.Catalog.Pause(app.ID, name)
+		} else {
+			err = ah.Catalog.Resume(app.ID, name)
+		}
+	default:
+		adminReply(w, http.StatusNotFound, &adminError{"not found"})
+		return
+	}
+
+	if err != nil {
+		adminReply(w, http.StatusBadRequest, &adminError{err.Error()})
+		return
+	}
+
+	ah.replyTrack(w, http.StatusOK, app.ID, name)
+}
+
+// putTrack sets the version of an existing track or, if the body has
+// updates, replaces or creates the track with them.
+func (ah *AdminHandler) putTrack(w http.ResponseWriter, r *http.Request, appID, name string, exists bool) {
+	var body adminTrack
+	if !adminDecode(w, r, &body) {
+		return
+	}
+
+	var err error
+	if body.Updates == nil && !exists {
+		adminReply(w, http.StatusNotFound, &adminError{fmt.Sprintf("unknown track %q", name)})
+		return
+	} else if body.Updates != nil {
+		body.Name = name
+		var ct *CatalogTrack
+		if ct, err = ah.newTrack(appID, &body); err == nil {
+			err = ah.Catalog.ReplaceTrack(appID, name, ct)
+		}
+	} else {
+		err = ah.Catalog.SetVersion(appID, name, body.Version)
+	}
+	if err != nil {
+		adminReply(w, http.StatusBadRequest, &adminError{err.Error()})
+		return
+	}
+
+	ah.replyTrack(w, http.StatusOK, appID, name)
+}
+
+// addUpdate adds an update to a track or, if replace is set, replaces
+// the update to the same version from the same previous version.
+func (ah *AdminHandler) addUpdate(w http.ResponseWriter, r *http.Request, appID, track string, replace bool) {
+	var body adminUpdate
+	if !adminDecode(w, r, &body) {
+		return
+	}
+
+	u, err := ah.newUpdate(appID, &body)
+	if err == nil && replace {
+		err = ah.Catalog.ReplaceUpdate(track, u)
+	} else if err == nil {
+		err = ah.Catalog.AddUpdate(track, u)
+	}
+	if err != nil {
+		adminReply(w, http.StatusBadRequest, &adminError{err.Error()})
+		return
+	}
+
+	status := http.StatusCreated
+	if replace {
+		status = http.StatusOK
+	}
+	ah.replyTrack(w, status, appID, track)
+}
+
+// newUpdate builds an update the same way TrivialServer does, with an
+// update_engine postinstall action for the first package, signed with
+// Key unless a signature is given.
+func (ah *AdminHandler) newUpdate(appID string, au *adminUpdate) (*Update, error) {
+	if len(au.Packages) == 0 {
+		return nil, fmt.Errorf("omaha: update to %s has no packages", au.Version)
+	}
+
+	u := &Update{
+		ID:              appID,
+		PreviousVersion: au.PreviousVersion,
+		URL:             URL{CodeBase: au.CodeBase},
+		Manifest:        Manifest{Version: au.Version},
+	}
+
+	for _, ap := range au.Packages {
+		var pkg *Package
+		if ap.Blob != "" {
+			if ah.Blobs == nil {
+				return nil, fmt.Errorf("omaha: package %q: no blob store", ap.Name)
+			}
+			p, err := u.Manifest.AddPackageFromBlob(ah.Blobs, ap.Blob, ap.Name)
+			if err != nil {
+				return nil, fmt.Errorf("omaha: package %q: %v", ap.Name, err)
+			}
+			pkg = p
+		} else {
+			if ap.Name == "" || ap.SHA1 == "" {
+				return nil, fmt.Errorf("omaha: package %q needs a name and sha1", ap.Name)
+			}
+			pkg = u.Manifest.AddPackage()
+			pkg.Name = ap.Name
+			pkg.SHA1 = ap.SHA1
+			pkg.SHA256 = ap.SHA256
+			pkg.Size = ap.Size
+		}
+		pkg.Required = ap.Required
+	}
+
+	act := u.Manifest.AddAction("postinstall")
+	act.DisablePayloadBackoff = true
+	act.SHA256 = u.Manifest.Packages[0].SHA256
+	act.IsDeltaPayload = au.Delta
+
+	// Sorted to keep the response stable.
+	names := make([]string, 0, len(au.Attrs))
+	for name := range au.Attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		act.SetAttr(name, au.Attrs[name])
+	}
+
+	if _, ok := act.Attr(PayloadSignatureAttr); !ok && ah.Key != nil {
+		if err := u.Manifest.Sign(ah.Key); err != nil {
+			return nil, err
+		}
+	}
+
+	if ah.Validate != nil {
+		if err := ah.Validate(u); err != nil {
+			return nil, err
+		}
+	}
+
+	return u, nil
+}
+
+func (ah *AdminHandler) servePin(w http.ResponseWriter, r *http.Request, app *CatalogApp, machineID string) {
+	switch r.Method {
+	case "PUT":
+		var body adminVersion
+		if !adminDecode(w, r, &body) {
+			return
+		}
+		if err := ah.Catalog.PinMachine(app.ID, machineID, body.Version); err != nil {
+			adminReply(w, http.StatusBadRequest, &adminError{err.Error()})
+			return
+		}
+	case "DELETE":
+		ah.Catalog.UnpinMachine(app.ID, machineID)
+	default:
+		adminMethodNotAllowed(w, "PUT, DELETE")
+		return
+	}
+
+	adminReply(w, http.StatusOK, newAdminApp(ah.Catalog.App(app.ID)))
+}
+
+func (ah *AdminHandler) serveOverrides(w http.ResponseWriter, r *http.Request, rest []string) {
+	if len(rest) == 0 {
+		adminGet(w, r, func() interface{} { return ah.Overrides.Overrides() })
+		return
+	}
+	if len(rest) != 1 {
+		adminReply(w, http.StatusNotFound, &adminError{"not found"})
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		var o Override
+		if !adminDecode(w, r, &o) {
+			return
+		}
+		o.Name = rest[0]
+		if err := ah.Overrides.Set(o); err != nil {
+			adminReply(w, http.StatusBadRequest, &adminError{err.Error()})
+			return
+		}
+		adminReply(w, http.StatusOK, &o)
+	case "DELETE":
+		if !ah.Overrides.Remove(rest[0]) {
+			adminReply(w, http.StatusNotFound, &adminError{fmt.Sprintf("unknown override %q", rest[0])})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		adminMethodNotAllowed(w, "PUT, DELETE")
+	}
+}
+
+func (ah *AdminHandler) replyTrack(w http.ResponseWriter, status int, appID, name string) {
+	for _, t := range ah.Catalog.App(appID).Tracks {
+		if t.Name == name {
+			adminReply(w, status, newAdminTrack(t))
+			return
+		}
+	}
+	adminReply(w, http.StatusNotFound, &adminError{fmt.Sprintf("unknown track %q", name)})
+}
+
+func newAdminApp(app *CatalogApp) *adminApp {
+	aa := &adminApp{
+		ID:     app.ID,
+		Tracks: []*adminTrack{},
+		Pins:   app.Pins,
+	}
+	for _, t := range app.Tracks {
+		aa.Tracks = append(aa.Tracks, newAdminTrack(t))
+	}
+	return aa
+}
+
+func newAdminTrack(t *CatalogTrack) *adminTrack {
+	at := &adminTrack{
+		Name:    t.Name,
+		Version: t.Version,
+		Paused:  t.Paused,
+		Halted:  t.Halted,
+		Updates: []*adminUpdate{},
+	}
+	for _, u := range t.Updates {
+		au := &adminUpdate{
+			Version:         u.Manifest.Version,
+			PreviousVersion: u.PreviousVersion,
+			Delta:           u.IsDelta(),
+			CodeBase:        u.URL.CodeBase,
+		}
+		for _, pkg := range u.Manifest.Packages {
+			au.Packages = append(au.Packages, &adminPackage{
+				Name:     pkg.Name,
+				SHA1:     pkg.SHA1,
+				SHA256:   pkg.SHA256,
+				Size:     pkg.Size,
+				Required: pkg.Required,
+			})
+		}
+		if act := u.Manifest.PostinstallAction(); act != nil && len(act.ExtraAttrs) != 0 {
+			au.Attrs = make(map[string]string)
+			for _, attr := range act.ExtraAttrs {
+				au.Attrs[attr.Name.Local] = attr.Value
+			}
+		}
+		at.Updates = append(at.Updates, au)
+	}
+	return at
+}
+
+func adminGet(w http.ResponseWriter, r *http.Request, get func() interface{}) {
+	if r.Method != "GET" {
+		adminMethodNotAllowed(w, "GET")
+		return
+	}
+	adminReply(w, http.StatusOK, get())
+}
+
+func adminDecode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024*1024))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		adminReply(w, http.StatusBadRequest, &adminError{"invalid request: " + err.Error()})
+		return false
+	}
+	return true
+}
+
+func adminMethodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	adminReply(w, http.StatusMethodNotAllowed, &adminError{"method not allowed"})
+}
+
+func adminReply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("omaha: Failed writing admin response: %v", err)
+	}
+}
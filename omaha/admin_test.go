@@ -0,0 +1,267 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testAdminToken = "secret"
+
+func adminDo(h http.Handler, token, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, AdminPrefix+path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminAuth(t *testing.T) {
+	for _, tt := range []struct {
+		configured string
+		sent       string
+	}{
+		{testAdminToken, ""},
+		{testAdminToken, "wrong"},
+		{"", ""},
+	} {
+		h := NewAdminHandler(NewCatalog(), tt.configured)
+		w := adminDo(h, tt.sent, "GET", "apps", "")
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("token %q with %q: got %d", tt.configured, tt.sent, w.Code)
+		}
+	}
+
+	h := NewAdminHandler(NewCatalog(), testAdminToken)
+	if w := adminDo(h, testAdminToken, "GET", "apps", ""); w.Code != http.StatusOK {
+		t.Errorf("valid token rejected: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestAdminManage(t *testing.T) {
+	c := NewCatalog()
+	h := NewAdminHandler(c, testAdminToken)
+
+	for _, tt := range []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"POST", "apps", `{"id": "` + testAppID + `"}`, http.StatusCreated},
+		{"POST", "apps", `{"id": ""}`, http.StatusBadRequest},
+		{"POST", "apps", `{"bogus": 1}`, http.StatusBadRequest},
+		{"GET", "apps/" + testAppID, "", http.StatusOK},
+		{"GET", "apps/nope", "", http.StatusNotFound},
+		{"GET", "apps/" + testAppID + "/tracks/stable", "", http.StatusNotFound},
+		{"POST", "apps/" + testAppID + "/tracks/stable/updates",
+			`{"version": "1.1.0", "codebase": "/packages/", "packages": [{"name": "update.gz", "sha1": "AAAA", "size": 4}]}`,
+			http.StatusCreated},
+		{"POST", "apps/" + testAppID + "/tracks/stable/updates",
+			`{"version": "1.2.0", "codebase": "/packages/", "packages": [{"name": "update.gz", "sha1": "BBBB", "size": 4}]}`,
+			http.StatusCreated},
+		{"POST", "apps/" + testAppID + "/tracks/stable/updates",
+			`{"version": "1.3.0", "packages": []}`, http.StatusBadRequest},
+		{"POST", "apps/" + testAppID + "/tracks/stable/updates",
+			`{"version": "1.3.0", "packages": [{"name": "update.gz", "blob": "00"}]}`, http.StatusBadRequest},
+		{"PUT", "apps/" + testAppID + "/tracks/stable", `{"version": "1.2.0"}`, http.StatusOK},
+		{"PUT", "apps/" + testAppID + "/tracks/stable", `{"version": "9.9.9"}`, http.StatusBadRequest},
+		{"POST", "apps/" + testAppID + "/tracks/stable/pause", "", http.StatusOK},
+		{"GET", "apps/" + testAppID + "/tracks/stable/pause", "", http.StatusMethodNotAllowed},
+		{"PUT", "apps/" + testAppID + "/pins/m1", `{"version": "1.1.0"}`, http.StatusOK},
+		{"DELETE", "apps/" + testAppID + "/pins/m2", "", http.StatusOK},
+		{"GET", "apps/" + testAppID + "/stats", "", http.StatusOK},
+		{"GET", "apps/" + testAppID + "/instances", "", http.StatusOK},
+		{"GET", "apps/" + testAppID + "/bogus", "", http.StatusNotFound},
+		{"GET", "bogus", "", http.StatusNotFound},
+	} {
+		w := adminDo(h, testAdminToken, tt.method, tt.path, tt.body)
+		if w.Code != tt.code {
+			t.Errorf("%s %s: expected %d, got %d: %s", tt.method, tt.path, tt.code, w.Code, w.Body)
+		}
+	}
+
+	app := c.App(testAppID)
+	if len(app.Tracks) != 1 {
+		t.Fatalf("unexpected tracks %#v", app.Tracks)
+	}
+	track := app.Tracks[0]
+	if track.Version != "1.2.0" || !track.Paused || len(track.Updates) != 2 {
+		t.Errorf("unexpected track %#v", track)
+	}
+	if app.Pins["m1"] != "1.1.0" {
+		t.Errorf("unexpected pins %v", app.Pins)
+	}
+	if act := track.Updates[0].Manifest.PostinstallAction(); act == nil || !act.DisablePayloadBackoff {
+		t.Errorf("missing postinstall action %#v", track.Updates[0].Manifest.Actions)
+	}
+
+	w := adminDo(h, testAdminToken, "GET", "apps", "")
+	var apps []adminApp
+	if err := json.Unmarshal(w.Body.Bytes(), &apps); err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 1 || apps[0].Tracks[0].Updates[1].Packages[0].SHA1 != "BBBB" {
+		t.Errorf("unexpected listing %s", w.Body)
+	}
+}
+
+func TestAdminBlobPackage(t *testing.T) {
+	s, dir, cleanup := newTestBlobStore(t)
+	defer cleanup()
+	info := addTestBlob(t, s, dir, "payload", "test")
+
+	c := NewCatalog()
+	h := NewAdminHandler(c, testAdminToken)
+	h.Blobs = s
+
+	w := adminDo(h, testAdminToken, "POST", "apps", `{"id": "`+testAppID+`"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+
+	w = adminDo(h, testAdminToken, "POST", "apps/"+testAppID+"/tracks/stable/updates",
+		`{"version": "1.1.0", "codebase": "/blobs/`+info.Key+`/", "packages": [{"name": "update.gz", "blob": "`+info.Key+`"}]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+
+	pkg := c.App(testAppID).Tracks[0].Updates[0].Manifest.Packages[0]
+	if pkg.SHA256 != info.SHA256 || pkg.Size != 4 || pkg.Name != "update.gz" {
+		t.Errorf("unexpected package %#v", pkg)
+	}
+}
+
+func TestAdminSignature(t *testing.T) {
+	c := NewCatalog()
+	h := NewAdminHandler(c, testAdminToken)
+	h.Key = testSigners(t)[0]
+
+	const (
+		track  = "apps/" + testAppID + "/tracks/stable"
+		sha256 = "n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg="
+	)
+	if w := adminDo(h, testAdminToken, "POST", "apps", `{"id": "`+testAppID+`"}`); w.Code != http.StatusCreated {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	w := adminDo(h, testAdminToken, "POST", track+"/updates",
+		`{"version": "1.1.0", "packages": [{"name": "update.gz", "sha1": "AAAA", "sha256": "`+sha256+`"}],
+		  "attrs": {"MetadataSize": "1234"}}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+
+	act := c.App(testAppID).Tracks[0].Updates[0].Manifest.PostinstallAction()
+	sig, err := act.PayloadSignature()
+	if err != nil || sig == nil {
+		t.Fatalf("update not signed: %v %#v", err, act)
+	}
+	if size, _ := act.Attr("MetadataSize"); size != "1234" {
+		t.Errorf("MetadataSize not set: %#v", act)
+	}
+
+	// Putting back what was read keeps the signature and attributes.
+	h.Key = nil
+	w = adminDo(h, testAdminToken, "GET", track, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	if w = adminDo(h, testAdminToken, "PUT", track, w.Body.String()); w.Code != http.StatusOK {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+
+	act = c.App(testAppID).Tracks[0].Updates[0].Manifest.PostinstallAction()
+	if got, _ := act.PayloadSignature(); string(got) != string(sig) {
+		t.Errorf("signature lost: %#v", act)
+	}
+	if size, _ := act.Attr("MetadataSize"); size != "1234" {
+		t.Errorf("MetadataSize lost: %#v", act)
+	}
+}
+
+func TestAdminLimits(t *testing.T) {
+	h := NewAdminHandler(NewCatalog(), testAdminToken)
+	if w := adminDo(h, testAdminToken, "GET", "limits", ""); w.Code != http.StatusNotFound {
+		t.Errorf("limits served without a limiter: %d", w.Code)
+	}
+
+	h.Limiter = NewLimiter(Limits{MaxApps: 5})
+	w := adminDo(h, testAdminToken, "GET", "limits", "")
+	var resp adminLimits
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Limits.MaxApps != 5 {
+		t.Errorf("unexpected limits %s", w.Body)
+	}
+}
+
+func TestAdminRemoveReplace(t *testing.T) {
+	c := NewCatalog()
+	h := NewAdminHandler(c, testAdminToken)
+
+	const (
+		app    = "apps/" + testAppID
+		full   = `{"version": "1.1.0", "packages": [{"name": "update.gz", "sha1": "AAAA"}]}`
+		fixed  = `{"version": "1.1.0", "packages": [{"name": "update.gz", "sha1": "CCCC"}]}`
+		delta  = `{"version": "1.1.0", "previous_version": "1.0.0", "delta": true, "packages": [{"name": "delta.gz", "sha1": "DDDD"}]}`
+		second = `{"version": "1.2.0", "packages": [{"name": "update.gz", "sha1": "BBBB"}]}`
+	)
+	for _, tt := range []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"POST", "apps", `{"id": "` + testAppID + `"}`, http.StatusCreated},
+		{"POST", app + "/tracks/stable/updates", full, http.StatusCreated},
+		{"POST", app + "/tracks/stable/updates", delta, http.StatusCreated},
+		{"PUT", app + "/tracks/stable/updates", fixed, http.StatusOK},
+		{"DELETE", app + "/tracks/stable/updates/1.1.0?previous=1.0.0", "", http.StatusOK},
+		{"DELETE", app + "/tracks/stable/updates/1.1.0?previous=1.0.0", "", http.StatusBadRequest},
+		{"DELETE", app + "/tracks/stable/updates/1.1.0", "", http.StatusBadRequest},
+		{"PUT", app + "/tracks/beta", `{"version": "1.2.0"}`, http.StatusNotFound},
+		{"PUT", app + "/tracks/beta", `{"updates": [` + second + `]}`, http.StatusOK},
+		{"PUT", app + "/tracks/beta", `{"version": "2.0.0", "updates": [` + second + `]}`, http.StatusBadRequest},
+		{"DELETE", app + "/tracks/beta", "", http.StatusNoContent},
+		{"DELETE", app + "/tracks/beta", "", http.StatusNotFound},
+		{"PUT", app, `{"tracks": [{"name": "alpha", "updates": [` + second + `]}], "pins": {"m1": "1.2.0"}}`, http.StatusOK},
+		{"PUT", app, `{"tracks": [{"name": "alpha", "version": "9.9.9", "updates": []}]}`, http.StatusBadRequest},
+	} {
+		w := adminDo(h, testAdminToken, tt.method, tt.path, tt.body)
+		if w.Code != tt.code {
+			t.Errorf("%s %s: expected %d, got %d: %s", tt.method, tt.path, tt.code, w.Code, w.Body)
+		}
+	}
+
+	a := c.App(testAppID)
+	if len(a.Tracks) != 1 || a.Tracks[0].Name != "alpha" || a.Tracks[0].Version != "1.2.0" ||
+		a.Pins["m1"] != "1.2.0" {
+		t.Errorf("app not replaced: %#v", a)
+	}
+
+	if w := adminDo(h, testAdminToken, "DELETE", app, ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE %s: %d %s", app, w.Code, w.Body)
+	}
+	if c.App(testAppID) != nil {
+		t.Error("app not removed")
+	}
+}
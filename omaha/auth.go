@@ -0,0 +1,191 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTP headers used by HMAC signed requests. The signature is the base64
+// HMAC-SHA256 of the date header, a newline, and the request body, keyed
+// by the machine's key.
+const (
+	HeaderMachineID = "X-Omaha-Machine-Id"
+	HeaderDate      = "X-Omaha-Date"
+	HeaderSignature = "X-Omaha-Signature"
+)
+
+var NoCredentialsError = errors.New("omaha: no credentials")
+
+// Identity is an authenticated client.
+type Identity struct {
+	// Name describes the credential, for logging.
+	Name string
+
+	// MachineID, if not blank, restricts the identity to apps sent
+	// with that machine ID, or user ID if no machine ID is set.
+	MachineID string
+}
+
+// Allows reports if the identity may make requests for an app.
+func (id *Identity) Allows(req *Request, app *AppRequest) bool {
+	if id == nil {
+		return false
+	}
+	return id.MachineID == "" || id.MachineID == machineID(req, app)
+}
+
+// Authenticator checks the credentials of an omaha request. The body is
+// the raw request as sent by the client.
+type Authenticator interface {
+	Authenticate(httpReq *http.Request, body []byte) (*Identity, error)
+}
+
+// MultiAuth accepts the first credentials any of its authenticators do.
+type MultiAuth []Authenticator
+
+func (ma MultiAuth) Authenticate(httpReq *http.Request, body []byte) (*Identity, error) {
+	err := NoCredentialsError
+	for _, a := range ma {
+		id, aerr := a.Authenticate(httpReq, body)
+		if aerr == nil {
+			return id, nil
+		}
+		// Report why presented credentials failed over missing ones.
+		if aerr != NoCredentialsError {
+			err = aerr
+		}
+	}
+	return nil, err
+}
+
+// TokenAuth accepts any of a set of shared bearer tokens, sent as
+// "Authorization: Bearer <token>". A token is trusted for any machine.
+type TokenAuth struct {
+	Tokens []string
+}
+
+func NewTokenAuth(tokens ...string) *TokenAuth {
+	return &TokenAuth{Tokens: tokens}
+}
+
+func (ta *TokenAuth) Authenticate(httpReq *http.Request, body []byte) (*Identity, error) {
+	auth := httpReq.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, NoCredentialsError
+	}
+
+	token := []byte(strings.TrimPrefix(auth, "Bearer "))
+	for i, t := range ta.Tokens {
+		if t != "" && subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+			return &Identity{Name: fmt.Sprintf("token %d", i)}, nil
+		}
+	}
+	return nil, errors.New("omaha: invalid bearer token")
+}
+
+// HMACAuth accepts requests signed with a key specific to the machine,
+// trusting them only for that machine's apps. Requests dated more than
+// MaxSkew from now are rejected to limit replays.
+type HMACAuth struct {
+	// Key returns the key for a machine, or nil if it is unknown.
+	Key func(machineID string) []byte
+
+	MaxSkew time.Duration
+}
+
+func NewHMACAuth(key func(machineID string) []byte) *HMACAuth {
+	return &HMACAuth{Key: key, MaxSkew: 5 * time.Minute}
+}
+
+// HMACMachineKey derives a machine's key from a secret shared by the
+// server, so keys can be issued to machines without keeping a list.
+func HMACMachineKey(secret []byte, machineID string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(machineID))
+	return mac.Sum(nil)
+}
+
+// HMACSign returns the signature header value for a request body.
+func HMACSign(key []byte, date string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(date))
+	mac.Write([]byte("\n"))
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (ha *HMACAuth) Authenticate(httpReq *http.Request, body []byte) (*Identity, error) {
+	machineID := httpReq.Header.Get(HeaderMachineID)
+	sig := httpReq.Header.Get(HeaderSignature)
+	if machineID == "" || sig == "" {
+		return nil, NoCredentialsError
+	}
+
+	date := httpReq.Header.Get(HeaderDate)
+	unix, err := strconv.ParseInt(date, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("omaha: invalid signature date %q", date)
+	}
+	skew := time.Since(time.Unix(unix, 0))
+	if skew < -ha.MaxSkew || skew > ha.MaxSkew {
+		return nil, fmt.Errorf("omaha: signature date off by %s", skew)
+	}
+
+	key := ha.Key(machineID)
+	if key == nil {
+		return nil, fmt.Errorf("omaha: no key for machine %q", machineID)
+	}
+
+	expect := HMACSign(key, date, body)
+	if !hmac.Equal([]byte(sig), []byte(expect)) {
+		return nil, fmt.Errorf("omaha: invalid signature for machine %q", machineID)
+	}
+
+	return &Identity{Name: "hmac " + machineID, MachineID: machineID}, nil
+}
+
+// TLSAuth accepts clients presenting a certificate verified by the
+// server's tls.Config, which must set ClientAuth to verify certificates
+// and ClientCAs to the CAs issuing them. If MatchMachineID is set the
+// certificate's common name must be the machine ID of the apps.
+type TLSAuth struct {
+	MatchMachineID bool
+}
+
+func (ta *TLSAuth) Authenticate(httpReq *http.Request, body []byte) (*Identity, error) {
+	if httpReq.TLS == nil || len(httpReq.TLS.VerifiedChains) == 0 {
+		return nil, NoCredentialsError
+	}
+
+	cert := httpReq.TLS.VerifiedChains[0][0]
+	id := &Identity{Name: "tls " + cert.Subject.CommonName}
+	if ta.MatchMachineID {
+		if cert.Subject.CommonName == "" {
+			return nil, errors.New("omaha: client certificate has no common name")
+		}
+		id.MachineID = cert.Subject.CommonName
+	}
+	return id, nil
+}
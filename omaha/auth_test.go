@@ -0,0 +1,173 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func mkAuthRequest(t *testing.T, machineIDs ...string) (*Request, []byte) {
+	req := NewRequest()
+	for i, id := range machineIDs {
+		app := req.AddApp("{00000000-0000-0000-0000-00000000000"+strconv.Itoa(i)+"}", testAppVer)
+		app.MachineID = id
+	}
+	body, err := xml.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req, body
+}
+
+func TestTokenAuth(t *testing.T) {
+	ta := NewTokenAuth("a", "b")
+	for _, tt := range []struct {
+		header string
+		err    bool
+		none   bool
+	}{
+		{"", true, true},
+		{"Basic Zm9vOmJhcg==", true, true},
+		{"Bearer c", true, false},
+		{"Bearer b", false, false},
+	} {
+		httpReq := httptest.NewRequest("POST", "/v1/update/", nil)
+		httpReq.Header.Set("Authorization", tt.header)
+		id, err := ta.Authenticate(httpReq, nil)
+		if (err != nil) != tt.err || (err == NoCredentialsError) != tt.none {
+			t.Errorf("%q: unexpected error %v", tt.header, err)
+		}
+		if err == nil && id.MachineID != "" {
+			t.Errorf("%q: token limited to a machine", tt.header)
+		}
+	}
+}
+
+func TestHMACAuth(t *testing.T) {
+	secret := []byte("secret")
+	ha := NewHMACAuth(func(machineID string) []byte {
+		if machineID == "unknown" {
+			return nil
+		}
+		return HMACMachineKey(secret, machineID)
+	})
+
+	_, body := mkAuthRequest(t, "m1")
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	for _, tt := range []struct {
+		name    string
+		machine string
+		key     string
+		date    string
+		body    []byte
+		ok      bool
+	}{
+		{"valid", "m1", "m1", now, body, true},
+		{"wrong key", "m1", "m2", now, body, false},
+		{"unknown", "unknown", "unknown", now, body, false},
+		{"tampered", "m1", "m1", now, append([]byte(" "), body...), false},
+		{"old", "m1", "m1", old, body, false},
+		{"bad date", "m1", "m1", "yesterday", body, false},
+	} {
+		key := HMACMachineKey(secret, tt.key)
+		httpReq := httptest.NewRequest("POST", "/v1/update/", nil)
+		httpReq.Header.Set(HeaderMachineID, tt.machine)
+		httpReq.Header.Set(HeaderDate, tt.date)
+		httpReq.Header.Set(HeaderSignature, HMACSign(key, tt.date, body))
+
+		id, err := ha.Authenticate(httpReq, tt.body)
+		if tt.ok && (err != nil || id.MachineID != tt.machine) {
+			t.Errorf("%s: rejected: %v", tt.name, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+
+	httpReq := httptest.NewRequest("POST", "/v1/update/", nil)
+	if _, err := ha.Authenticate(httpReq, body); err != NoCredentialsError {
+		t.Errorf("expected no credentials, got %v", err)
+	}
+}
+
+func TestTLSAuth(t *testing.T) {
+	httpReq := httptest.NewRequest("POST", "/v1/update/", nil)
+	ta := &TLSAuth{MatchMachineID: true}
+	if _, err := ta.Authenticate(httpReq, nil); err != NoCredentialsError {
+		t.Errorf("expected no credentials, got %v", err)
+	}
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "m1"}}
+	httpReq.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+	}
+	if _, err := ta.Authenticate(httpReq, nil); err != NoCredentialsError {
+		t.Errorf("unverified certificate accepted: %v", err)
+	}
+
+	httpReq.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	id, err := ta.Authenticate(httpReq, nil)
+	if err != nil || id.MachineID != "m1" {
+		t.Errorf("unexpected identity %#v %v", id, err)
+	}
+}
+
+func TestHandleAuth(t *testing.T) {
+	handler := &OmahaHandler{
+		Updater: UpdaterStub{},
+		Auth: &HMACAuth{
+			Key:     func(string) []byte { return []byte("key") },
+			MaxSkew: time.Minute,
+		},
+	}
+
+	// Credentials for m1 don't cover m2's app.
+	req, body := mkAuthRequest(t, "m1", "m2")
+	date := strconv.FormatInt(time.Now().Unix(), 10)
+	httpReq := httptest.NewRequest("POST", "/v1/update/", bytes.NewReader(body))
+	httpReq.Header.Set(HeaderMachineID, "m1")
+	httpReq.Header.Set(HeaderDate, date)
+	httpReq.Header.Set(HeaderSignature, HMACSign([]byte("key"), date, body))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httpReq)
+	resp, err := ParseResponse(w.Header().Get("Content-Type"), w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := resp.GetApp(req.Apps[0].ID).Status; s != AppOK {
+		t.Errorf("authenticated app: %s", string(s))
+	}
+	if s := resp.GetApp(req.Apps[1].ID).Status; s != AppRestricted {
+		t.Errorf("other machine's app: %s", string(s))
+	}
+
+	// No credentials at all.
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/v1/update/", bytes.NewReader(body)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected forbidden, got %d", w.Code)
+	}
+}
@@ -0,0 +1,382 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	BlobNotFoundError   = errors.New("blob not found")
+	BlobInvalidKeyError = errors.New("blob key is not a hex sha256 sum")
+)
+
+// BlobInfo describes a stored blob. Key is the lowercase hex encoded
+// SHA-256 sum of the contents, the hashes are base64 as in Package.
+type BlobInfo struct {
+	Key    string `json:"key"`
+	Size   uint64 `json:"size"`
+	SHA1   string `json:"sha1"`
+	SHA256 string `json:"sha256"`
+}
+
+// Blob is the contents of a stored blob.
+type Blob interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// BlobBackend is storage for a BlobStore. Implementations do not need to
+// verify contents, the store does that, but Put must not leave a partial
+// blob behind if it fails. Missing blobs are reported as
+// BlobNotFoundError.
+type BlobBackend interface {
+	Put(info *BlobInfo, r io.Reader) error
+	Open(key string) (Blob, error)
+	Stat(key string) (*BlobInfo, error)
+	Delete(key string) error
+	List() ([]string, error)
+}
+
+// ValidBlobKey reports if key is a lowercase hex encoded SHA-256 sum.
+func ValidBlobKey(key string) bool {
+	if len(key) != sha256.Size*2 || strings.ToLower(key) != key {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
+
+// BlobKey returns the store key for a package, from its SHA-256 hash.
+func BlobKey(pkg *Package) (string, error) {
+	sum, err := base64.StdEncoding.DecodeString(pkg.SHA256)
+	if err != nil || len(sum) != sha256.Size {
+		return "", fmt.Errorf("omaha: package %q has no valid sha256", pkg.Name)
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// BlobStore is a content addressed store of update payloads. The same
+// payload can be used by any number of updates while stored only once.
+type BlobStore struct {
+	backend BlobBackend
+	hashes  *HashCache
+}
+
+func NewBlobStore(backend BlobBackend) *BlobStore {
+	return &BlobStore{backend: backend}
+}
+
+// SetHashCache sets a cache of file hashes used by AddFile. Contents are
+// still verified as they are copied into the store.
+func (s *BlobStore) SetHashCache(hc *HashCache) {
+	s.hashes = hc
+}
+
+// AddFile stores the file at path, returning its info. Adding a file
+// that is already stored does not copy it again.
+func (s *BlobStore) AddFile(path string) (*BlobInfo, error) {
+	pkg := &Package{}
+	if err := s.hashes.FromPath(pkg, path); err != nil {
+		return nil, err
+	}
+
+	key, err := BlobKey(pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	if info, err := s.backend.Stat(key); err == nil {
+		return info, nil
+	} else if err != BlobNotFoundError {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info := &BlobInfo{
+		Key:    key,
+		Size:   pkg.Size,
+		SHA1:   pkg.SHA1,
+		SHA256: pkg.SHA256,
+	}
+
+	// The file may have changed since it was hashed.
+	h := sha256.New()
+	if err := s.backend.Put(info, io.TeeReader(f, h)); err != nil {
+		return nil, err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != key {
+		s.backend.Delete(key)
+		return nil, PackageHashMismatchError
+	}
+
+	return info, nil
+}
+
+// Stat returns the info for a stored blob.
+func (s *BlobStore) Stat(key string) (*BlobInfo, error) {
+	if !ValidBlobKey(key) {
+		return nil, BlobInvalidKeyError
+	}
+	return s.backend.Stat(key)
+}
+
+// Open returns the contents of a stored blob.
+func (s *BlobStore) Open(key string) (Blob, error) {
+	if !ValidBlobKey(key) {
+		return nil, BlobInvalidKeyError
+	}
+	return s.backend.Open(key)
+}
+
+// Package returns a package for a stored blob with the given name.
+func (s *BlobStore) Package(key, name string) (*Package, error) {
+	info, err := s.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Package{
+		Name:   name,
+		SHA1:   info.SHA1,
+		SHA256: info.SHA256,
+		Size:   info.Size,
+	}, nil
+}
+
+// GC deletes every blob not used by a package in the given manifests,
+// returning the keys deleted.
+func (s *BlobStore) GC(referenced ...*Manifest) ([]string, error) {
+	keep := make(map[string]bool)
+	for _, m := range referenced {
+		for _, pkg := range m.Packages {
+			if key, err := BlobKey(pkg); err == nil {
+				keep[key] = true
+			}
+		}
+	}
+
+	keys, err := s.backend.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+	for _, key := range keys {
+		if keep[key] {
+			continue
+		}
+		if err := s.backend.Delete(key); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, key)
+	}
+
+	return deleted, nil
+}
+
+// Handler serves blobs under prefix as prefix + key + "/" + name, where
+// name may be anything so a package's name can be kept. An update using
+// a blob for its payload should use prefix + key + "/" as its CodeBase.
+// Responses carry the same headers as PackageHandler.
+func (s *BlobStore) Handler(prefix string) http.Handler {
+	return &blobHandler{store: s, prefix: prefix}
+}
+
+type blobHandler struct {
+	store  *BlobStore
+	prefix string
+	PackageHandler
+}
+
+func (bh *blobHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Expected a GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, bh.prefix) {
+		http.NotFound(w, r)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, bh.prefix), "/", 2)
+	key, name := parts[0], ""
+	if len(parts) == 2 {
+		name = parts[1]
+	}
+	if name == "" || strings.Contains(name, "/") {
+		name = key
+	}
+
+	pkg, err := bh.store.Package(key, name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	blob, err := bh.store.Open(key)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer blob.Close()
+
+	// Blobs never change so there is no meaningful modification time.
+	ph := bh.PackageHandler
+	ph.Package = pkg
+	ph.serve(w, r, name, time.Time{}, blob)
+}
+
+// AddPackageFromBlob adds a stored blob to the manifest as a package.
+func (m *Manifest) AddPackageFromBlob(store *BlobStore, key, name string) (*Package, error) {
+	if filepath.Base(name) != name || name == "" || name[0] == '.' {
+		return nil, fmt.Errorf("omaha: invalid package name %q", name)
+	}
+
+	pkg, err := store.Package(key, name)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Packages = append(m.Packages, pkg)
+	return pkg, nil
+}
+
+// LocalBlobBackend stores blobs in a local directory, sharded by the
+// first two characters of the key, with the info in a JSON sidecar.
+type LocalBlobBackend struct {
+	Dir string
+}
+
+func NewLocalBlobBackend(dir string) (*LocalBlobBackend, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalBlobBackend{Dir: dir}, nil
+}
+
+func (lb *LocalBlobBackend) path(key string) string {
+	return filepath.Join(lb.Dir, key[:2], key)
+}
+
+func (lb *LocalBlobBackend) Put(info *BlobInfo, r io.Reader) error {
+	path := lb.path(info.Key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	meta, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	// The blob is only visible once the info is in place.
+	if err := ioutil.WriteFile(path+".json", meta, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (lb *LocalBlobBackend) Open(key string) (Blob, error) {
+	f, err := os.Open(lb.path(key))
+	if os.IsNotExist(err) {
+		return nil, BlobNotFoundError
+	}
+	return f, err
+}
+
+func (lb *LocalBlobBackend) Stat(key string) (*BlobInfo, error) {
+	path := lb.path(key)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, BlobNotFoundError
+	} else if err != nil {
+		return nil, err
+	}
+
+	meta, err := ioutil.ReadFile(path + ".json")
+	if os.IsNotExist(err) {
+		return nil, BlobNotFoundError
+	} else if err != nil {
+		return nil, err
+	}
+
+	info := &BlobInfo{}
+	if err := json.Unmarshal(meta, info); err != nil {
+		return nil, fmt.Errorf("omaha: blob %s: %v", key, err)
+	}
+	return info, nil
+}
+
+func (lb *LocalBlobBackend) Delete(key string) error {
+	path := lb.path(key)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(path + ".json"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (lb *LocalBlobBackend) List() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(lb.Dir, "??", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, m := range matches {
+		if key := filepath.Base(m); ValidBlobKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
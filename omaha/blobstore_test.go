@@ -0,0 +1,189 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestBlobStore(t *testing.T) (*BlobStore, string, func()) {
+	dir, err := ioutil.TempDir("", "go-omaha")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := NewLocalBlobBackend(filepath.Join(dir, "blobs"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return NewBlobStore(backend), dir, func() { os.RemoveAll(dir) }
+}
+
+func addTestBlob(t *testing.T, s *BlobStore, dir, name, data string) *BlobInfo {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := s.AddFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestBlobStoreAddFile(t *testing.T) {
+	s, dir, cleanup := newTestBlobStore(t)
+	defer cleanup()
+
+	a := addTestBlob(t, s, dir, "a", "test")
+	b := addTestBlob(t, s, dir, "b", "test")
+	if *a != *b {
+		t.Errorf("same contents stored differently: %#v %#v", a, b)
+	}
+	if a.Key != "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08" {
+		t.Errorf("unexpected key %q", a.Key)
+	}
+	if a.Size != 4 || a.SHA1 != "qUqP5cyxm6YcTAhz05Hph5gvu9M=" {
+		t.Errorf("unexpected info %#v", a)
+	}
+
+	keys, err := s.backend.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != a.Key {
+		t.Errorf("unexpected blobs %v", keys)
+	}
+
+	blob, err := s.Open(a.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	data, err := ioutil.ReadAll(blob)
+	if err != nil || string(data) != "test" {
+		t.Errorf("unexpected contents %q %v", data, err)
+	}
+
+	if _, err := s.Stat("../../etc/passwd"); err != BlobInvalidKeyError {
+		t.Errorf("invalid key accepted: %v", err)
+	}
+	if _, err := s.Stat(a.Key[:63] + "0"); err != BlobNotFoundError {
+		t.Errorf("missing blob found: %v", err)
+	}
+}
+
+func TestBlobStoreManifests(t *testing.T) {
+	s, dir, cleanup := newTestBlobStore(t)
+	defer cleanup()
+
+	info := addTestBlob(t, s, dir, "payload", "test")
+
+	var m1, m2 Manifest
+	p1, err := m1.AddPackageFromBlob(s, info.Key, "update.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := m2.AddPackageFromBlob(s, info.Key, "other.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p1.SHA256 != p2.SHA256 || p1.Size != 4 || p2.Name != "other.gz" {
+		t.Errorf("unexpected packages %#v %#v", p1, p2)
+	}
+	if _, err := m1.AddPackageFromBlob(s, info.Key, "../update.gz"); err == nil {
+		t.Error("invalid package name accepted")
+	}
+
+	blob, err := s.Open(info.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	if err := p1.VerifyReader(blob); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBlobStoreGC(t *testing.T) {
+	s, dir, cleanup := newTestBlobStore(t)
+	defer cleanup()
+
+	keep := addTestBlob(t, s, dir, "keep", "keep")
+	drop := addTestBlob(t, s, dir, "drop", "drop")
+
+	var m Manifest
+	if _, err := m.AddPackageFromBlob(s, keep.Key, "update.gz"); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := s.GC(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0] != drop.Key {
+		t.Errorf("unexpected deleted blobs %v", deleted)
+	}
+	if _, err := s.Stat(keep.Key); err != nil {
+		t.Errorf("referenced blob removed: %v", err)
+	}
+	if _, err := s.Stat(drop.Key); err != BlobNotFoundError {
+		t.Errorf("unreferenced blob kept: %v", err)
+	}
+}
+
+func TestBlobStoreHandler(t *testing.T) {
+	s, dir, cleanup := newTestBlobStore(t)
+	defer cleanup()
+
+	info := addTestBlob(t, s, dir, "payload", "test")
+	h := s.Handler("/blobs/")
+
+	for _, tt := range []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{"GET", "/blobs/" + info.Key + "/update.gz", http.StatusOK},
+		{"HEAD", "/blobs/" + info.Key + "/update.gz", http.StatusOK},
+		{"GET", "/blobs/" + info.Key, http.StatusOK},
+		{"POST", "/blobs/" + info.Key + "/update.gz", http.StatusMethodNotAllowed},
+		{"GET", "/blobs/" + info.Key[:63] + "0/update.gz", http.StatusNotFound},
+		{"GET", "/blobs/nope/update.gz", http.StatusNotFound},
+		{"GET", "/other/" + info.Key, http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.path, tt.code, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/blobs/"+info.Key+"/update.gz", nil))
+	if w.Body.String() != "test" {
+		t.Errorf("unexpected body %q", w.Body.String())
+	}
+	if etag := w.Header().Get("ETag"); etag != `"`+info.Key+`"` {
+		t.Errorf("unexpected ETag %q", etag)
+	}
+}
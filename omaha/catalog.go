@@ -0,0 +1,809 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blang/semver"
+)
+
+// Catalog is an Updater serving any number of applications, each with
+// any number of tracks. A track offers a single version at a time but
+// may hold several updates to that version: a full payload for any
+// client and delta payloads that only apply to one previous version.
+//
+// Individual machines may be pinned to another version of their track.
+// Clients that send a targetversionprefix are offered the newest version
+// matching it instead. If the chosen version is older than the client's
+// the update is marked as a rollback and only offered to clients that
+// set rollback_allowed. A paused track offers no updates at all, a
+// halted version is not offered but the rest of the track is.
+//
+// The catalog also keeps statistics on the instances checking in and
+// the events they report, see Stats. Instances not seen for a while are
+// forgotten and their number is capped, see SetInstanceLimits.
+type Catalog struct {
+	mu   sync.RWMutex
+	apps map[string]map[string]*catalogTrack
+	pins map[catalogPin]string
+
+	statsMu      sync.Mutex
+	instances    map[catalogPin]*CatalogInstance
+	events       map[string]map[string]int
+	maxInstances int
+	instanceTTL  time.Duration
+}
+
+const (
+	defaultMaxInstances = 100000
+	defaultInstanceTTL  = 7 * 24 * time.Hour
+)
+
+type catalogPin struct {
+	appID     string
+	machineID string
+}
+
+type catalogTrack struct {
+	version string
+	paused  bool
+	halted  map[string]bool
+	updates []*Update
+}
+
+// CatalogApp is a snapshot of an application in a Catalog.
+type CatalogApp struct {
+	ID     string
+	Tracks []*CatalogTrack
+
+	// Pins maps machine IDs to their pinned version.
+	Pins map[string]string
+}
+
+// CatalogTrack is a snapshot of a track in a Catalog.
+type CatalogTrack struct {
+	Name    string
+	Version string
+	Paused  bool
+	Updates []*Update
+
+	// Halted versions are not offered, see Catalog.Halt.
+	Halted []string
+}
+
+// CatalogInstance is the most recent check in from an instance of an
+// application.
+type CatalogInstance struct {
+	MachineID string    `json:"machine_id"`
+	Version   string    `json:"version"`
+	Track     string    `json:"track"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// CatalogStats summarizes the instances of an application that have
+// checked in and the events they have reported.
+type CatalogStats struct {
+	Instances int            `json:"instances"`
+	Versions  map[string]int `json:"versions"`
+	Tracks    map[string]int `json:"tracks"`
+
+	// Events are counted by type and result, as in
+	// "update complete: success".
+	Events map[string]int `json:"events"`
+}
+
+func NewCatalog() *Catalog {
+	return &Catalog{
+		apps:      make(map[string]map[string]*catalogTrack),
+		pins:      make(map[catalogPin]string),
+		instances: make(map[catalogPin]*CatalogInstance),
+		events:    make(map[string]map[string]int),
+
+		maxInstances: defaultMaxInstances,
+		instanceTTL:  defaultInstanceTTL,
+	}
+}
+
+// SetInstanceLimits sets how many instances are remembered across all
+// applications and for how long after they last checked in. Once max is
+// reached expired instances are dropped, then the least recently seen.
+// Zero for either means no limit. The defaults are 100000 instances for
+// a week.
+func (c *Catalog) SetInstanceLimits(max int, ttl time.Duration) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+
+	c.maxInstances = max
+	c.instanceTTL = ttl
+	c.trimInstances(time.Now(), 0)
+}
+
+// AddApp adds an application with no tracks. Adding an existing
+// application does nothing.
+func (c *Catalog) AddApp(appID string) error {
+	if appID == "" {
+		return errors.New("omaha: empty application id")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.apps[appID]; !ok {
+		c.apps[appID] = make(map[string]*catalogTrack)
+	}
+	return nil
+}
+
+// AddUpdate adds an update to an application's track, creating either
+// as needed. The update's ID is the application and its manifest version
+// is the version it installs. Deltas must set PreviousVersion. The first
+// version added to a track becomes the version it offers.
+func (c *Catalog) AddUpdate(track string, u *Update) error {
+	if err := validCatalogUpdate(u); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.track(u.ID, track, u.Manifest.Version).add(u)
+	return nil
+}
+
+// ReplaceUpdate adds an update like AddUpdate but replaces any update to
+// the same version from the same previous version, such as one with a
+// broken payload.
+func (c *Catalog) ReplaceUpdate(track string, u *Update) error {
+	if err := validCatalogUpdate(u); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := c.track(u.ID, track, u.Manifest.Version)
+	for i, old := range t.updates {
+		if sameUpdate(old, u) {
+			t.updates[i] = u
+			return nil
+		}
+	}
+	t.add(u)
+	return nil
+}
+
+// RemoveUpdate removes the updates to version whose PreviousVersion is
+// previous, which is usually blank for full updates. The last update to
+// the version a track offers cannot be removed, set another version
+// first or remove the track.
+func (c *Catalog) RemoveUpdate(appID, track, version, previous string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.apps[appID][track]
+	if !ok {
+		return fmt.Errorf("omaha: unknown track %q for app %s", track, appID)
+	}
+
+	rest := &catalogTrack{version: t.version, paused: t.paused}
+	for _, u := range t.updates {
+		if u.Manifest.Version != version || u.PreviousVersion != previous {
+			rest.add(u)
+		}
+	}
+
+	if len(rest.updates) == len(t.updates) {
+		return fmt.Errorf("omaha: no update to %s from %q for app %s track %q",
+			version, previous, appID, track)
+	}
+	if version == t.version && !rest.hasVersion(version) {
+		return fmt.Errorf("omaha: version %s is offered by app %s track %q",
+			version, appID, track)
+	}
+
+	t.updates = rest.updates
+	if !t.hasVersion(version) {
+		delete(t.halted, version)
+	}
+	return nil
+}
+
+// track returns an application's track, creating either as needed with
+// the track offering version.
+func (c *Catalog) track(appID, track, version string) *catalogTrack {
+	tracks, ok := c.apps[appID]
+	if !ok {
+		tracks = make(map[string]*catalogTrack)
+		c.apps[appID] = tracks
+	}
+
+	t, ok := tracks[track]
+	if !ok {
+		t = &catalogTrack{version: version}
+		tracks[track] = t
+	}
+	return t
+}
+
+// RemoveTrack removes an application's track and all of its updates.
+func (c *Catalog) RemoveTrack(appID, track string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.apps[appID][track]; !ok {
+		return fmt.Errorf("omaha: unknown track %q for app %s", track, appID)
+	}
+	delete(c.apps[appID], track)
+	return nil
+}
+
+// ReplaceTrack replaces an application's track, creating either as
+// needed, with the track's updates, version and paused state. The name
+// of the track given is ignored. A blank version offers the version of
+// the first update.
+func (c *Catalog) ReplaceTrack(appID, track string, ct *CatalogTrack) error {
+	t, err := newCatalogTrack(appID, ct)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tracks, ok := c.apps[appID]
+	if !ok {
+		tracks = make(map[string]*catalogTrack)
+		c.apps[appID] = tracks
+	}
+	tracks[track] = t
+	return nil
+}
+
+// RemoveApp removes an application with all of its tracks, pins and
+// statistics.
+func (c *Catalog) RemoveApp(appID string) error {
+	c.mu.Lock()
+	if _, ok := c.apps[appID]; !ok {
+		c.mu.Unlock()
+		return fmt.Errorf("omaha: unknown app %s", appID)
+	}
+	delete(c.apps, appID)
+	for pin := range c.pins {
+		if pin.appID == appID {
+			delete(c.pins, pin)
+		}
+	}
+	c.mu.Unlock()
+
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	for pin := range c.instances {
+		if pin.appID == appID {
+			delete(c.instances, pin)
+		}
+	}
+	delete(c.events, appID)
+	return nil
+}
+
+// ReplaceApp replaces all of an application's tracks and pins with the
+// given ones, creating the application if needed. Statistics are kept.
+func (c *Catalog) ReplaceApp(app *CatalogApp) error {
+	if app.ID == "" {
+		return errors.New("omaha: empty application id")
+	}
+
+	tracks := make(map[string]*catalogTrack)
+	for _, ct := range app.Tracks {
+		if _, ok := tracks[ct.Name]; ok {
+			return fmt.Errorf("omaha: duplicate track %q", ct.Name)
+		}
+		t, err := newCatalogTrack(app.ID, ct)
+		if err != nil {
+			return err
+		}
+		tracks[ct.Name] = t
+	}
+
+	for machineID := range app.Pins {
+		if machineID == "" {
+			return errors.New("omaha: empty machine id")
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.apps[app.ID] = tracks
+	for pin := range c.pins {
+		if pin.appID == app.ID {
+			delete(c.pins, pin)
+		}
+	}
+	for machineID, version := range app.Pins {
+		c.pins[catalogPin{app.ID, machineID}] = version
+	}
+	return nil
+}
+
+func newCatalogTrack(appID string, ct *CatalogTrack) (*catalogTrack, error) {
+	t := &catalogTrack{version: ct.Version, paused: ct.Paused}
+	for _, version := range ct.Halted {
+		t.halt(version)
+	}
+	for _, u := range ct.Updates {
+		if u.ID != appID {
+			return nil, fmt.Errorf("omaha: update to %s is for app %q, not %s",
+				u.Manifest.Version, u.ID, appID)
+		}
+		if err := validCatalogUpdate(u); err != nil {
+			return nil, err
+		}
+		t.add(u)
+	}
+
+	if t.version == "" && len(t.updates) != 0 {
+		t.version = t.updates[0].Manifest.Version
+	}
+	if t.version != "" && !t.hasVersion(t.version) {
+		return nil, fmt.Errorf("omaha: track %q has no update to version %s", ct.Name, t.version)
+	}
+	return t, nil
+}
+
+func validCatalogUpdate(u *Update) error {
+	if u.ID == "" {
+		return errors.New("omaha: update has no application id")
+	}
+	if u.Manifest.Version == "" {
+		return errors.New("omaha: update has no version")
+	}
+	if u.IsDelta() && u.PreviousVersion == "" {
+		return fmt.Errorf("omaha: delta update to %s has no previous version", u.Manifest.Version)
+	}
+	return nil
+}
+
+// sameUpdate reports if two updates go to the same version from the
+// same previous version.
+func sameUpdate(a, b *Update) bool {
+	return a.Manifest.Version == b.Manifest.Version &&
+		a.PreviousVersion == b.PreviousVersion &&
+		a.IsDelta() == b.IsDelta()
+}
+
+// SetVersion changes the version offered by an application's track.
+// At least one update to that version must have been added. Setting an
+// older version rolls back clients that allow it.
+func (c *Catalog) SetVersion(appID, track, version string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.apps[appID][track]
+	if !ok {
+		return fmt.Errorf("omaha: unknown track %q for app %s", track, appID)
+	}
+
+	if !t.hasVersion(version) {
+		return fmt.Errorf("omaha: no update to version %s for app %s track %q",
+			version, appID, track)
+	}
+
+	t.version = version
+	return nil
+}
+
+// Pause stops an application's track from offering any updates, for
+// example while a problem with its current version is investigated.
+func (c *Catalog) Pause(appID, track string) error {
+	return c.setPaused(appID, track, true)
+}
+
+// Resume undoes Pause and Halt, offering all of the track's versions
+// again.
+func (c *Catalog) Resume(appID, track string) error {
+	return c.setPaused(appID, track, false)
+}
+
+func (c *Catalog) setPaused(appID, track string, paused bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.apps[appID][track]
+	if !ok {
+		return fmt.Errorf("omaha: unknown track %q for app %s", track, appID)
+	}
+
+	t.paused = paused
+	if !paused {
+		t.halted = nil
+	}
+	return nil
+}
+
+// Halt stops an application's track from offering one version, for
+// example after too many machines failed to install it. Machines
+// pinned to or asking for other versions of the track still get them.
+func (c *Catalog) Halt(appID, track, version string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.apps[appID][track]
+	if !ok {
+		return fmt.Errorf("omaha: unknown track %q for app %s", track, appID)
+	}
+
+	if !t.hasVersion(version) {
+		return fmt.Errorf("omaha: no update to version %s for app %s track %q",
+			version, appID, track)
+	}
+
+	t.halt(version)
+	return nil
+}
+
+// PinMachine pins a machine to a version of an application regardless
+// of the version its track offers. The machine ID is matched against the
+// request's machineid, or userid if not set. The version must be
+// available on the track the machine checks in with or it is offered
+// nothing at all.
+func (c *Catalog) PinMachine(appID, machineID, version string) error {
+	if machineID == "" {
+		return errors.New("omaha: empty machine id")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.apps[appID]; !ok {
+		return fmt.Errorf("omaha: unknown app %s", appID)
+	}
+
+	c.pins[catalogPin{appID, machineID}] = version
+	return nil
+}
+
+// UnpinMachine returns a machine to the version offered by its track.
+func (c *Catalog) UnpinMachine(appID, machineID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.pins, catalogPin{appID, machineID})
+}
+
+// Apps returns a snapshot of every application, sorted by ID.
+func (c *Catalog) Apps() []*CatalogApp {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	apps := make([]*CatalogApp, 0, len(c.apps))
+	for id := range c.apps {
+		apps = append(apps, c.snapshot(id))
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].ID < apps[j].ID })
+	return apps
+}
+
+// App returns a snapshot of an application, or nil if it is unknown.
+func (c *Catalog) App(appID string) *CatalogApp {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if _, ok := c.apps[appID]; !ok {
+		return nil
+	}
+	return c.snapshot(appID)
+}
+
+func (c *Catalog) snapshot(appID string) *CatalogApp {
+	app := &CatalogApp{
+		ID:   appID,
+		Pins: make(map[string]string),
+	}
+
+	for name, t := range c.apps[appID] {
+		ct := &CatalogTrack{
+			Name:    name,
+			Version: t.version,
+			Paused:  t.paused,
+			Updates: append([]*Update(nil), t.updates...),
+		}
+		for version := range t.halted {
+			ct.Halted = append(ct.Halted, version)
+		}
+		sort.Strings(ct.Halted)
+		app.Tracks = append(app.Tracks, ct)
+	}
+	sort.Slice(app.Tracks, func(i, j int) bool {
+		return app.Tracks[i].Name < app.Tracks[j].Name
+	})
+
+	for pin, version := range c.pins {
+		if pin.appID == appID {
+			app.Pins[pin.machineID] = version
+		}
+	}
+
+	return app
+}
+
+// Stats summarizes an application's instances and events. Instances are
+// only counted if they identify themselves with a machine or user ID.
+func (c *Catalog) Stats(appID string) *CatalogStats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+
+	stats := &CatalogStats{
+		Versions: make(map[string]int),
+		Tracks:   make(map[string]int),
+		Events:   make(map[string]int),
+	}
+
+	now := time.Now()
+	for pin, inst := range c.instances {
+		if pin.appID != appID || c.expired(inst, now) {
+			continue
+		}
+		stats.Instances++
+		stats.Versions[inst.Version]++
+		stats.Tracks[inst.Track]++
+	}
+
+	for event, n := range c.events[appID] {
+		stats.Events[event] = n
+	}
+
+	return stats
+}
+
+// Instances returns the most recent check in of each of an application's
+// instances, sorted by machine ID.
+func (c *Catalog) Instances(appID string) []CatalogInstance {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+
+	now := time.Now()
+	instances := []CatalogInstance{}
+	for pin, inst := range c.instances {
+		if pin.appID == appID && !c.expired(inst, now) {
+			instances = append(instances, *inst)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].MachineID < instances[j].MachineID
+	})
+	return instances
+}
+
+func (c *Catalog) CheckApp(req *Request, app *AppRequest) error {
+	c.mu.RLock()
+	_, ok := c.apps[app.ID]
+	c.mu.RUnlock()
+
+	if !ok {
+		return AppUnknownID
+	}
+
+	if id := machineID(req, app); id != "" {
+		now := time.Now()
+		pin := catalogPin{app.ID, id}
+
+		c.statsMu.Lock()
+		if _, ok := c.instances[pin]; !ok && c.maxInstances > 0 &&
+			len(c.instances) >= c.maxInstances {
+			c.trimInstances(now, 1)
+		}
+		c.instances[pin] = &CatalogInstance{
+			MachineID: id,
+			Version:   app.Version,
+			Track:     app.Track,
+			LastSeen:  now,
+		}
+		c.statsMu.Unlock()
+	}
+
+	return nil
+}
+
+func (c *Catalog) expired(inst *CatalogInstance, now time.Time) bool {
+	return c.instanceTTL > 0 && now.Sub(inst.LastSeen) > c.instanceTTL
+}
+
+// trimInstances drops expired instances, then the least recently seen
+// until there is room for more. A tenth of the limit is freed at once
+// so a flood of new machine IDs does not sort on every check in.
+// statsMu must be held.
+func (c *Catalog) trimInstances(now time.Time, room int) {
+	for pin, inst := range c.instances {
+		if c.expired(inst, now) {
+			delete(c.instances, pin)
+		}
+	}
+
+	over := len(c.instances) + room - c.maxInstances
+	if c.maxInstances <= 0 || over <= 0 {
+		return
+	}
+	if room != 0 {
+		over += c.maxInstances / 10
+	}
+
+	pins := make([]catalogPin, 0, len(c.instances))
+	for pin := range c.instances {
+		pins = append(pins, pin)
+	}
+	sort.Slice(pins, func(i, j int) bool {
+		return c.instances[pins[i]].LastSeen.Before(c.instances[pins[j]].LastSeen)
+	})
+	if over > len(pins) {
+		over = len(pins)
+	}
+	for _, pin := range pins[:over] {
+		delete(c.instances, pin)
+	}
+}
+
+func (c *Catalog) Event(req *Request, app *AppRequest, event *EventRequest) {
+	key := event.Type.String() + ": " + event.Result.String()
+
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+
+	events, ok := c.events[app.ID]
+	if !ok {
+		events = make(map[string]int)
+		c.events[app.ID] = events
+	}
+	events[key]++
+}
+
+func (c *Catalog) Ping(req *Request, app *AppRequest) {
+}
+
+func (c *Catalog) CheckUpdate(req *Request, app *AppRequest) (*Update, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	t, ok := c.apps[app.ID][app.Track]
+	if !ok || t.paused {
+		return nil, NoUpdate
+	}
+
+	version := t.version
+	if pin, ok := c.pins[catalogPin{app.ID, machineID(req, app)}]; ok {
+		version = pin
+	}
+
+	var prefix string
+	if app.UpdateCheck != nil {
+		prefix = app.UpdateCheck.TargetVersionPrefix
+	}
+	if !MatchVersionPrefix(version, prefix) {
+		version = t.newestMatching(prefix)
+	}
+
+	if version == "" || version == app.Version || t.halted[version] {
+		return nil, NoUpdate
+	}
+
+	if newerVersion(app.Version, version) {
+		if u := selectUpdate(t.updates, version, app); u != nil {
+			return u, nil
+		}
+		return nil, NoUpdate
+	}
+
+	if app.UpdateCheck == nil || !app.UpdateCheck.RollbackAllowed {
+		return nil, NoUpdate
+	}
+
+	// Deltas only go forward so always roll back with a full update.
+	full := *app
+	full.DeltaOK = false
+	if u := selectUpdate(t.updates, version, &full); u != nil {
+		rollback := *u
+		rollback.Rollback = true
+		return &rollback, nil
+	}
+
+	return nil, NoUpdate
+}
+
+// machineID returns the update_engine machine ID, or the standard user
+// ID for clients that do not send one.
+func machineID(req *Request, app *AppRequest) string {
+	if app.MachineID != "" || req == nil {
+		return app.MachineID
+	}
+	return req.UserID
+}
+
+func (t *catalogTrack) add(u *Update) {
+	t.updates = append(t.updates, u)
+}
+
+func (t *catalogTrack) halt(version string) {
+	if t.halted == nil {
+		t.halted = make(map[string]bool)
+	}
+	t.halted[version] = true
+}
+
+func (t *catalogTrack) hasVersion(version string) bool {
+	for _, u := range t.updates {
+		if u.Manifest.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// newestMatching returns the newest version on the track matching prefix,
+// or a blank string if there is none.
+func (t *catalogTrack) newestMatching(prefix string) string {
+	var newest string
+	for _, u := range t.updates {
+		v := u.Manifest.Version
+		if !MatchVersionPrefix(v, prefix) {
+			continue
+		}
+		if newest == "" || newerVersion(newest, v) {
+			newest = v
+		}
+	}
+	return newest
+}
+
+// selectUpdate picks the best update to version for the client: a delta
+// from its current version if it accepts deltas, otherwise a full update.
+func selectUpdate(updates []*Update, version string, app *AppRequest) *Update {
+	var full *Update
+	for _, u := range updates {
+		if u.Manifest.Version != version {
+			continue
+		}
+
+		if u.IsDelta() {
+			if app.DeltaOK && u.PreviousVersion == app.Version {
+				return u
+			}
+		} else if full == nil &&
+			(u.PreviousVersion == "" || u.PreviousVersion == app.Version) {
+			full = u
+		}
+	}
+	return full
+}
+
+// newerVersion reports if target is newer than current. Versions that
+// are not valid semver are only compared for equality.
+func newerVersion(current, target string) bool {
+	if current == target {
+		return false
+	}
+
+	v1, err1 := semver.Make(current)
+	v2, err2 := semver.Make(target)
+	if err1 != nil || err2 != nil {
+		return true
+	}
+
+	return v1.LT(v2)
+}
@@ -0,0 +1,460 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func mkCatalogUpdate(version, previous string, delta bool) *Update {
+	u := &Update{
+		ID:              testAppID,
+		PreviousVersion: previous,
+		Manifest:        Manifest{Version: version},
+	}
+	pkg := u.AddPackage()
+	pkg.Name = "update.gz"
+	if delta {
+		pkg.Name = "delta-" + previous + ".gz"
+		u.AddAction("postinstall").IsDeltaPayload = true
+	}
+	return u
+}
+
+func mkCatalogApp(version string, deltaOK bool) *AppRequest {
+	req := NewRequest()
+	app := req.AddApp(testAppID, version)
+	app.Track = "stable"
+	app.DeltaOK = deltaOK
+	app.AddUpdateCheck()
+	return app
+}
+
+func TestCatalogCheckApp(t *testing.T) {
+	c := NewCatalog()
+	if err := c.AddUpdate("stable", mkCatalogUpdate("1.1.0", "", false)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.CheckApp(nil, mkCatalogApp("1.0.0", false)); err != nil {
+		t.Errorf("known app rejected: %v", err)
+	}
+
+	app := mkCatalogApp("1.0.0", false)
+	app.ID = "{00000000-0000-0000-0000-000000000000}"
+	if err := c.CheckApp(nil, app); err != AppUnknownID {
+		t.Errorf("unknown app accepted: %v", err)
+	}
+}
+
+func TestCatalogDelta(t *testing.T) {
+	full := mkCatalogUpdate("1.1.0", "", false)
+	delta := mkCatalogUpdate("1.1.0", "1.0.0", true)
+
+	c := NewCatalog()
+	for _, u := range []*Update{full, delta} {
+		if err := c.AddUpdate("stable", u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		version string
+		deltaOK bool
+		expect  *Update
+	}{
+		{"1.0.0", true, delta},
+		{"1.0.0", false, full},
+		{"0.9.0", true, full},
+		{"1.1.0", true, nil},
+	} {
+		u, err := c.CheckUpdate(nil, mkCatalogApp(tt.version, tt.deltaOK))
+		if tt.expect == nil {
+			if err != NoUpdate {
+				t.Errorf("%s: expected no update, got %v", tt.version, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.version, err)
+		} else if u != tt.expect {
+			t.Errorf("%s delta_okay=%t: got %s", tt.version, tt.deltaOK, u.Manifest.Packages[0].Name)
+		}
+	}
+}
+
+func TestCatalogDeltaOnly(t *testing.T) {
+	c := NewCatalog()
+	if err := c.AddUpdate("stable", mkCatalogUpdate("1.1.0", "1.0.0", true)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.CheckUpdate(nil, mkCatalogApp("1.0.0", false)); err != NoUpdate {
+		t.Errorf("expected no update without a full payload, got %v", err)
+	}
+
+	if err := c.AddUpdate("stable", mkCatalogUpdate("1.1.0", "", true)); err == nil {
+		t.Error("delta without a previous version accepted")
+	}
+}
+
+func TestCatalogSetVersion(t *testing.T) {
+	c := NewCatalog()
+	for _, v := range []string{"1.1.0", "1.2.0"} {
+		if err := c.AddUpdate("stable", mkCatalogUpdate(v, "", false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u, err := c.CheckUpdate(nil, mkCatalogApp("1.0.0", false))
+	if err != nil || u.Manifest.Version != "1.1.0" {
+		t.Fatalf("expected 1.1.0, got %v %v", u, err)
+	}
+
+	if err := c.SetVersion(testAppID, "stable", "1.2.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err = c.CheckUpdate(nil, mkCatalogApp("1.1.0", false))
+	if err != nil || u.Manifest.Version != "1.2.0" {
+		t.Fatalf("expected 1.2.0, got %v %v", u, err)
+	}
+
+	if err := c.SetVersion(testAppID, "stable", "9.9.9"); err == nil {
+		t.Error("unknown version accepted")
+	}
+	if err := c.SetVersion(testAppID, "beta", "1.2.0"); err == nil {
+		t.Error("unknown track accepted")
+	}
+}
+
+func TestCatalogRollback(t *testing.T) {
+	c := NewCatalog()
+	for _, u := range []*Update{
+		mkCatalogUpdate("1.1.0", "", false),
+		mkCatalogUpdate("1.2.0", "", false),
+		mkCatalogUpdate("1.2.0", "1.1.0", true),
+	} {
+		if err := c.AddUpdate("stable", u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 1.1.0 is still the track's version so 1.2.0 clients roll back.
+	app := mkCatalogApp("1.2.0", true)
+	if _, err := c.CheckUpdate(nil, app); err != NoUpdate {
+		t.Fatalf("rollback offered without rollback_allowed: %v", err)
+	}
+
+	app.UpdateCheck.RollbackAllowed = true
+	u, err := c.CheckUpdate(nil, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.Rollback || u.Manifest.Version != "1.1.0" || u.IsDelta() {
+		t.Errorf("unexpected rollback: %#v", u)
+	}
+
+	// Clients moving forward must not see the flag.
+	u, err = c.CheckUpdate(nil, mkCatalogApp("1.0.0", false))
+	if err != nil || u.Rollback {
+		t.Errorf("unexpected update: %#v %v", u, err)
+	}
+}
+
+func TestCatalogPinMachine(t *testing.T) {
+	c := NewCatalog()
+	for _, v := range []string{"1.1.0", "1.2.0"} {
+		if err := c.AddUpdate("stable", mkCatalogUpdate(v, "", false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.PinMachine(testAppID, "pinned", "1.2.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PinMachine("{00000000-0000-0000-0000-000000000000}", "pinned", "1.2.0"); err == nil {
+		t.Error("pin for unknown app accepted")
+	}
+
+	app := mkCatalogApp("1.0.0", false)
+	app.MachineID = "pinned"
+	u, err := c.CheckUpdate(nil, app)
+	if err != nil || u.Manifest.Version != "1.2.0" {
+		t.Fatalf("expected pinned 1.2.0, got %v %v", u, err)
+	}
+
+	// Falls back to the standard user id.
+	app.MachineID = ""
+	u, err = c.CheckUpdate(&Request{UserID: "pinned"}, app)
+	if err != nil || u.Manifest.Version != "1.2.0" {
+		t.Fatalf("expected pinned 1.2.0, got %v %v", u, err)
+	}
+
+	c.UnpinMachine(testAppID, "pinned")
+	u, err = c.CheckUpdate(&Request{UserID: "pinned"}, app)
+	if err != nil || u.Manifest.Version != "1.1.0" {
+		t.Fatalf("expected track version 1.1.0, got %v %v", u, err)
+	}
+}
+
+func TestCatalogTargetVersionPrefix(t *testing.T) {
+	c := NewCatalog()
+	for _, v := range []string{"2.0.0", "1.1.0", "1.2.0", "1.20.0"} {
+		if err := c.AddUpdate("stable", mkCatalogUpdate(v, "", false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		prefix string
+		expect string
+	}{
+		{"", "2.0.0"},
+		{"1", "1.20.0"},
+		{"1.2", "1.2.0"},
+		{"1.2.", "1.2.0"},
+		{"3", ""},
+	} {
+		app := mkCatalogApp("1.0.0", false)
+		app.UpdateCheck.TargetVersionPrefix = tt.prefix
+		u, err := c.CheckUpdate(nil, app)
+		if tt.expect == "" {
+			if err != NoUpdate {
+				t.Errorf("%q: expected no update, got %v", tt.prefix, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.prefix, err)
+		} else if u.Manifest.Version != tt.expect {
+			t.Errorf("%q: expected %s, got %s", tt.prefix, tt.expect, u.Manifest.Version)
+		}
+	}
+}
+
+func TestCatalogPause(t *testing.T) {
+	c := NewCatalog()
+	if err := c.AddUpdate("stable", mkCatalogUpdate("1.1.0", "", false)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Pause(testAppID, "stable"); err != nil {
+		t.Fatal(err)
+	}
+	if !c.App(testAppID).Tracks[0].Paused {
+		t.Error("track not marked paused")
+	}
+	if _, err := c.CheckUpdate(nil, mkCatalogApp("1.0.0", false)); err != NoUpdate {
+		t.Errorf("paused track offered an update: %v", err)
+	}
+
+	if err := c.Resume(testAppID, "stable"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CheckUpdate(nil, mkCatalogApp("1.0.0", false)); err != nil {
+		t.Errorf("resumed track offered nothing: %v", err)
+	}
+
+	if err := c.Pause(testAppID, "beta"); err == nil {
+		t.Error("unknown track paused")
+	}
+}
+
+func TestCatalogHalt(t *testing.T) {
+	c := NewCatalog()
+	for _, v := range []string{"1.1.0", "1.2.0"} {
+		if err := c.AddUpdate("stable", mkCatalogUpdate(v, "", false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.PinMachine(testAppID, "pinned", "1.2.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Halt(testAppID, "stable", "1.1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Halt(testAppID, "stable", "9.9.9"); err == nil {
+		t.Error("unknown version halted")
+	}
+
+	if _, err := c.CheckUpdate(nil, mkCatalogApp("1.0.0", false)); err != NoUpdate {
+		t.Errorf("halted version offered: %v", err)
+	}
+	pinned := mkCatalogApp("1.0.0", false)
+	pinned.MachineID = "pinned"
+	if u, err := c.CheckUpdate(nil, pinned); err != nil || u.Manifest.Version != "1.2.0" {
+		t.Errorf("expected pinned 1.2.0, got %v %v", u, err)
+	}
+
+	if err := c.Resume(testAppID, "stable"); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := c.CheckUpdate(nil, mkCatalogApp("1.0.0", false)); err != nil || u.Manifest.Version != "1.1.0" {
+		t.Errorf("expected 1.1.0 after resume, got %v %v", u, err)
+	}
+}
+
+func TestCatalogStats(t *testing.T) {
+	c := NewCatalog()
+	if err := c.AddUpdate("stable", mkCatalogUpdate("1.1.0", "", false)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, inst := range []struct{ id, version string }{
+		{"a", "1.0.0"},
+		{"b", "1.0.0"},
+		{"c", "1.1.0"},
+	} {
+		app := mkCatalogApp(inst.version, false)
+		app.MachineID = inst.id
+		if err := c.CheckApp(nil, app); err != nil {
+			t.Fatal(err)
+		}
+		c.Event(nil, app, &EventRequest{
+			Type:   EventTypeUpdateComplete,
+			Result: EventResultSuccess,
+		})
+	}
+
+	// Anonymous instances can't be told apart.
+	if err := c.CheckApp(nil, mkCatalogApp("1.0.0", false)); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := c.Stats(testAppID)
+	if stats.Instances != 3 || stats.Versions["1.0.0"] != 2 ||
+		stats.Versions["1.1.0"] != 1 || stats.Tracks["stable"] != 3 {
+		t.Errorf("unexpected stats %#v", stats)
+	}
+	if stats.Events["update complete: success"] != 3 {
+		t.Errorf("unexpected events %v", stats.Events)
+	}
+
+	instances := c.Instances(testAppID)
+	if len(instances) != 3 || instances[0].MachineID != "a" || instances[2].Version != "1.1.0" {
+		t.Errorf("unexpected instances %#v", instances)
+	}
+}
+
+func TestCatalogInstanceLimits(t *testing.T) {
+	c := NewCatalog()
+	c.SetInstanceLimits(10, 0)
+	if err := c.AddUpdate("stable", mkCatalogUpdate("1.1.0", "", false)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 25; i++ {
+		app := mkCatalogApp("1.0.0", false)
+		app.MachineID = fmt.Sprintf("m%02d", i)
+		if err := c.CheckApp(nil, app); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	instances := c.Instances(testAppID)
+	if len(instances) > 10 {
+		t.Fatalf("%d instances kept, limit is 10", len(instances))
+	}
+	if last := instances[len(instances)-1]; last.MachineID != "m24" {
+		t.Errorf("newest instance dropped: %#v", instances)
+	}
+
+	// Expire everything already seen.
+	c.statsMu.Lock()
+	for _, inst := range c.instances {
+		inst.LastSeen = inst.LastSeen.Add(-2 * time.Hour)
+	}
+	c.statsMu.Unlock()
+	c.SetInstanceLimits(10, time.Hour)
+
+	if stats := c.Stats(testAppID); stats.Instances != 0 {
+		t.Errorf("expired instances counted: %#v", stats)
+	}
+}
+
+func TestCatalogRemoveReplace(t *testing.T) {
+	full := mkCatalogUpdate("1.1.0", "", false)
+	delta := mkCatalogUpdate("1.1.0", "1.0.0", true)
+
+	c := NewCatalog()
+	for _, u := range []*Update{full, delta, mkCatalogUpdate("1.2.0", "", false)} {
+		if err := c.AddUpdate("stable", u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Replacing a delta keeps the full payload.
+	fixed := mkCatalogUpdate("1.1.0", "1.0.0", true)
+	if err := c.ReplaceUpdate("stable", fixed); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := c.CheckUpdate(nil, mkCatalogApp("1.0.0", true)); u != fixed {
+		t.Errorf("expected replaced delta, got %#v", u)
+	}
+	if u, _ := c.CheckUpdate(nil, mkCatalogApp("1.0.0", false)); u != full {
+		t.Errorf("expected full update, got %#v", u)
+	}
+
+	if err := c.RemoveUpdate(testAppID, "stable", "1.1.0", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := c.CheckUpdate(nil, mkCatalogApp("1.0.0", true)); u != full {
+		t.Errorf("removed delta offered, got %#v", u)
+	}
+	if err := c.RemoveUpdate(testAppID, "stable", "1.1.0", "1.0.0"); err == nil {
+		t.Error("removed a missing update")
+	}
+	if err := c.RemoveUpdate(testAppID, "stable", "1.1.0", ""); err == nil {
+		t.Error("removed the offered version")
+	}
+	if err := c.RemoveUpdate(testAppID, "stable", "1.2.0", ""); err != nil {
+		t.Errorf("failed removing 1.2.0: %v", err)
+	}
+
+	if err := c.ReplaceTrack(testAppID, "beta", &CatalogTrack{
+		Updates: []*Update{mkCatalogUpdate("2.0.0", "", false)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ReplaceTrack(testAppID, "beta", &CatalogTrack{Version: "3.0.0"}); err == nil {
+		t.Error("replaced track with a missing version")
+	}
+	if err := c.RemoveTrack(testAppID, "beta"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RemoveTrack(testAppID, "beta"); err == nil {
+		t.Error("removed a missing track")
+	}
+
+	if err := c.PinMachine(testAppID, "m1", "1.1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ReplaceApp(&CatalogApp{ID: testAppID}); err != nil {
+		t.Fatal(err)
+	}
+	if app := c.App(testAppID); len(app.Tracks) != 0 || len(app.Pins) != 0 {
+		t.Errorf("app not replaced: %#v", app)
+	}
+	if err := c.RemoveApp(testAppID); err != nil {
+		t.Fatal(err)
+	}
+	if c.App(testAppID) != nil {
+		t.Error("app not removed")
+	}
+}
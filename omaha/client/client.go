@@ -16,8 +16,12 @@
 package client
 
 import (
+	"crypto"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"log"
+	"net/http"
 	"net/url"
 	"time"
 
@@ -45,6 +49,15 @@ type Client struct {
 	isMachine     bool
 	sentPing      bool
 	apps          map[string]*AppClient
+	events        *EventQueue
+	handlers      []UpdateHandler
+	policies      []Policy
+	prompt        PromptHandler
+	trigger       chan struct{}
+	keys          []crypto.PublicKey
+	strictness    omaha.Strictness
+
+	forceAfterDeadline bool
 }
 
 // AppClient supports managing a single application.
@@ -54,6 +67,20 @@ type AppClient struct {
 	track   string
 	version string
 	oem     string
+	deltaOK bool
+
+	// set after failing to apply a delta, until the version changes.
+	deltaFailed bool
+
+	// nextVersion is the version of the update last offered, sent
+	// with events until the version changes or no update is offered.
+	// previousVersion is sent with the next update check, see
+	// SetPreviousVersion.
+	nextVersion     string
+	previousVersion string
+
+	targetVersionPrefix string
+	rollbackAllowed     bool
 }
 
 // New creates an omaha client for updating one or more applications.
@@ -69,6 +96,7 @@ func New(serverURL, userID string) (*Client, error) {
 		userID:        userID,
 		sessionID:     uuid.NewV4().String(),
 		apps:          make(map[string]*AppClient),
+		trigger:       make(chan struct{}, 1),
 	}
 
 	if err := c.SetServerURL(serverURL); err != nil {
@@ -105,14 +133,68 @@ func (c *Client) SetClientVersion(clientVersion string) {
 	c.clientVersion = clientVersion
 }
 
+// SetEventQueue enables queuing events until they are successfully
+// delivered to the server. Pending events are included in the next
+// request for the same application. Without a queue events are sent
+// once and dropped if that fails.
+func (c *Client) SetEventQueue(q *EventQueue) {
+	c.events = q
+}
+
+// SetStrictness sets how strictly server responses are validated.
+// Invalid responses are reported as ExitCodeOmahaResponseInvalid.
+// The default, omaha.ValidateNone, only checks what the client uses.
+func (c *Client) SetStrictness(level omaha.Strictness) {
+	c.strictness = level
+}
+
+// SetRecorder records every request sent to the server along with the
+// response, for debugging. Pass nil to stop recording.
+func (c *Client) SetRecorder(r *omaha.Recorder) {
+	c.apiClient.recorder = r
+}
+
+// SetBearerToken authenticates requests with a token shared by clients,
+// sent as "Authorization: Bearer <token>". Pass "" to stop.
+func (c *Client) SetBearerToken(token string) {
+	c.apiClient.token = token
+}
+
+// SetHMACKey signs requests with this machine's key, identifying it by
+// the user ID given to New. Pass nil to stop.
+func (c *Client) SetHMACKey(key []byte) {
+	c.apiClient.machineID = c.userID
+	c.apiClient.hmacKey = key
+}
+
+// SetTLSConfig sets the TLS configuration used to talk to the server,
+// and for downloads. Include a client certificate for servers that
+// authenticate clients by certificate.
+func (c *Client) SetTLSConfig(cfg *tls.Config) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = cfg
+	c.apiClient.Transport = t
+}
+
+// SetCompressRequests gzip compresses requests sent to the server. Only
+// enable it for servers known to accept compressed requests. Responses
+// are always allowed to be compressed.
+func (c *Client) SetCompressRequests(ok bool) {
+	c.apiClient.compress = ok
+}
+
 // NextPing returns a timer channel that will fire when the next update
 // check or ping should be sent.
 func (c *Client) NextPing() <-chan time.Time {
+	return time.After(c.nextPingDelay())
+}
+
+func (c *Client) nextPingDelay() time.Duration {
 	d := pingDelay
 	if c.sentPing {
 		d = pingInterval
 	}
-	return FuzzyAfter(d, pingFuzz)
+	return FuzzyDuration(d, pingFuzz)
 }
 
 // AppClient gets the application client for the given application ID.
@@ -177,9 +259,19 @@ func (ac *AppClient) SetVersion(version string) error {
 	}
 
 	ac.version = version
+	ac.deltaFailed = false
+	ac.nextVersion = ""
 	return nil
 }
 
+// SetPreviousVersion reports that the application was just updated from
+// the given version, as update_engine does after rebooting into a new
+// version. It is sent with the next successful update check, telling the
+// server the update completed.
+func (ac *AppClient) SetPreviousVersion(version string) {
+	ac.previousVersion = version
+}
+
 // SetTrack sets the application update track or group.
 // This is a update_engine/Core Update protocol extension.
 func (ac *AppClient) SetTrack(track string) error {
@@ -194,6 +286,26 @@ func (ac *AppClient) SetTrack(track string) error {
 	return nil
 }
 
+// SetDeltaOK tells the server this application can apply delta payloads.
+// This is a update_engine/Core Update protocol extension.
+func (ac *AppClient) SetDeltaOK(ok bool) {
+	ac.deltaOK = ok
+}
+
+// SetTargetVersionPrefix limits updates to versions starting with the
+// given dot separated components, such as "1.2" for any 1.2.x version.
+// Updates to other versions are ignored.
+func (ac *AppClient) SetTargetVersionPrefix(prefix string) {
+	ac.targetVersionPrefix = prefix
+}
+
+// SetRollbackAllowed tells the server this application accepts updates
+// to versions older than its current one. Rollbacks are ignored unless
+// allowed. This is a protocol 3.1 feature.
+func (ac *AppClient) SetRollbackAllowed(ok bool) {
+	ac.rollbackAllowed = ok
+}
+
 // SetOEM sets the application OEM name.
 // This is a update_engine/Core Update protocol extension.
 func (ac *AppClient) SetOEM(oem string) {
@@ -201,19 +313,38 @@ func (ac *AppClient) SetOEM(oem string) {
 }
 
 func (ac *AppClient) UpdateCheck() (*omaha.UpdateResponse, error) {
+	return ac.updateCheck("")
+}
+
+// updateCheck sends an update check, source is the request's
+// install source and may be blank.
+func (ac *AppClient) updateCheck(source string) (*omaha.UpdateResponse, error) {
 	req := ac.NewAppRequest()
+	req.InstallSource = source
 	app := req.Apps[0]
 	app.AddPing()
-	app.AddUpdateCheck()
+	uc := app.AddUpdateCheck()
+	uc.TargetVersionPrefix = ac.targetVersionPrefix
+	uc.RollbackAllowed = ac.rollbackAllowed
 
 	// Tell CoreUpdate to consider us in its "Complete" state,
 	// otherwise it interprets ping as "Instance-Hold" which is
-	// nonsense when we are sending an update check!
-	app.Events = append(app.Events, EventComplete)
+	// nonsense when we are sending an update check! Only the first
+	// check after an update says which version it came from.
+	complete := EventComplete
+	if ac.previousVersion != "" {
+		e := *EventComplete
+		e.PreviousVersion = ac.previousVersion
+		complete = &e
+	}
+	app.Events = append(app.Events, complete)
 
 	ac.sentPing = true
 
 	appResp, err := ac.SendAppRequest(req)
+	if delivered(err) {
+		ac.previousVersion = ""
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -229,14 +360,18 @@ func (ac *AppClient) UpdateCheck() (*omaha.UpdateResponse, error) {
 	}*/
 
 	if appResp.UpdateCheck == nil {
-		ac.Event(NewErrorEvent(ExitCodeOmahaResponseInvalid))
+		ac.sendEvent(NewErrorEvent(ExitCodeOmahaResponseInvalid))
 		return nil, fmt.Errorf("omaha: update check missing from response")
 	}
 
 	if appResp.UpdateCheck.Status != omaha.UpdateOK {
+		ac.nextVersion = ""
 		return nil, appResp.UpdateCheck.Status
 	}
 
+	if appResp.UpdateCheck.Manifest != nil {
+		ac.nextVersion = appResp.UpdateCheck.Manifest.Version
+	}
 	return appResp.UpdateCheck, nil
 }
 
@@ -268,15 +403,47 @@ func (ac *AppClient) Ping() error {
 
 // Event asynchronously sends the given omaha event.
 // Reading the error channel is optional.
+// If the client has an EventQueue the event is queued first, any other
+// events waiting in the queue for this application are sent with it.
+// Events are sent with the version of the update last offered, if any,
+// as their nextversion.
 func (ac *AppClient) Event(event *omaha.EventRequest) <-chan error {
+	if ac.nextVersion != "" && event.NextVersion == "" {
+		e := *event
+		e.NextVersion = ac.nextVersion
+		event = &e
+	}
+	return ac.sendEvent(event)
+}
+
+// sendEvent sends an event as is, see Event.
+func (ac *AppClient) sendEvent(event *omaha.EventRequest) <-chan error {
 	errc := make(chan error, 1)
 	url := ac.apiEndpoint
 	req := ac.NewAppRequest()
 	app := req.Apps[0]
-	app.Events = append(app.Events, event)
+
+	var queued []*queuedEvent
+	var queueErr error
+	if ac.events != nil {
+		queueErr = ac.events.Push(ac.appID, event)
+		queued = ac.events.take(ac.appID)
+		app.Events = append(app.Events, queuedEvents(queued)...)
+	} else {
+		app.Events = append(app.Events, event)
+	}
+
+	if len(app.Events) == 0 {
+		// Already in flight with another request.
+		errc <- queueErr
+		return errc
+	}
 
 	go func() {
 		appResp, err := ac.doReq(url, req)
+		if err := ac.events.done(queued, delivered(err)); err != nil && queueErr == nil {
+			queueErr = err
+		}
 		if err != nil {
 			errc <- err
 			return
@@ -294,7 +461,7 @@ func (ac *AppClient) Event(event *omaha.EventRequest) <-chan error {
 			return
 		}*/
 
-		errc <- nil
+		errc <- queueErr
 		return
 	}()
 
@@ -314,6 +481,7 @@ func (ac *AppClient) NewAppRequest() *omaha.Request {
 	app := req.AddApp(ac.appID, ac.version)
 	app.Track = ac.track
 	app.OEM = ac.oem
+	app.DeltaOK = ac.deltaOK && !ac.deltaFailed
 
 	// MachineID and BootID are non-standard fields used by CoreOS'
 	// update_engine and Core Update. Copy their values from the
@@ -326,20 +494,64 @@ func (ac *AppClient) NewAppRequest() *omaha.Request {
 }
 
 // SendAppRequest sends a Request object and validates the response.
-// On failure an error event is automatically sent to the server.
+// On failure an error event is automatically sent to the server, without
+// a nextversion since it is not about the update.
+// Any events waiting in the client's EventQueue are sent first, failing
+// to save the queue afterwards is logged.
 func (ac *AppClient) SendAppRequest(req *omaha.Request) (*omaha.AppResponse, error) {
+	var queued []*queuedEvent
+	if len(req.Apps) == 1 {
+		app := req.Apps[0]
+		queued = ac.events.take(app.ID)
+		if len(queued) != 0 {
+			app.Events = append(queuedEvents(queued), app.Events...)
+		}
+	}
+
 	resp, err := ac.doReq(ac.apiEndpoint, req)
+	if qerr := ac.events.done(queued, delivered(err)); qerr != nil {
+		// The response is still good, don't lose it over the queue.
+		log.Printf("omaha: Failed saving event queue: %v", qerr)
+	}
 	if _, ok := err.(omaha.AppStatus); ok {
 		// No point to sending an error if we got a well-formed
 		// non-ok application status in the response.
 	} else if err, ok := err.(ErrorEvent); ok {
-		ac.Event(err.ErrorEvent())
+		ac.sendEvent(err.ErrorEvent())
 	} else if err != nil {
-		ac.Event(NewErrorEvent(ExitCodeOmahaRequestError))
+		ac.sendEvent(NewErrorEvent(ExitCodeOmahaRequestError))
 	}
 	return resp, err
 }
 
+// delivered reports whether the server received and parsed a request.
+// A well-formed response with a non-ok application status still means
+// any events sent with it were recorded and must not be sent again.
+func delivered(err error) bool {
+	_, ok := err.(omaha.AppStatus)
+	return err == nil || ok
+}
+
+// Forward sends a request built elsewhere, such as one received by a
+// proxy, to the server and returns the complete response. The request is
+// sent as is: unlike SendAppRequest the client's identity is not added,
+// queued events are not included and no error events are sent.
+func (c *Client) Forward(req *omaha.Request) (*omaha.Response, error) {
+	resp, err := c.apiClient.Omaha(c.apiEndpoint, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := resp.Validate(c.strictness); err != nil {
+		return nil, &omahaError{
+			Err:  err,
+			Code: ExitCodeOmahaResponseInvalid,
+		}
+	}
+
+	return resp, nil
+}
+
 // doReq posts an omaha request. It may be called in its own goroutine so
 // it should not touch any mutable data in AppClient, but apiClient is ok.
 func (ac *AppClient) doReq(url string, req *omaha.Request) (*omaha.AppResponse, error) {
@@ -352,6 +564,13 @@ func (ac *AppClient) doReq(url string, req *omaha.Request) (*omaha.AppResponse,
 		return nil, err
 	}
 
+	if err := resp.Validate(ac.strictness); err != nil {
+		return nil, &omahaError{
+			Err:  err,
+			Code: ExitCodeOmahaResponseInvalid,
+		}
+	}
+
 	appResp := resp.GetApp(appID)
 	if appResp == nil {
 		return nil, &omahaError{
@@ -26,6 +26,7 @@ type recorder struct {
 	t      *testing.T
 	update *omaha.Update
 	checks []*omaha.UpdateRequest
+	srcs   []string
 	events []*omaha.EventRequest
 	pings  []*omaha.PingRequest
 }
@@ -64,6 +65,7 @@ func (r *recorder) CheckApp(req *omaha.Request, app *omaha.AppRequest) error {
 
 func (r *recorder) CheckUpdate(req *omaha.Request, app *omaha.AppRequest) (*omaha.Update, error) {
 	r.checks = append(r.checks, app.UpdateCheck)
+	r.srcs = append(r.srcs, req.InstallSource)
 	if r.update == nil {
 		return nil, omaha.NoUpdate
 	} else {
@@ -197,3 +199,103 @@ func TestClientEvent(t *testing.T) {
 		t.Fatalf("sent != received:\n%#v\n%#v", event, r.events[0])
 	}
 }
+
+func TestClientStrictness(t *testing.T) {
+	// An update without a package is useless but parses fine.
+	_, s := newRecordingServer(t, &omaha.Update{
+		Manifest: omaha.Manifest{Version: "1.1.1"},
+	})
+	defer s.Destroy()
+
+	url := "http://" + s.Addr().String()
+	ac, err := NewAppClient(url, "client-id", "app-id", "0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ac.UpdateCheck(); err != nil {
+		t.Fatalf("response rejected without validation: %v", err)
+	}
+
+	ac.SetStrictness(omaha.ValidateBasic)
+	_, err = ac.UpdateCheck()
+	if oe, ok := err.(*omahaError); !ok || oe.Code != ExitCodeOmahaResponseInvalid {
+		t.Fatalf("expected an invalid response error, got %v", err)
+	}
+}
+
+func TestClientForward(t *testing.T) {
+	r, s := newRecordingServer(t, &omaha.Update{
+		Manifest: omaha.Manifest{Version: "1.1.1"},
+	})
+	defer s.Destroy()
+
+	c, err := New("http://"+s.Addr().String(), "proxy-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := omaha.NewRequest()
+	req.UserID = "machine-id"
+	req.SessionID = "7d52a1cc-7066-40f0-91c7-7cb6a871bfde"
+	app := req.AddApp("app-id", "1.0.0")
+	app.MachineID = req.UserID
+	app.BootID = req.SessionID
+	app.AddUpdateCheck()
+	resp, err := c.Forward(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appResp := resp.GetApp("app-id")
+	if appResp == nil || appResp.UpdateCheck == nil || appResp.UpdateCheck.Status != omaha.UpdateOK {
+		t.Fatalf("unexpected response: %#v", resp)
+	}
+	if len(r.checks) != 1 {
+		t.Errorf("expected 1 update check, got %d", len(r.checks))
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	secret := []byte("secret")
+	r, s := newRecordingServer(t, nil)
+	defer s.Destroy()
+	s.SetAuthenticator(omaha.MultiAuth{
+		omaha.NewTokenAuth("token"),
+		omaha.NewHMACAuth(func(machineID string) []byte {
+			return omaha.HMACMachineKey(secret, machineID)
+		}),
+	})
+
+	url := "http://" + s.Addr().String()
+	for _, tt := range []struct {
+		name  string
+		token string
+		key   []byte
+		ok    bool
+	}{
+		{"none", "", nil, false},
+		{"bad token", "nope", nil, false},
+		{"token", "token", nil, true},
+		{"bad key", "", omaha.HMACMachineKey(secret, "other-id"), false},
+		{"key", "", omaha.HMACMachineKey(secret, "client-id"), true},
+	} {
+		ac, err := NewAppClient(url, "client-id", "app-id", "0.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ac.SetBearerToken(tt.token)
+		ac.SetHMACKey(tt.key)
+
+		checks := len(r.checks)
+		_, err = ac.UpdateCheck()
+		if tt.ok && err != omaha.NoUpdate {
+			t.Errorf("%s: expected noupdate, got %v", tt.name, err)
+		} else if !tt.ok && err == omaha.NoUpdate {
+			t.Errorf("%s: unauthenticated request accepted", tt.name)
+		}
+		if !tt.ok && len(r.checks) != checks {
+			t.Errorf("%s: unauthenticated request reached the updater", tt.name)
+		}
+	}
+}
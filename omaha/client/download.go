@@ -0,0 +1,199 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+// AddPublicKey adds a key trusted to sign update payloads. Once any key
+// is added downloaded payloads must carry a valid signature from one of
+// the trusted keys. Ed25519 and RSA keys are supported.
+func (c *Client) AddPublicKey(key crypto.PublicKey) error {
+	switch key.(type) {
+	case ed25519.PublicKey, *rsa.PublicKey:
+	default:
+		return fmt.Errorf("omaha: unsupported public key type %T", key)
+	}
+	c.keys = append(c.keys, key)
+	return nil
+}
+
+// Download fetches all of the update's packages into dir, returning the
+// paths of the downloaded files. Download started and finished events
+// are sent to the server but errors are not, they implement ErrorEvent
+// and should be returned from an UpdateHandler or reported by the caller.
+func (ac *AppClient) Download(update *omaha.UpdateResponse, dir string) ([]string, error) {
+	if update.Manifest == nil {
+		return nil, &omahaError{
+			Err:  errors.New("update manifest missing from response"),
+			Code: ExitCodeOmahaResponseInvalid,
+		}
+	}
+
+	ac.Event(EventDownloading)
+
+	var paths []string
+	for _, pkg := range update.Manifest.Packages {
+		path, err := ac.DownloadPackage(update, pkg, dir)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+
+	ac.Event(EventDownloaded)
+	return paths, nil
+}
+
+// DownloadPackage fetches a single package, trying each of the update's
+// URLs in order, and verifies its size and hashes. If the client has any
+// public keys the payload, the manifest's first package, must also be
+// signed and any other package is rejected. The file is only moved into
+// place in dir once verified. Errors implement ErrorEvent.
+func (c *Client) DownloadPackage(update *omaha.UpdateResponse, pkg *omaha.Package, dir string) (string, error) {
+	if pkg.Name == "" || filepath.Base(pkg.Name) != pkg.Name || pkg.Name[0] == '.' {
+		return "", &omahaError{
+			Err:  fmt.Errorf("invalid package name %q", pkg.Name),
+			Code: ExitCodeOmahaResponseInvalid,
+		}
+	}
+
+	if len(update.URLs) == 0 {
+		return "", &omahaError{
+			Err:  errors.New("update URLs missing from response"),
+			Code: ExitCodeOmahaResponseInvalid,
+		}
+	}
+
+	var sig []byte
+	if len(c.keys) != 0 {
+		var err error
+		if sig, err = c.packageSignature(update, pkg); err != nil {
+			return "", err
+		}
+	}
+
+	path := filepath.Join(dir, pkg.Name)
+	var err error
+	for _, u := range update.URLs {
+		if err = c.download(u.CodeBase+pkg.Name, path, pkg, sig); err == nil {
+			return path, nil
+		}
+		if oe, ok := err.(*omahaError); ok && oe.Code != ExitCodeDownloadTransferError {
+			// Don't bother with other mirrors if the server is
+			// giving us broken data or the disk is unhappy.
+			break
+		}
+	}
+
+	return "", err
+}
+
+// packageSignature finds and decodes the signature for pkg.
+func (c *Client) packageSignature(update *omaha.UpdateResponse, pkg *omaha.Package) ([]byte, error) {
+	act := update.PostinstallAction()
+	if act == nil || len(update.Manifest.Packages) == 0 ||
+		update.Manifest.Packages[0] != pkg {
+		return nil, &omahaError{
+			Err:  omaha.SignatureMissingError,
+			Code: ExitCodeDownloadMetadataSignatureMissingError,
+		}
+	}
+
+	sig, err := act.PayloadSignature()
+	if err != nil {
+		return nil, &omahaError{
+			Err:  err,
+			Code: ExitCodeDownloadMetadataSignatureError,
+		}
+	}
+	if sig == nil {
+		return nil, &omahaError{
+			Err:  omaha.SignatureMissingError,
+			Code: ExitCodeDownloadMetadataSignatureMissingError,
+		}
+	}
+
+	return sig, nil
+}
+
+// download fetches url to path, verifying it matches pkg and sig.
+func (c *Client) download(url, path string, pkg *omaha.Package, sig []byte) error {
+	// Payloads can be huge so don't reuse the API client's timeout.
+	hc := &http.Client{Transport: c.apiClient.Transport}
+	resp, err := hc.Get(url)
+	if err != nil {
+		return &omahaError{err, ExitCodeDownloadTransferError}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &omahaError{
+			Err:  fmt.Errorf("%s: http error: %s", url, resp.Status),
+			Code: ExitCodeDownloadTransferError,
+		}
+	}
+
+	tmp := path + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return &omahaError{err, ExitCodeDownloadWriteError}
+	}
+	defer os.Remove(tmp)
+
+	// VerifyReader consumes the body, hashing and writing it out as it goes.
+	h := sha256.New()
+	err = pkg.VerifyReader(io.TeeReader(resp.Body, io.MultiWriter(f, h)))
+	if cerr := f.Close(); err == nil && cerr != nil {
+		return &omahaError{cerr, ExitCodeDownloadWriteError}
+	}
+
+	switch err {
+	case nil:
+	case omaha.PackageSizeMismatchError:
+		return &omahaError{err, ExitCodePayloadSizeMismatchError}
+	case omaha.PackageHashMismatchError:
+		return &omahaError{err, ExitCodePayloadHashMismatchError}
+	default:
+		if _, ok := err.(*os.PathError); ok {
+			return &omahaError{err, ExitCodeDownloadWriteError}
+		}
+		return &omahaError{err, ExitCodeDownloadTransferError}
+	}
+
+	if len(c.keys) != 0 {
+		if err := omaha.VerifyDigest(c.keys, h.Sum(nil), sig); err != nil {
+			return &omahaError{err, ExitCodeDownloadMetadataSignatureVerificationError}
+		}
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return &omahaError{err, ExitCodeDownloadWriteError}
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+// newPackageServer serves "update.gz" containing data as version 1.1.1.
+func newPackageServer(t *testing.T, data string, key ed25519.PrivateKey) (*omaha.TrivialServer, func()) {
+	dir, err := ioutil.TempDir("", "go-omaha-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkg := filepath.Join(dir, "update.gz")
+	if err := ioutil.WriteFile(pkg, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := omaha.NewTrivialServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != nil {
+		s.SetSigningKey(key)
+	}
+	if err := s.AddPackage(pkg, "update.gz"); err != nil {
+		t.Fatal(err)
+	}
+	s.SetVersion("1.1.1")
+	go s.Serve()
+
+	return s, func() {
+		s.Destroy()
+		os.RemoveAll(dir)
+	}
+}
+
+func downloadUpdate(t *testing.T, s *omaha.TrivialServer, keys ...ed25519.PublicKey) error {
+	url := "http://" + s.Addr().String()
+	ac, err := NewAppClient(url, "client-id", "app-id", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if err := ac.AddPublicKey(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	update, err := ac.UpdateCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "go-omaha-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	paths, err := ac.Download(update, dir)
+	if err != nil {
+		return err
+	}
+
+	if len(paths) != 1 {
+		t.Fatalf("expected 1 package, not %d", len(paths))
+	}
+	data, err := ioutil.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "test" {
+		t.Fatalf("unexpected package data: %q", data)
+	}
+
+	return nil
+}
+
+func errorCode(err error) ExitCode {
+	if ee, ok := err.(ErrorEvent); ok {
+		return ExitCode(ee.ErrorEvent().ErrorCode)
+	}
+	return ExitCodeError
+}
+
+func TestDownload(t *testing.T) {
+	s, cleanup := newPackageServer(t, "test", nil)
+	defer cleanup()
+
+	if err := downloadUpdate(t, s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDownloadSigned(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, cleanup := newPackageServer(t, "test", priv)
+	defer cleanup()
+
+	if err := downloadUpdate(t, s, pub); err != nil {
+		t.Fatal(err)
+	}
+
+	err = downloadUpdate(t, s, other)
+	if code := errorCode(err); code != ExitCodeDownloadMetadataSignatureVerificationError {
+		t.Fatalf("unexpected error: %v (%s)", err, code)
+	}
+}
+
+func TestDownloadUnsigned(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, cleanup := newPackageServer(t, "test", nil)
+	defer cleanup()
+
+	err = downloadUpdate(t, s, pub)
+	if code := errorCode(err); code != ExitCodeDownloadMetadataSignatureMissingError {
+		t.Fatalf("unexpected error: %v (%s)", err, code)
+	}
+}
+
+func TestDownloadBadHash(t *testing.T) {
+	s, cleanup := newPackageServer(t, "test", nil)
+	defer cleanup()
+
+	url := "http://" + s.Addr().String()
+	ac, err := NewAppClient(url, "client-id", "app-id", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	update, err := ac.UpdateCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "go-omaha-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkg := *update.Manifest.Packages[0]
+	pkg.SHA1 = "xxxxxxxxxxxxxxxxxxxxxxxxxxx="
+	_, err = ac.DownloadPackage(update, &pkg, dir)
+	if code := errorCode(err); code != ExitCodePayloadHashMismatchError {
+		t.Fatalf("unexpected error: %v (%s)", err, code)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, pkg.Name)); !os.IsNotExist(err) {
+		t.Errorf("bad package left behind: %v", err)
+	}
+}
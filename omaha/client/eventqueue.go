@@ -0,0 +1,220 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+const (
+	// default maximum number of events held by an EventQueue
+	defaultEventQueueSize = 100
+)
+
+// EventQueue holds events that have not yet been delivered to the Omaha
+// server. Queued events are sent, oldest first, along with the next
+// request made for the same application and are only dropped from the
+// queue once the server has accepted that request. If the queue has a
+// backing file it is rewritten on every change so pending events survive
+// a restart, for example a reboot into a network outage right after an
+// update was installed.
+type EventQueue struct {
+	mu     sync.Mutex
+	path   string
+	max    int
+	events []*queuedEvent
+}
+
+type queuedEvent struct {
+	AppID string              `json:"appid"`
+	Event *omaha.EventRequest `json:"event"`
+
+	// set while the event is part of a request in progress.
+	inflight bool
+}
+
+// NewEventQueue creates an event queue, loading any events previously
+// saved to path. If path is blank the queue is only kept in memory.
+// Once the queue holds max events the oldest are dropped to make room,
+// a max of zero or less uses a default of 100.
+func NewEventQueue(path string, max int) (*EventQueue, error) {
+	if max <= 0 {
+		max = defaultEventQueueSize
+	}
+
+	q := &EventQueue{path: path, max: max}
+	if path == "" {
+		return q, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("omaha: failed to read event queue: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &q.events); err != nil {
+		return nil, fmt.Errorf("omaha: invalid event queue %s: %v", path, err)
+	}
+	q.trim()
+
+	return q, nil
+}
+
+// Len returns the number of undelivered events.
+func (q *EventQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.events)
+}
+
+// Push adds an event to the end of the queue. Events identical to one
+// already waiting for the same application are ignored. The event is
+// always queued in memory, the returned error only reports failures
+// to save the queue to disk.
+func (q *EventQueue) Push(appID string, event *omaha.EventRequest) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, qe := range q.events {
+		if qe.AppID == appID && reflect.DeepEqual(qe.Event, event) {
+			return nil
+		}
+	}
+
+	// Copy the event since callers often reuse the shared
+	// EventDownloading, EventComplete, etc. values.
+	ev := *event
+	q.events = append(q.events, &queuedEvent{AppID: appID, Event: &ev})
+	q.trim()
+
+	return q.save()
+}
+
+// take marks all queued events for appID as in flight and returns them.
+// Events already in flight with another request are skipped.
+func (q *EventQueue) take(appID string) []*queuedEvent {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var taken []*queuedEvent
+	for _, qe := range q.events {
+		if qe.AppID == appID && !qe.inflight {
+			qe.inflight = true
+			taken = append(taken, qe)
+		}
+	}
+	return taken
+}
+
+// done removes events returned by take from the queue if they were
+// delivered, otherwise they are released to be sent again later.
+func (q *EventQueue) done(taken []*queuedEvent, delivered bool) error {
+	if q == nil || len(taken) == 0 {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !delivered {
+		for _, qe := range taken {
+			qe.inflight = false
+		}
+		return nil
+	}
+
+	remove := make(map[*queuedEvent]bool, len(taken))
+	for _, qe := range taken {
+		remove[qe] = true
+	}
+
+	events := q.events[:0]
+	for _, qe := range q.events {
+		if !remove[qe] {
+			events = append(events, qe)
+		}
+	}
+	q.events = events
+
+	return q.save()
+}
+
+// trim drops the oldest events once the queue is over its size limit.
+func (q *EventQueue) trim() {
+	if over := len(q.events) - q.max; over > 0 {
+		q.events = append(q.events[:0], q.events[over:]...)
+	}
+}
+
+// save atomically replaces the queue's backing file, if any.
+func (q *EventQueue) save() error {
+	if q.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(q.events)
+	if err != nil {
+		return fmt.Errorf("omaha: failed to encode event queue: %v", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(q.path), ".eventqueue")
+	if err != nil {
+		return fmt.Errorf("omaha: failed to save event queue: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("omaha: failed to save event queue: %v", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("omaha: failed to save event queue: %v", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("omaha: failed to save event queue: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), q.path); err != nil {
+		return fmt.Errorf("omaha: failed to save event queue: %v", err)
+	}
+
+	return nil
+}
+
+// queuedEvents extracts the EventRequests from a list of queued events.
+func queuedEvents(queued []*queuedEvent) []*omaha.EventRequest {
+	events := make([]*omaha.EventRequest, len(queued))
+	for i, qe := range queued {
+		events[i] = qe.Event
+	}
+	return events
+}
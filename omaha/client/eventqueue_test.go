@@ -0,0 +1,265 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+func tempQueuePath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "go-omaha-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "events.json"), func() { os.RemoveAll(dir) }
+}
+
+func TestEventQueuePersist(t *testing.T) {
+	path, cleanup := tempQueuePath(t)
+	defer cleanup()
+
+	q, err := NewEventQueue(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push("app1", EventDownloaded); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push("app1", EventComplete); err != nil {
+		t.Fatal(err)
+	}
+
+	q2, err := NewEventQueue(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := queuedEvents(q2.take("app1"))
+	expect := []*omaha.EventRequest{EventDownloaded, EventComplete}
+	if !reflect.DeepEqual(events, expect) {
+		t.Fatalf("loaded %#v, not %#v", events, expect)
+	}
+}
+
+func TestEventQueueDedup(t *testing.T) {
+	q, err := NewEventQueue("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q.Push("app1", EventComplete)
+	q.Push("app1", EventComplete)
+	q.Push("app2", EventComplete)
+	if q.Len() != 2 {
+		t.Fatalf("expected 2 events, not %d", q.Len())
+	}
+}
+
+func TestEventQueueMax(t *testing.T) {
+	q, err := NewEventQueue("", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q.Push("app1", EventDownloading)
+	q.Push("app1", EventDownloaded)
+	q.Push("app1", EventInstalled)
+
+	events := queuedEvents(q.take("app1"))
+	expect := []*omaha.EventRequest{EventDownloaded, EventInstalled}
+	if !reflect.DeepEqual(events, expect) {
+		t.Fatalf("queued %#v, not %#v", events, expect)
+	}
+}
+
+func TestEventQueueDone(t *testing.T) {
+	q, err := NewEventQueue("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q.Push("app1", EventDownloaded)
+	taken := q.take("app1")
+	if len(q.take("app1")) != 0 {
+		t.Fatal("in flight events were taken twice")
+	}
+
+	q.done(taken, false)
+	taken = q.take("app1")
+	if len(taken) != 1 {
+		t.Fatalf("expected 1 event after failure, not %d", len(taken))
+	}
+
+	q.done(taken, true)
+	if q.Len() != 0 {
+		t.Fatalf("expected empty queue, not %d", q.Len())
+	}
+}
+
+func TestClientEventQueue(t *testing.T) {
+	path, cleanup := tempQueuePath(t)
+	defer cleanup()
+
+	r, s := newRecordingServer(t, nil)
+	url := "http://" + s.Addr().String()
+	s.Destroy()
+
+	ac, err := NewAppClient(url, "client-id", "app-id", "0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := NewEventQueue(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac.SetEventQueue(q)
+
+	if err := <-ac.Event(EventInstalled); err == nil {
+		t.Fatal("event sent to a stopped server")
+	}
+	if q.Len() != 1 {
+		t.Fatalf("expected 1 queued event, not %d", q.Len())
+	}
+
+	// Restart with a fresh client and queue loaded from disk.
+	r, s = newRecordingServer(t, nil)
+	defer s.Destroy()
+
+	url = "http://" + s.Addr().String()
+	ac, err = NewAppClient(url, "client-id", "app-id", "0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = NewEventQueue(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac.SetEventQueue(q)
+
+	if err := ac.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.events) != 1 {
+		t.Fatalf("expected 1 event, not %d", len(r.events))
+	}
+	if !reflect.DeepEqual(r.events[0], EventInstalled) {
+		t.Fatalf("expected %#v, not %#v", EventInstalled, r.events[0])
+	}
+	if q.Len() != 0 {
+		t.Fatalf("expected empty queue, not %d", q.Len())
+	}
+}
+
+func TestClientEventQueueAppStatus(t *testing.T) {
+	var events int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := omaha.ParseRequest("", r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events += len(req.Apps[0].Events)
+
+		// A valid response rejecting the app, as some servers send.
+		resp := omaha.NewResponse()
+		resp.AddApp(req.Apps[0].ID, omaha.AppUnknownID)
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		xml.NewEncoder(w).Encode(resp)
+	}))
+	defer s.Close()
+
+	ac, err := NewAppClient(s.URL, "client-id", "app-id", "0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := NewEventQueue("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac.SetEventQueue(q)
+
+	if err := <-ac.Event(EventInstalled); err != omaha.AppUnknownID {
+		t.Fatalf("expected %v, got %v", omaha.AppUnknownID, err)
+	}
+	if q.Len() != 0 {
+		t.Fatalf("delivered event left in queue: %d", q.Len())
+	}
+
+	if err := ac.Ping(); err != omaha.AppUnknownID {
+		t.Fatalf("expected %v, got %v", omaha.AppUnknownID, err)
+	}
+	if events != 1 {
+		t.Errorf("server received %d events, not 1", events)
+	}
+}
+
+func TestClientEventQueueSaveError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := omaha.ParseRequest("", r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := omaha.NewResponse()
+		resp.AddApp(req.Apps[0].ID, omaha.AppUnknownID)
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		xml.NewEncoder(w).Encode(resp)
+	}))
+	defer s.Close()
+
+	path, cleanup := tempQueuePath(t)
+	defer cleanup()
+	q, err := NewEventQueue(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push("app-id", EventInstalled); err != nil {
+		t.Fatal(err)
+	}
+
+	ac, err := NewAppClient(s.URL, "client-id", "app-id", "0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac.SetEventQueue(q)
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	// Saving the queue after delivering the event fails.
+	cleanup()
+	if err := ac.Ping(); err != omaha.AppUnknownID {
+		t.Fatalf("expected %v, got %v", omaha.AppUnknownID, err)
+	}
+	if !strings.Contains(logged.String(), "Failed saving event queue") {
+		t.Errorf("save error not logged: %q", logged.String())
+	}
+}
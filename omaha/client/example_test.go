@@ -15,6 +15,7 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"os"
 	//"os/signal"
@@ -24,13 +25,19 @@ import (
 )
 
 func Example() {
-	// Launch a dummy server for our client to talk to.
+	// Launch a dummy server for our client to talk to, offering
+	// an empty package as version 1.0.1 of our app.
 	s, err := omaha.NewTrivialServer("127.0.0.1:0")
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 	defer s.Destroy()
+	if err := s.AddPackage("/dev/null", "update.gz"); err != nil {
+		fmt.Println(err)
+		return
+	}
+	s.SetVersion("1.0.1")
 	go s.Serve()
 
 	// Configure our client. userID should be random but preserved
@@ -50,51 +57,40 @@ func Example() {
 	// Client version is the name and version of this updater.
 	c.SetClientVersion("example-0.0.1")
 
-	// Use SIGUSR1 to trigger immediate update checks.
-	sigc := make(chan os.Signal, 1)
-	//signal.Notify(sigc, syscall.SIGUSR1)
-	sigc <- syscall.SIGUSR1 // Fake it
+	// Run checks for updates until the context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	//for {
-	var source string
-	select {
-	case <-sigc:
-		source = "ondemandupdate"
-	case <-c.NextPing():
-		source = "scheduler"
-	}
+	c.OnUpdate(func(ac *AppClient, update *omaha.UpdateResponse) error {
+		// Download new application version.
+		ac.Event(EventDownloaded)
 
-	// TODO: pass source to UpdateCheck
-	_ = source
-	// If updates are disabled call c.Ping() instead.
-	update, err := c.UpdateCheck()
-	if err != nil {
-		fmt.Println(err)
-		//continue
-		return
-	}
+		// Install new application version here.
+		ac.Event(EventInstalled)
 
-	// Download new application version.
-	c.Event(&omaha.EventRequest{
-		Type:   omaha.EventTypeUpdateDownloadFinished,
-		Result: omaha.EventResultSuccess,
-	})
+		// Restart, new application is now running.
+		ac.SetVersion(update.Manifest.Version)
+		ac.Event(EventComplete)
 
-	// Install new application version here.
-	c.Event(&omaha.EventRequest{
-		Type:   omaha.EventTypeUpdateComplete,
-		Result: omaha.EventResultSuccess,
+		fmt.Println("updated to", update.Manifest.Version)
+		cancel()
+		return nil
 	})
 
-	// Restart, new application is now running.
-	c.SetVersion(update.Manifest.Version)
-	c.Event(&omaha.EventRequest{
-		Type:   omaha.EventTypeUpdateComplete,
-		Result: omaha.EventResultSuccessReboot,
-	})
+	// Use SIGUSR1 to trigger immediate update checks.
+	sigc := make(chan os.Signal, 1)
+	//signal.Notify(sigc, syscall.SIGUSR1)
+	sigc <- syscall.SIGUSR1 // Fake it
+	go func() {
+		for range sigc {
+			c.CheckNow()
+		}
+	}()
 
-	//}
+	if err := c.Run(ctx); err != context.Canceled {
+		fmt.Println(err)
+	}
 
 	// Output:
-	// omaha: update status noupdate
+	// updated to 1.0.1
 }
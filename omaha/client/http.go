@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/coreos/go-omaha/omaha"
@@ -33,26 +34,89 @@ const (
 // and decoding as well as automatic retries on transient failures.
 type httpClient struct {
 	http.Client
+
+	// recorder, if not nil, records every request and response.
+	recorder *omaha.Recorder
+
+	// credentials added to every request, see Client.SetBearerToken
+	// and Client.SetHMACKey.
+	token     string
+	machineID string
+	hmacKey   []byte
+
+	// compress request bodies, see Client.SetCompressRequests.
+	compress bool
 }
 
 func newHTTPClient() *httpClient {
-	return &httpClient{http.Client{
+	return &httpClient{Client: http.Client{
 		Timeout: defaultTimeout,
 	}}
 }
 
 // doPost sends a single HTTP POST, returning a parsed omaha response.
 func (hc *httpClient) doPost(url string, reqBody []byte) (*omaha.Response, error) {
-	resp, err := hc.Post(url, "text/xml; charset=utf-8", bytes.NewReader(reqBody))
+	sendBody := reqBody
+	if hc.compress {
+		var err error
+		if sendBody, err = omaha.EncodeBody("gzip", reqBody); err != nil {
+			return nil, &omahaError{err, ExitCodeOmahaRequestError}
+		}
+	}
+
+	httpReq, err := http.NewRequest("POST", url, bytes.NewReader(sendBody))
+	if err != nil {
+		return nil, &omahaError{err, ExitCodeOmahaRequestError}
+	}
+	httpReq.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	if hc.compress {
+		httpReq.Header.Set("Content-Encoding", "gzip")
+	}
+
+	// Decompress here rather than in http.Transport so the size limit
+	// below is enforced on the decompressed response.
+	httpReq.Header.Set("Accept-Encoding", omaha.AcceptEncoding)
+
+	// Credentials always cover the uncompressed body.
+	hc.authorize(httpReq, reqBody)
+
+	resp, err := hc.Do(httpReq)
 	if err != nil {
+		hc.record(&omaha.Record{URL: url, Request: string(reqBody), Error: err.Error()})
 		return nil, &omahaError{err, ExitCodeOmahaRequestError}
 	}
 	defer resp.Body.Close()
 
+	decoded, err := omaha.DecodeBody(resp.Header.Get("Content-Encoding"), resp.Body)
+	if err != nil {
+		hc.record(&omaha.Record{URL: url, Status: resp.StatusCode, Request: string(reqBody), Error: err.Error()})
+		if resp.StatusCode != http.StatusOK {
+			return nil, &httpError{resp}
+		}
+		return nil, &omahaError{err, ExitCodeOmahaRequestXMLParseError}
+	}
+
 	// A response over 1M in size is certainly bogus.
-	respBody := &io.LimitedReader{R: resp.Body, N: 1024 * 1024}
+	respBody := &io.LimitedReader{R: decoded, N: omaha.MaxDocumentSize}
 	contentType := resp.Header.Get("Content-Type")
-	omahaResp, err := omaha.ParseResponse(contentType, respBody)
+
+	var body io.Reader = respBody
+	var raw bytes.Buffer
+	if hc.recorder != nil {
+		body = io.TeeReader(respBody, &raw)
+	}
+	omahaResp, err := omaha.ParseResponse(contentType, body)
+
+	if hc.recorder != nil {
+		// Record what the server sent, not just what the parser read.
+		io.Copy(&raw, respBody)
+		hc.record(&omaha.Record{
+			URL:      url,
+			Status:   resp.StatusCode,
+			Request:  string(reqBody),
+			Response: raw.String(),
+		})
+	}
 
 	// Report a more sensible error if we truncated the body.
 	if isUnexpectedEOF(err) && respBody.N <= 0 {
@@ -71,6 +135,28 @@ func (hc *httpClient) doPost(url string, reqBody []byte) (*omaha.Response, error
 	return omahaResp, err
 }
 
+// authorize adds any configured credentials to a request.
+func (hc *httpClient) authorize(httpReq *http.Request, body []byte) {
+	if hc.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+hc.token)
+	}
+
+	if hc.hmacKey != nil {
+		date := strconv.FormatInt(time.Now().Unix(), 10)
+		httpReq.Header.Set(omaha.HeaderMachineID, hc.machineID)
+		httpReq.Header.Set(omaha.HeaderDate, date)
+		httpReq.Header.Set(omaha.HeaderSignature, omaha.HMACSign(hc.hmacKey, date, body))
+	}
+}
+
+// record saves rec if recording is enabled. Recording is a debugging aid
+// so failures are ignored.
+func (hc *httpClient) record(rec *omaha.Record) {
+	if hc.recorder != nil {
+		hc.recorder.Record(rec)
+	}
+}
+
 // Omaha encodes and sends an omaha request, retrying on any transient errors.
 func (hc *httpClient) Omaha(url string, req *omaha.Request) (resp *omaha.Response, err error) {
 	buf := bytes.NewBufferString(xml.Header)
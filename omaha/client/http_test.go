@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 
@@ -104,6 +105,39 @@ func newFlakyServer() (*flakyServer, error) {
 	return f, nil
 }
 
+func TestHTTPClientRecorder(t *testing.T) {
+	s, err := omaha.NewTrivialServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Destroy()
+	go s.Serve()
+
+	var buf bytes.Buffer
+	c := newHTTPClient()
+	c.recorder = omaha.NewRecorder(&buf)
+	url := "http://" + s.Addr().String() + "/v1/update/"
+
+	if _, err := c.doPost(url, []byte(sampleRequest)); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := omaha.ReadRecords(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(records))
+	}
+	rec := records[0]
+	if rec.URL != url || rec.Request != sampleRequest || rec.Status != http.StatusOK {
+		t.Errorf("unexpected record: %#v", rec)
+	}
+	if _, err := rec.ParseResponse(); err != nil {
+		t.Errorf("recorded response: %v", err)
+	}
+}
+
 func TestHTTPClientError(t *testing.T) {
 	f, err := newFlakyServer()
 	if err != nil {
@@ -210,3 +244,57 @@ func TestHTTPClientLarge(t *testing.T) {
 		t.Errorf("Unexpected error: %v", err)
 	}
 }
+
+// gzipBombHandler sends a small compressed response that expands past
+// the size limit.
+func gzipBombHandler(w http.ResponseWriter, r *http.Request) {
+	body := []byte(`<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		`<response protocol="3.0"><!--` + strings.Repeat(" ", 2*omaha.MaxDocumentSize) + `--></response>`)
+	gz, err := omaha.EncodeBody("gzip", body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Write(gz)
+}
+
+func TestHTTPClientCompression(t *testing.T) {
+	var encodings []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		if r.Header.Get("Accept-Encoding") != omaha.AcceptEncoding {
+			t.Errorf("unexpected Accept-Encoding %q", r.Header.Get("Accept-Encoding"))
+		}
+		h := &omaha.OmahaHandler{Updater: omaha.UpdaterStub{}}
+		h.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	c := newHTTPClient()
+	for _, compress := range []bool{false, true} {
+		c.compress = compress
+		resp, err := c.doPost(s.URL, []byte(sampleRequest))
+		if err != nil {
+			t.Fatalf("compress=%t: %v", compress, err)
+		}
+		if len(resp.Apps) != 1 || resp.Apps[0].Status != omaha.AppOK {
+			t.Errorf("compress=%t: unexpected response %#v", compress, resp)
+		}
+	}
+
+	if len(encodings) != 2 || encodings[0] != "" || encodings[1] != "gzip" {
+		t.Errorf("unexpected request encodings %q", encodings)
+	}
+}
+
+func TestHTTPClientGzipBomb(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(gzipBombHandler))
+	defer s.Close()
+
+	c := newHTTPClient()
+	if _, err := c.doPost(s.URL, []byte(sampleRequest)); err != bodySizeError {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
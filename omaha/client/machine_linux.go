@@ -33,7 +33,7 @@ const (
 func NewMachineClient(serverURL string) (*Client, error) {
 	machineID, err := ioutil.ReadFile(machineIDPath)
 	if err != nil {
-		fmt.Errorf("omaha: failed to read machine id: %v", err)
+		return nil, fmt.Errorf("omaha: failed to read machine id: %v", err)
 	}
 
 	machineID = bytes.TrimSpace(machineID)
@@ -43,19 +43,19 @@ func NewMachineClient(serverURL string) (*Client, error) {
 	// add the '-' chars but update_engine doesn't so stick with its
 	// behavior for now.
 	if len(machineID) < 32 {
-		fmt.Errorf("omaha: incomplete machine id: %q",
+		return nil, fmt.Errorf("omaha: incomplete machine id: %q",
 			machineID)
 	}
 
 	bootID, err := ioutil.ReadFile(bootIDPath)
 	if err != nil {
-		fmt.Errorf("omaha: failed to read boot id: %v", err)
+		return nil, fmt.Errorf("omaha: failed to read boot id: %v", err)
 	}
 
 	bootID = bytes.TrimSpace(bootID)
 	// unlike machineID, bootID *does* include '-' chars.
 	if len(bootID) < 36 {
-		fmt.Errorf("omaha: incomplete boot id: %q", bootID)
+		return nil, fmt.Errorf("omaha: incomplete boot id: %q", bootID)
 	}
 
 	c := &Client{
@@ -65,6 +65,7 @@ func NewMachineClient(serverURL string) (*Client, error) {
 		sessionID:     string(bootID),
 		isMachine:     true,
 		apps:          make(map[string]*AppClient),
+		trigger:       make(chan struct{}, 1),
 	}
 
 	if err := c.SetServerURL(serverURL); err != nil {
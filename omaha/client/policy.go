@@ -0,0 +1,496 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+// Stage identifies the step of the update process a Policy is checking.
+type Stage int
+
+const (
+	StageDownload Stage = iota
+	StageInstall
+)
+
+func (s Stage) String() string {
+	switch s {
+	case StageDownload:
+		return "download"
+	case StageInstall:
+		return "install"
+	default:
+		return fmt.Sprintf("stage %d", s)
+	}
+}
+
+// Policy decides if an update may proceed to the given stage. Returning
+// nil allows it, otherwise the error is reported to the server. Errors
+// should normally be a PolicyError created by DeferUpdate or IgnoreUpdate.
+type Policy interface {
+	Check(ac *AppClient, stage Stage, update *omaha.UpdateResponse) error
+}
+
+// PolicyFunc adapts an ordinary function to the Policy interface.
+type PolicyFunc func(ac *AppClient, stage Stage, update *omaha.UpdateResponse) error
+
+func (f PolicyFunc) Check(ac *AppClient, stage Stage, update *omaha.UpdateResponse) error {
+	return f(ac, stage, update)
+}
+
+// PolicyError implements error and ErrorEvent for updates held back
+// by a Policy.
+type PolicyError struct {
+	Reason string
+	Code   ExitCode
+}
+
+// DeferUpdate creates an error for updates that should be retried later.
+func DeferUpdate(reason string) *PolicyError {
+	return &PolicyError{reason, ExitCodeOmahaUpdateDeferredPerPolicy}
+}
+
+// IgnoreUpdate creates an error for updates that should not be applied.
+func IgnoreUpdate(reason string) *PolicyError {
+	return &PolicyError{reason, ExitCodeOmahaUpdateIgnoredPerPolicy}
+}
+
+func (pe *PolicyError) Error() string {
+	return fmt.Sprintf("omaha: %s: %s", pe.Code, pe.Reason)
+}
+
+func (pe *PolicyError) ErrorEvent() *omaha.EventRequest {
+	event := NewErrorEvent(pe.Code)
+	if pe.Code == ExitCodeOmahaUpdateDeferredPerPolicy {
+		event.Result = omaha.EventResultUpdateDeferred
+	}
+	return event
+}
+
+// AddPolicy adds a policy to be evaluated by CheckPolicy.
+// Policies are checked in the order they were added.
+func (c *Client) AddPolicy(p Policy) {
+	c.policies = append(c.policies, p)
+}
+
+// CheckPolicy evaluates all policies for the given update and stage,
+// returning the first error. Run checks StageDownload before calling any
+// UpdateHandler, handlers should check StageInstall before installing
+// and return the error as-is so it is reported to the server.
+// Deferrals are skipped for updates forced by SetForceAfterDeadline.
+func (ac *AppClient) CheckPolicy(stage Stage, update *omaha.UpdateResponse) error {
+	forced := false
+	if ac.forceAfterDeadline {
+		if info, err := NewUpdateInfo(update); err == nil {
+			forced = ac.forced(info)
+		}
+	}
+
+	for _, p := range ac.policies {
+		err := p.Check(ac, stage, update)
+		if pe, ok := err.(*PolicyError); ok && forced &&
+			pe.Code == ExitCodeOmahaUpdateDeferredPerPolicy {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Window is a recurring period of time during the week.
+type Window struct {
+	days  [7]bool       // indexed by time.Weekday
+	start time.Duration // offset from midnight
+	end   time.Duration // offset from midnight, may be less than start
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ParseWindow parses a window in the format "DAYS HH:MM-HH:MM" where DAYS
+// is "*" or a comma separated list of day names or ranges of days, e.g.
+// "Mon-Fri 02:00-04:00" or "Sat,Sun 22:00-06:00". Windows that end before
+// they start run past midnight into the next day. If DAYS is omitted the
+// window applies to every day.
+func ParseWindow(spec string) (*Window, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 1 {
+		fields = []string{"*", fields[0]}
+	}
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("omaha: invalid window %q", spec)
+	}
+
+	w := &Window{}
+	if err := w.parseDays(fields[0]); err != nil {
+		return nil, fmt.Errorf("omaha: invalid window %q: %v", spec, err)
+	}
+
+	times := strings.Split(fields[1], "-")
+	if len(times) != 2 {
+		return nil, fmt.Errorf("omaha: invalid window %q: bad time range", spec)
+	}
+
+	var err error
+	if w.start, err = parseClock(times[0]); err != nil {
+		return nil, fmt.Errorf("omaha: invalid window %q: %v", spec, err)
+	}
+	if w.end, err = parseClock(times[1]); err != nil {
+		return nil, fmt.Errorf("omaha: invalid window %q: %v", spec, err)
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("omaha: invalid window %q: empty time range", spec)
+	}
+
+	return w, nil
+}
+
+func (w *Window) parseDays(days string) error {
+	if days == "*" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return nil
+	}
+
+	for _, r := range strings.Split(days, ",") {
+		bounds := strings.Split(r, "-")
+		if len(bounds) > 2 {
+			return fmt.Errorf("bad day range %q", r)
+		}
+
+		first, ok := weekdays[strings.ToLower(bounds[0])]
+		if !ok {
+			return fmt.Errorf("bad day %q", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[strings.ToLower(bounds[1])]; !ok {
+				return fmt.Errorf("bad day %q", bounds[1])
+			}
+		}
+
+		// ranges such as Fri-Mon wrap around the weekend
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseClock parses HH:MM into an offset from midnight, 24:00 is allowed.
+func parseClock(clock string) (time.Duration, error) {
+	parts := strings.Split(clock, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("bad time %q", clock)
+	}
+
+	h, err := strconv.Atoi(parts[0])
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("bad time %q", clock)
+	}
+
+	m, err := strconv.Atoi(parts[1])
+	if err != nil || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("bad time %q", clock)
+	}
+
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// Contains reports if t, in its own location, falls within the window.
+func (w *Window) Contains(t time.Time) bool {
+	// The wall clock time, not the time since midnight, which is an
+	// hour off on days daylight saving time starts or ends.
+	offset := time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+
+	if w.start < w.end {
+		return w.days[today] && offset >= w.start && offset < w.end
+	}
+
+	// window started yesterday or starts today and runs past midnight
+	return (w.days[today] && offset >= w.start) ||
+		(w.days[yesterday] && offset < w.end)
+}
+
+// WindowPolicy defers updates outside of the given maintenance windows.
+type WindowPolicy struct {
+	Windows []*Window
+
+	// Stages the policy applies to, all stages if empty.
+	Stages []Stage
+
+	// Location windows are interpreted in, local time if nil.
+	Location *time.Location
+
+	now func() time.Time // for testing
+}
+
+func (wp *WindowPolicy) Check(ac *AppClient, stage Stage, update *omaha.UpdateResponse) error {
+	if !stageIn(stage, wp.Stages) {
+		return nil
+	}
+
+	now := time.Now()
+	if wp.now != nil {
+		now = wp.now()
+	}
+	if wp.Location != nil {
+		now = now.In(wp.Location)
+	}
+
+	for _, w := range wp.Windows {
+		if w.Contains(now) {
+			return nil
+		}
+	}
+
+	return DeferUpdate(stage.String() + " outside of maintenance window")
+}
+
+// MeteredPolicy defers downloads while the network connection is metered.
+type MeteredPolicy struct {
+	IsMetered func() bool
+}
+
+func (mp *MeteredPolicy) Check(ac *AppClient, stage Stage, update *omaha.UpdateResponse) error {
+	if stage == StageDownload && mp.IsMetered != nil && mp.IsMetered() {
+		return DeferUpdate("network is metered")
+	}
+	return nil
+}
+
+const (
+	// locks on the reboot semaphore file older than this are stale.
+	rebootLockStale = time.Minute
+	rebootLockTries = 50
+	rebootLockWait  = 100 * time.Millisecond
+
+	// holders that have not released the semaphore after this long
+	// are assumed to have crashed.
+	defaultRebootLease = time.Hour
+)
+
+// RebootLockPolicy limits how many machines may install, and reboot into,
+// an update at once. Holders are recorded in a file shared by all of the
+// machines, each holder must call Release once it has rebooted. A holder
+// that fails to do so, such as one that crashed, loses its hold once its
+// lease expires.
+type RebootLockPolicy struct {
+	Path string
+
+	// Max concurrent holders, 1 if not positive.
+	Max int
+
+	// Lease is how long a hold lasts, an hour if zero. Each check by
+	// a holder renews it.
+	Lease time.Duration
+
+	// ID of this holder, the client's user ID if blank.
+	ID string
+}
+
+type rebootSemaphore struct {
+	Holders []rebootHolder `json:"holders"`
+}
+
+type rebootHolder struct {
+	ID      string    `json:"id"`
+	Expires time.Time `json:"expires"`
+}
+
+func (rp *RebootLockPolicy) Check(ac *AppClient, stage Stage, update *omaha.UpdateResponse) error {
+	if stage != StageInstall {
+		return nil
+	}
+
+	id := rp.ID
+	if id == "" {
+		id = ac.userID
+	}
+
+	max := rp.Max
+	if max <= 0 {
+		max = 1
+	}
+
+	lease := rp.Lease
+	if lease <= 0 {
+		lease = defaultRebootLease
+	}
+
+	acquired := false
+	err := rp.update(func(sem *rebootSemaphore) bool {
+		now := time.Now()
+		changed := sem.expire(now)
+		for i, h := range sem.Holders {
+			if h.ID == id {
+				sem.Holders[i].Expires = now.Add(lease)
+				acquired = true
+				return true
+			}
+		}
+		if len(sem.Holders) >= max {
+			return changed
+		}
+		sem.Holders = append(sem.Holders, rebootHolder{id, now.Add(lease)})
+		acquired = true
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	if !acquired {
+		return DeferUpdate("maximum concurrent reboots reached")
+	}
+	return nil
+}
+
+// Release gives up the client's hold on the semaphore, ID if set or
+// otherwise the client's user ID, once it has rebooted.
+func (rp *RebootLockPolicy) Release(ac *AppClient) error {
+	id := rp.ID
+	if id == "" {
+		id = ac.userID
+	}
+
+	return rp.update(func(sem *rebootSemaphore) bool {
+		for i, h := range sem.Holders {
+			if h.ID == id {
+				sem.Holders = append(sem.Holders[:i], sem.Holders[i+1:]...)
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// expire drops holders whose lease has run out, reporting if any were.
+func (sem *rebootSemaphore) expire(now time.Time) bool {
+	holders := sem.Holders[:0]
+	for _, h := range sem.Holders {
+		if now.Before(h.Expires) {
+			holders = append(holders, h)
+		}
+	}
+	changed := len(holders) != len(sem.Holders)
+	sem.Holders = holders
+	return changed
+}
+
+// update applies f to the semaphore while holding its lock, rewriting
+// the file if f returns true.
+func (rp *RebootLockPolicy) update(f func(*rebootSemaphore) bool) error {
+	unlock, err := lockFile(rp.Path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	sem := &rebootSemaphore{}
+	data, err := ioutil.ReadFile(rp.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("omaha: failed to read reboot lock: %v", err)
+	} else if err == nil {
+		if err := json.Unmarshal(data, sem); err != nil {
+			return fmt.Errorf("omaha: invalid reboot lock %s: %v", rp.Path, err)
+		}
+	}
+
+	if !f(sem) {
+		return nil
+	}
+
+	if data, err = json.Marshal(sem); err != nil {
+		return fmt.Errorf("omaha: failed to encode reboot lock: %v", err)
+	}
+
+	tmp := filepath.Join(filepath.Dir(rp.Path), "."+filepath.Base(rp.Path)+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("omaha: failed to write reboot lock: %v", err)
+	}
+	if err := os.Rename(tmp, rp.Path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("omaha: failed to write reboot lock: %v", err)
+	}
+
+	return nil
+}
+
+// lockFile creates path exclusively, waiting for any other holder to
+// remove it. Locks left behind by crashed processes expire eventually.
+func lockFile(path string) (func(), error) {
+	for tries := 0; ; tries++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("omaha: failed to lock %s: %v", path, err)
+		}
+		if tries >= rebootLockTries {
+			return nil, fmt.Errorf("omaha: timed out waiting for lock %s", path)
+		}
+
+		if fi, err := os.Stat(path); err == nil &&
+			time.Since(fi.ModTime()) > rebootLockStale {
+			os.Remove(path)
+			continue
+		}
+
+		time.Sleep(rebootLockWait)
+	}
+}
+
+func stageIn(stage Stage, stages []Stage) bool {
+	if len(stages) == 0 {
+		return true
+	}
+	for _, s := range stages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,265 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+func TestParseWindow(t *testing.T) {
+	// 2017-01-02 was a Monday
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2017, 1, 1+day, hour, min, 0, 0, time.UTC)
+	}
+
+	for _, tt := range []struct {
+		spec string
+		t    time.Time
+		in   bool
+	}{
+		{"Mon-Fri 02:00-04:00", at(1, 2, 0), true},
+		{"Mon-Fri 02:00-04:00", at(1, 4, 0), false},
+		{"Mon-Fri 02:00-04:00", at(0, 3, 0), false},
+		{"Mon,Wed 02:00-04:00", at(3, 3, 59), true},
+		{"Mon,Wed 02:00-04:00", at(2, 3, 0), false},
+		{"Fri-Mon 02:00-04:00", at(0, 3, 0), true},
+		{"Sat 22:00-02:00", at(6, 23, 0), true},
+		{"Sat 22:00-02:00", at(7, 1, 0), true},
+		{"Sat 22:00-02:00", at(7, 22, 30), false},
+		{"00:00-24:00", at(4, 12, 0), true},
+		{"* 12:00-13:00", at(4, 12, 30), true},
+	} {
+		w, err := ParseWindow(tt.spec)
+		if err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+			continue
+		}
+		if in := w.Contains(tt.t); in != tt.in {
+			t.Errorf("%q contains %s = %t", tt.spec, tt.t, in)
+		}
+	}
+
+	for _, spec := range []string{
+		"",
+		"Mon",
+		"Mon 02:00",
+		"Mon 02:00-02:00",
+		"Mon 25:00-02:00",
+		"Mon 24:30-02:00",
+		"Mon-Tue-Wed 01:00-02:00",
+		"Moon 01:00-02:00",
+	} {
+		if _, err := ParseWindow(spec); err == nil {
+			t.Errorf("%q was not rejected", spec)
+		}
+	}
+}
+
+func TestWindowPolicy(t *testing.T) {
+	w, err := ParseWindow("Mon 02:00-04:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2017, 1, 2, 5, 0, 0, 0, time.UTC)
+	wp := &WindowPolicy{
+		Windows:  []*Window{w},
+		Stages:   []Stage{StageInstall},
+		Location: time.UTC,
+		now:      func() time.Time { return now },
+	}
+
+	if err := wp.Check(nil, StageDownload, nil); err != nil {
+		t.Errorf("download deferred: %v", err)
+	}
+
+	err = wp.Check(nil, StageInstall, nil)
+	if pe, ok := err.(*PolicyError); !ok || pe.Code != ExitCodeOmahaUpdateDeferredPerPolicy {
+		t.Errorf("install not deferred: %v", err)
+	}
+
+	now = now.Add(-2 * time.Hour)
+	if err := wp.Check(nil, StageInstall, nil); err != nil {
+		t.Errorf("install deferred: %v", err)
+	}
+}
+
+func TestWindowDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	w, err := ParseWindow("Sun 04:00-05:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clocks skip from 2:00 to 3:00 on March 12th and go back from
+	// 2:00 to 1:00 on November 5th.
+	for _, day := range []time.Time{
+		time.Date(2017, time.March, 12, 0, 0, 0, 0, loc),
+		time.Date(2017, time.November, 5, 0, 0, 0, 0, loc),
+	} {
+		for _, tt := range []struct {
+			hour, min int
+			expect    bool
+		}{
+			{3, 59, false},
+			{4, 0, true},
+			{4, 59, true},
+			{5, 0, false},
+		} {
+			at := time.Date(day.Year(), day.Month(), day.Day(), tt.hour, tt.min, 0, 0, loc)
+			if w.Contains(at) != tt.expect {
+				t.Errorf("%s: expected %v", at, tt.expect)
+			}
+		}
+	}
+}
+
+func TestRebootLockPolicy(t *testing.T) {
+	path, cleanup := tempQueuePath(t)
+	defer cleanup()
+
+	c1, err := New("http://localhost", "client1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac1, _ := c1.NewAppClient("app-id", "1.0.0")
+
+	c2, err := New("http://localhost", "client2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac2, _ := c2.NewAppClient("app-id", "1.0.0")
+
+	rp := &RebootLockPolicy{Path: path, Max: 1}
+
+	if err := rp.Check(ac1, StageDownload, nil); err != nil {
+		t.Fatalf("download deferred: %v", err)
+	}
+	if err := rp.Check(ac1, StageInstall, nil); err != nil {
+		t.Fatalf("client1 deferred: %v", err)
+	}
+	if err := rp.Check(ac1, StageInstall, nil); err != nil {
+		t.Fatalf("client1 deferred on second check: %v", err)
+	}
+	if err := rp.Check(ac2, StageInstall, nil); err == nil {
+		t.Fatal("client2 was not deferred")
+	}
+
+	if err := rp.Release(ac1); err != nil {
+		t.Fatal(err)
+	}
+	if err := rp.Check(ac2, StageInstall, nil); err != nil {
+		t.Fatalf("client2 deferred after release: %v", err)
+	}
+}
+
+func TestRebootLockPolicyDefaults(t *testing.T) {
+	path, cleanup := tempQueuePath(t)
+	defer cleanup()
+
+	c, err := New("http://localhost", "client1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac, _ := c.NewAppClient("app-id", "1.0.0")
+
+	// A zero Max allows one holder rather than none.
+	rp := &RebootLockPolicy{Path: path}
+	if err := rp.Check(ac, StageInstall, nil); err != nil {
+		t.Fatalf("zero Max deferred: %v", err)
+	}
+	if err := rp.Check(ac, StageInstall, nil); err != nil {
+		t.Fatalf("holder deferred on second check: %v", err)
+	}
+	rp.ID = "client2"
+	if err := rp.Check(ac, StageInstall, nil); err == nil {
+		t.Fatal("second holder was not deferred")
+	}
+}
+
+func TestRebootLockPolicyLease(t *testing.T) {
+	path, cleanup := tempQueuePath(t)
+	defer cleanup()
+
+	c, err := New("http://localhost", "client1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac, _ := c.NewAppClient("app-id", "1.0.0")
+
+	// A holder that crashed long ago without releasing.
+	stale := `{"holders": [{"id": "crashed", "expires": "2017-01-01T00:00:00Z"}]}`
+	if err := ioutil.WriteFile(path, []byte(stale), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rp := &RebootLockPolicy{Path: path, Max: 1, Lease: time.Minute}
+	if err := rp.Check(ac, StageInstall, nil); err != nil {
+		t.Fatalf("deferred by expired holder: %v", err)
+	}
+
+	rp.ID = "crashed"
+	if err := rp.Check(ac, StageInstall, nil); err == nil {
+		t.Fatal("expired holder was not deferred")
+	}
+}
+
+func TestRunPolicyDeferred(t *testing.T) {
+	r, s := newRecordingServer(t, &omaha.Update{
+		Manifest: omaha.Manifest{
+			Version: "1.1.1",
+		},
+	})
+	defer s.Destroy()
+
+	url := "http://" + s.Addr().String()
+	ac, err := NewAppClient(url, "client-id", "app-id", "0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ac.AddPolicy(&MeteredPolicy{IsMetered: func() bool {
+		cancel()
+		return true
+	}})
+	ac.OnUpdate(func(ac *AppClient, update *omaha.UpdateResponse) error {
+		t.Error("update handler called")
+		return nil
+	})
+
+	ac.CheckNow()
+	if err := ac.Run(ctx); err != context.Canceled {
+		t.Fatalf("Run returned %v", err)
+	}
+
+	if len(r.events) != 2 {
+		t.Fatalf("expected 2 events, not %d", len(r.events))
+	}
+	if r.events[1].Result != omaha.EventResultUpdateDeferred ||
+		r.events[1].ErrorCode != int(ExitCodeOmahaUpdateDeferredPerPolicy) {
+		t.Fatalf("unexpected event: %s", EventString(r.events[1]))
+	}
+}
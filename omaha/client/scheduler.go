@@ -0,0 +1,177 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+const (
+	// Request install sources used by update_engine to tell the
+	// server why an update check was made.
+	InstallSourceScheduler = "scheduler"
+	InstallSourceOnDemand  = "ondemandupdate"
+)
+
+// UpdateHandler is called by Run when an update check finds an update
+// for an application, policy allows downloading it, and the user has
+// accepted it if a prompt was requested. Returned errors are reported
+// to the server and skip any remaining handlers; errors implementing
+// ErrorEvent provide their own event, anything else is reported as
+// ExitCodeError. If applying a delta payload fails the handler should
+// return an ErrorEvent with one of the update_engine delta operation exit
+// codes, such as ExitCodeDownloadOperationExecutionError, to have Run
+// retry with a full payload.
+type UpdateHandler func(ac *AppClient, update *omaha.UpdateResponse) error
+
+// OnUpdate registers a handler to be called by Run for each update found.
+// Handlers are called in the order they were registered.
+func (c *Client) OnUpdate(h UpdateHandler) {
+	c.handlers = append(c.handlers, h)
+}
+
+// CheckNow asks Run to check all applications for updates immediately
+// instead of waiting for the next scheduled check. Unlike the rest of
+// Client it is safe to call from any goroutine.
+func (c *Client) CheckNow() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+		// a check is already pending
+	}
+}
+
+// Run checks all applications for updates periodically, using the same
+// fuzzed interval as NextPing, or immediately when CheckNow is called.
+// Handlers registered with OnUpdate are called from Run's goroutine so
+// while Run is active the Client and its AppClients should only be used
+// by those handlers. Run returns when ctx is done.
+func (c *Client) Run(ctx context.Context) error {
+	for {
+		timer := time.NewTimer(c.nextPingDelay())
+
+		var source string
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-c.trigger:
+			timer.Stop()
+			source = InstallSourceOnDemand
+		case <-timer.C:
+			source = InstallSourceScheduler
+		}
+
+		c.checkAll(source)
+	}
+}
+
+// checkAll sends an update check for every application, in a stable
+// order, and calls the update handlers for any that have an update.
+func (c *Client) checkAll(source string) {
+	ids := make([]string, 0, len(c.apps))
+	for id := range c.apps {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		c.apps[id].checkAndUpdate(source)
+	}
+}
+
+// checkAndUpdate checks a single application for updates and applies
+// any found. If applying a delta payload fails deltas are disabled and
+// the update is immediately retried with a full payload. Other errors,
+// such as a policy deferring the install, never cause a retry.
+func (ac *AppClient) checkAndUpdate(source string) {
+	update, err := ac.updateCheck(source)
+	if err != nil {
+		// SendAppRequest already reported any real failure.
+		return
+	}
+
+	info, err := NewUpdateInfo(update)
+	if err != nil {
+		ac.reportError(err)
+		return
+	}
+
+	if err := ac.checkTarget(info); err != nil {
+		ac.reportError(err)
+		return
+	}
+
+	if err := ac.CheckPolicy(StageDownload, update); err != nil {
+		ac.reportError(err)
+		return
+	}
+
+	if err := ac.checkPrompt(info); err != nil {
+		ac.reportError(err)
+		return
+	}
+
+	for _, h := range ac.handlers {
+		if err = h(ac, update); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		return
+	}
+
+	ac.reportError(err)
+	if act := update.PostinstallAction(); act != nil && act.IsDeltaPayload &&
+		ac.deltaOK && !ac.deltaFailed && isDeltaFailure(err) {
+		ac.deltaFailed = true
+		ac.checkAndUpdate(source)
+	}
+}
+
+// reportError sends an error event describing err, waiting for it to be
+// delivered or queued.
+func (ac *AppClient) reportError(err error) {
+	event := NewErrorEvent(ExitCodeError)
+	if ee, ok := err.(ErrorEvent); ok {
+		event = ee.ErrorEvent()
+	}
+	<-ac.Event(event)
+}
+
+// isDeltaFailure reports whether err is update_engine's way of saying
+// a delta payload could not be applied to the current version.
+func isDeltaFailure(err error) bool {
+	ee, ok := err.(ErrorEvent)
+	if !ok {
+		return false
+	}
+	if _, ok := err.(*PolicyError); ok {
+		return false
+	}
+
+	switch ExitCode(ee.ErrorEvent().ErrorCode) {
+	case ExitCodeDownloadOperationHashVerificationError,
+		ExitCodeDownloadOperationExecutionError,
+		ExitCodeDownloadOperationHashMismatch,
+		ExitCodeDownloadOperationHashMissingError:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,418 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+func TestRunOnDemand(t *testing.T) {
+	r, s := newRecordingServer(t, &omaha.Update{
+		Manifest: omaha.Manifest{
+			Version: "1.1.1",
+		},
+	})
+	defer s.Destroy()
+
+	url := "http://" + s.Addr().String()
+	ac, err := NewAppClient(url, "client-id", "app-id", "0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var updates []string
+	ac.OnUpdate(func(ac *AppClient, update *omaha.UpdateResponse) error {
+		updates = append(updates, update.Manifest.Version)
+		cancel()
+		return nil
+	})
+
+	ac.CheckNow()
+	ac.CheckNow() // should not block
+	if err := ac.Run(ctx); err != context.Canceled {
+		t.Fatalf("Run returned %v", err)
+	}
+
+	if len(updates) != 1 || updates[0] != "1.1.1" {
+		t.Fatalf("unexpected updates: %v", updates)
+	}
+
+	if len(r.srcs) != 1 || r.srcs[0] != InstallSourceOnDemand {
+		t.Fatalf("unexpected install sources: %q", r.srcs)
+	}
+}
+
+func TestRunHandlerError(t *testing.T) {
+	r, s := newRecordingServer(t, &omaha.Update{
+		Manifest: omaha.Manifest{
+			Version: "1.1.1",
+		},
+	})
+	defer s.Destroy()
+
+	url := "http://" + s.Addr().String()
+	ac, err := NewAppClient(url, "client-id", "app-id", "0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	called := false
+	ac.OnUpdate(func(ac *AppClient, update *omaha.UpdateResponse) error {
+		cancel()
+		return &omahaError{
+			Err:  errors.New("fake download failure"),
+			Code: ExitCodeDownloadTransferError,
+		}
+	})
+	ac.OnUpdate(func(ac *AppClient, update *omaha.UpdateResponse) error {
+		called = true
+		return nil
+	})
+
+	ac.CheckNow()
+	if err := ac.Run(ctx); err != context.Canceled {
+		t.Fatalf("Run returned %v", err)
+	}
+
+	if called {
+		t.Error("second handler called after an error")
+	}
+
+	// EventComplete is sent with the check, then the error.
+	if len(r.events) != 2 {
+		t.Fatalf("expected 2 events, not %d", len(r.events))
+	}
+	if r.events[1].ErrorCode != int(ExitCodeDownloadTransferError) {
+		t.Fatalf("unexpected error event: %s", EventString(r.events[1]))
+	}
+}
+
+// newDeltaServer serves a full and a delta update from 1.0.0 to 1.1.1.
+func newDeltaServer(t *testing.T) *omaha.Server {
+	catalog := omaha.NewCatalog()
+	for _, u := range []*omaha.Update{{
+		ID:       "app-id",
+		Manifest: omaha.Manifest{Version: "1.1.1"},
+	}, {
+		ID:              "app-id",
+		PreviousVersion: "1.0.0",
+		Manifest: omaha.Manifest{
+			Version: "1.1.1",
+			Actions: []*omaha.Action{{
+				Event:          "postinstall",
+				IsDeltaPayload: true,
+			}},
+		},
+	}} {
+		if err := catalog.AddUpdate("", u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := omaha.NewServer("127.0.0.1:0", catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	return s
+}
+
+func TestRunDeltaFallback(t *testing.T) {
+	s := newDeltaServer(t)
+	defer s.Destroy()
+
+	url := "http://" + s.Addr().String()
+	ac, err := NewAppClient(url, "client-id", "app-id", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac.SetDeltaOK(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var deltas []bool
+	ac.OnUpdate(func(ac *AppClient, update *omaha.UpdateResponse) error {
+		act := update.PostinstallAction()
+		delta := act != nil && act.IsDeltaPayload
+		deltas = append(deltas, delta)
+		if delta {
+			return &omahaError{
+				Err:  errors.New("fake delta failure"),
+				Code: ExitCodeDownloadOperationExecutionError,
+			}
+		}
+		cancel()
+		return nil
+	})
+
+	ac.CheckNow()
+	if err := ac.Run(ctx); err != context.Canceled {
+		t.Fatalf("Run returned %v", err)
+	}
+
+	if len(deltas) != 2 || !deltas[0] || deltas[1] {
+		t.Fatalf("expected a delta then a full update, got %v", deltas)
+	}
+
+	if req := ac.NewAppRequest(); req.Apps[0].DeltaOK {
+		t.Error("delta_okay still set after failure")
+	}
+	ac.SetVersion("1.1.1")
+	if req := ac.NewAppRequest(); !req.Apps[0].DeltaOK {
+		t.Error("delta_okay not restored after version change")
+	}
+}
+
+func TestRunDeltaNoFallback(t *testing.T) {
+	s := newDeltaServer(t)
+	defer s.Destroy()
+	url := "http://" + s.Addr().String()
+
+	deferInstall := PolicyFunc(func(ac *AppClient, stage Stage, update *omaha.UpdateResponse) error {
+		if stage == StageInstall {
+			return DeferUpdate("outside of maintenance window")
+		}
+		return nil
+	})
+
+	for _, tt := range []struct {
+		name string
+		fail func(ac *AppClient, update *omaha.UpdateResponse) error
+	}{
+		{"deferred", func(ac *AppClient, update *omaha.UpdateResponse) error {
+			return ac.CheckPolicy(StageInstall, update)
+		}},
+		{"transfer", func(ac *AppClient, update *omaha.UpdateResponse) error {
+			return &omahaError{
+				Err:  errors.New("fake transfer failure"),
+				Code: ExitCodeDownloadTransferError,
+			}
+		}},
+		{"plain", func(ac *AppClient, update *omaha.UpdateResponse) error {
+			return errors.New("fake failure")
+		}},
+	} {
+		ac, err := NewAppClient(url, "client-id", "app-id", "1.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ac.SetDeltaOK(true)
+		ac.AddPolicy(deferInstall)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		checks := 0
+		ac.OnUpdate(func(ac *AppClient, update *omaha.UpdateResponse) error {
+			checks++
+			cancel()
+			return tt.fail(ac, update)
+		})
+
+		ac.CheckNow()
+		if err := ac.Run(ctx); err != context.Canceled {
+			t.Fatalf("%s: Run returned %v", tt.name, err)
+		}
+
+		if checks != 1 {
+			t.Errorf("%s: expected 1 update, got %d", tt.name, checks)
+		}
+		if req := ac.NewAppRequest(); !req.Apps[0].DeltaOK {
+			t.Errorf("%s: delta_okay cleared", tt.name)
+		}
+	}
+}
+
+func TestRunRollback(t *testing.T) {
+	catalog := omaha.NewCatalog()
+	if err := catalog.AddUpdate("", &omaha.Update{
+		ID:       "app-id",
+		Manifest: omaha.Manifest{Version: "1.0.0"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := omaha.NewServer("127.0.0.1:0", catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Destroy()
+	go s.Serve()
+
+	url := "http://" + s.Addr().String()
+	ac, err := NewAppClient(url, "client-id", "app-id", "1.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rollbacks []string
+	ac.OnUpdate(func(ac *AppClient, update *omaha.UpdateResponse) error {
+		if update.Rollback {
+			rollbacks = append(rollbacks, update.Manifest.Version)
+		}
+		return nil
+	})
+
+	// Without rollback_allowed the server offers nothing.
+	ac.checkAndUpdate(InstallSourceOnDemand)
+	if len(rollbacks) != 0 {
+		t.Fatalf("unexpected rollback: %v", rollbacks)
+	}
+
+	ac.SetRollbackAllowed(true)
+	ac.checkAndUpdate(InstallSourceOnDemand)
+	if len(rollbacks) != 1 || rollbacks[0] != "1.0.0" {
+		t.Fatalf("expected rollback to 1.0.0, got %v", rollbacks)
+	}
+
+	ac.SetTargetVersionPrefix("1.1")
+	ac.checkAndUpdate(InstallSourceOnDemand)
+	if len(rollbacks) != 1 {
+		t.Fatalf("rollback outside target prefix: %v", rollbacks)
+	}
+}
+
+func TestCheckTarget(t *testing.T) {
+	ac := &AppClient{}
+	info := &UpdateInfo{Version: "1.0.0", Rollback: true}
+	if err := ac.checkTarget(info); err == nil {
+		t.Error("unrequested rollback accepted")
+	} else if pe, ok := err.(*PolicyError); !ok || pe.Code != ExitCodeOmahaUpdateIgnoredPerPolicy {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	ac.rollbackAllowed = true
+	if err := ac.checkTarget(info); err != nil {
+		t.Error(err)
+	}
+
+	ac.targetVersionPrefix = "2"
+	if err := ac.checkTarget(info); err == nil {
+		t.Error("version outside target prefix accepted")
+	}
+}
+
+// TestRunHealth checks the server scores releases correctly from the
+// events this client sends.
+func TestRunHealth(t *testing.T) {
+	catalog := omaha.NewCatalog()
+	if err := catalog.AddUpdate("", &omaha.Update{
+		ID:       "app-id",
+		Manifest: omaha.Manifest{Version: "1.1.0"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	health := omaha.NewHealthAggregator()
+	health.Policy = &omaha.HealthPolicy{MinMachines: 3, MaxFailureRatio: 0.5}
+	health.OnHalt = omaha.HaltCatalog(catalog)
+	bus := omaha.NewEventBus()
+	bus.AddSink(health, 100)
+
+	s, err := omaha.NewServer("127.0.0.1:0", catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetEventBus(bus)
+	defer s.Destroy()
+	go s.Serve()
+	url := "http://" + s.Addr().String()
+
+	newClient := func(id, version string) *AppClient {
+		ac, err := NewAppClient(url, id, "app-id", version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ac
+	}
+	update := func(id string, h UpdateHandler) *AppClient {
+		ac := newClient(id, "1.0.0")
+		ctx, cancel := context.WithCancel(context.Background())
+		ac.OnUpdate(func(ac *AppClient, update *omaha.UpdateResponse) error {
+			cancel()
+			<-ac.Event(EventDownloading)
+			return h(ac, update)
+		})
+		ac.CheckNow()
+		if err := ac.Run(ctx); err != context.Canceled {
+			t.Fatalf("%s: Run returned %v", id, err)
+		}
+		return ac
+	}
+
+	update("good", func(ac *AppClient, update *omaha.UpdateResponse) error {
+		<-ac.Event(EventDownloaded)
+		<-ac.Event(EventInstalled)
+		return nil
+	})
+	// Reboot into the new version.
+	good := newClient("good", "1.1.0")
+	good.SetPreviousVersion("1.0.0")
+	for i := 0; i < 2; i++ {
+		if _, err := good.UpdateCheck(); err != omaha.NoUpdate {
+			t.Fatalf("good: expected no update, got %v", err)
+		}
+	}
+
+	fail := func(ac *AppClient, update *omaha.UpdateResponse) error {
+		return &omahaError{
+			Err:  errors.New("fake install failure"),
+			Code: ExitCodeNewRootfsVerificationError,
+		}
+	}
+	bad := update("bad1", fail)
+	// A routine check after failing must not count as a success.
+	bad.UpdateCheck()
+
+	deferred := newClient("deferred", "1.0.0")
+	deferred.AddPolicy(PolicyFunc(func(ac *AppClient, stage Stage, update *omaha.UpdateResponse) error {
+		return DeferUpdate("not now")
+	}))
+	deferred.checkAndUpdate(InstallSourceOnDemand)
+
+	update("bad2", fail)
+
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := health.Release("app-id", "1.1.0", "")
+	if stats == nil {
+		t.Fatalf("no release stats: %v", health.Releases(""))
+	}
+	if stats.Succeeded != 1 || stats.Failed != 2 || stats.ErrorCodes[int(ExitCodeNewRootfsVerificationError)] != 2 {
+		t.Errorf("unexpected outcomes %+v", stats)
+	}
+	if stats.Completed != 1 || !stats.Halted {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if r := health.Releases(""); len(r) != 1 {
+		t.Errorf("unexpected releases %+v", r)
+	}
+
+	track := catalog.App("app-id").Tracks[0]
+	if track.Paused || len(track.Halted) != 1 || track.Halted[0] != "1.1.0" {
+		t.Errorf("expected only 1.1.0 halted: %+v", track)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+// UpdateInfo describes an update, interpreting the update_engine
+// extensions carried by the manifest's "postinstall" action.
+type UpdateInfo struct {
+	// Version is the manifest version and DisplayVersion a human
+	// friendly name for it, the same as Version if not provided.
+	Version        string
+	DisplayVersion string
+
+	// Deadline after which the update should be installed regardless
+	// of policy or user preference. Zero if there is no deadline. The
+	// special deadline "now" is converted to the time it was parsed.
+	Deadline time.Time
+
+	// Prompt requests that the user be asked before applying the
+	// update, MoreInfo is a URL describing it.
+	Prompt   bool
+	MoreInfo string
+
+	// Payload SHA-256 hash, metadata signature and metadata size, nil
+	// or zero if not provided.
+	SHA256            []byte
+	MetadataSignature []byte
+	MetadataSize      uint64
+
+	// Rollback is set if the server marked the update as a rollback to
+	// an older version.
+	Rollback bool
+
+	Response *omaha.UpdateResponse
+}
+
+// NewUpdateInfo extracts the UpdateInfo from an update response. The
+// postinstall action, if any, is validated against the payload package.
+// Errors implement ErrorEvent.
+func NewUpdateInfo(update *omaha.UpdateResponse) (*UpdateInfo, error) {
+	if update == nil || update.Manifest == nil {
+		return nil, &omahaError{
+			Err:  errors.New("update manifest missing from response"),
+			Code: ExitCodeOmahaResponseInvalid,
+		}
+	}
+
+	info := &UpdateInfo{
+		Version:        update.Manifest.Version,
+		DisplayVersion: update.Manifest.Version,
+		Rollback:       update.Rollback,
+		Response:       update,
+	}
+
+	act := update.Manifest.PostinstallAction()
+	if act == nil {
+		return info, nil
+	}
+
+	if err := update.Manifest.ValidatePostinstall(); err != nil {
+		return nil, postinstallError(err)
+	}
+
+	// Errors are impossible after validation.
+	info.SHA256, _ = act.DecodeSHA256()
+	info.MetadataSignature, _ = act.DecodeMetadataSignature()
+	info.MetadataSize, _ = act.DecodeMetadataSize()
+
+	if act.DisplayVersion != "" {
+		info.DisplayVersion = act.DisplayVersion
+	}
+	info.Prompt = act.Prompt
+	info.MoreInfo = act.MoreInfo
+
+	deadline, err := parseDeadline(act.Deadline)
+	if err != nil {
+		return nil, &omahaError{
+			Err:  err,
+			Code: ExitCodeOmahaResponseInvalid,
+		}
+	}
+	info.Deadline = deadline
+
+	return info, nil
+}
+
+// postinstallError maps postinstall validation errors to exit codes.
+func postinstallError(err error) error {
+	code := ExitCodeOmahaResponseInvalid
+	if ae, ok := err.(*omaha.ActionError); ok {
+		switch {
+		case ae.Err == omaha.PackageHashMismatchError:
+			code = ExitCodePayloadHashMismatchError
+		case ae.Attr == "MetadataSignatureRsa", ae.Attr == omaha.PayloadSignatureAttr:
+			code = ExitCodeDownloadInvalidMetadataSignature
+		case ae.Attr == "MetadataSize":
+			code = ExitCodeDownloadInvalidMetadataSize
+		}
+	}
+	return &omahaError{Err: err, Code: code}
+}
+
+// parseDeadline accepts "now", Unix timestamps and RFC 3339 times.
+func parseDeadline(deadline string) (time.Time, error) {
+	switch deadline {
+	case "":
+		return time.Time{}, nil
+	case "now":
+		return time.Now(), nil
+	}
+
+	if secs, err := strconv.ParseInt(deadline, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, deadline)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid deadline %q", deadline)
+	}
+	return t, nil
+}
+
+// DeadlinePassed reports if the update has a deadline at or before now.
+func (ui *UpdateInfo) DeadlinePassed(now time.Time) bool {
+	return !ui.Deadline.IsZero() && !now.Before(ui.Deadline)
+}
+
+// PromptHandler is called by Run for updates that request the user be
+// prompted, after policy allows downloading them. The update is deferred
+// if it returns false, unless the deadline has passed and the client is
+// set to force updates after their deadline.
+type PromptHandler func(ac *AppClient, info *UpdateInfo) bool
+
+// OnPrompt sets the handler used for updates that request a prompt.
+// Without a handler such updates proceed without asking.
+func (c *Client) OnPrompt(h PromptHandler) {
+	c.prompt = h
+}
+
+// SetForceAfterDeadline makes updates past their deadline ignore policy
+// deferrals and prompts. Policies that ignore updates still apply.
+func (c *Client) SetForceAfterDeadline(force bool) {
+	c.forceAfterDeadline = force
+}
+
+// forced reports if the update is past its deadline and should be forced.
+func (ac *AppClient) forced(info *UpdateInfo) bool {
+	return ac.forceAfterDeadline && info.DeadlinePassed(time.Now())
+}
+
+// checkPrompt asks the prompt handler, if any, about the update.
+func (ac *AppClient) checkPrompt(info *UpdateInfo) error {
+	if !info.Prompt || ac.prompt == nil || ac.forced(info) {
+		return nil
+	}
+	if !ac.prompt(ac, info) {
+		return DeferUpdate("declined by user")
+	}
+	return nil
+}
+
+// checkTarget ignores updates the application did not ask for: rollbacks
+// when they are not allowed and versions outside the target prefix.
+func (ac *AppClient) checkTarget(info *UpdateInfo) error {
+	if info.Rollback && !ac.rollbackAllowed {
+		return IgnoreUpdate("rollback not allowed")
+	}
+	if !omaha.MatchVersionPrefix(info.Version, ac.targetVersionPrefix) {
+		return IgnoreUpdate(fmt.Sprintf("version %s does not match prefix %q",
+			info.Version, ac.targetVersionPrefix))
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+func updateWithAction(act *omaha.Action) *omaha.UpdateResponse {
+	u := &omaha.UpdateResponse{Status: omaha.UpdateOK}
+	m := u.AddManifest("1.1.1")
+	if act != nil {
+		act.Event = "postinstall"
+		m.Actions = append(m.Actions, act)
+	}
+	return u
+}
+
+func TestNewUpdateInfo(t *testing.T) {
+	info, err := NewUpdateInfo(updateWithAction(&omaha.Action{
+		DisplayVersion: "1.1.1 (Beta)",
+		Deadline:       "1500000000",
+		Prompt:         true,
+		MoreInfo:       "https://example.com/1.1.1",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Version != "1.1.1" || info.DisplayVersion != "1.1.1 (Beta)" {
+		t.Errorf("unexpected versions: %q %q", info.Version, info.DisplayVersion)
+	}
+	if !info.Deadline.Equal(time.Unix(1500000000, 0)) {
+		t.Errorf("unexpected deadline: %s", info.Deadline)
+	}
+	if !info.Prompt || info.MoreInfo != "https://example.com/1.1.1" {
+		t.Errorf("unexpected prompt info: %t %q", info.Prompt, info.MoreInfo)
+	}
+	if !info.DeadlinePassed(time.Unix(1500000000, 0)) {
+		t.Error("deadline has not passed")
+	}
+	if info.DeadlinePassed(time.Unix(1400000000, 0)) {
+		t.Error("deadline passed early")
+	}
+}
+
+func TestNewUpdateInfoDeadline(t *testing.T) {
+	for _, tt := range []struct {
+		deadline string
+		passed   bool
+	}{
+		{"", false},
+		{"now", true},
+		{"2017-01-02T03:04:05Z", true},
+		{"2999-01-02T03:04:05Z", false},
+	} {
+		info, err := NewUpdateInfo(updateWithAction(&omaha.Action{
+			Deadline: tt.deadline,
+		}))
+		if err != nil {
+			t.Errorf("%q: %v", tt.deadline, err)
+			continue
+		}
+		if passed := info.DeadlinePassed(time.Now()); passed != tt.passed {
+			t.Errorf("%q passed = %t", tt.deadline, passed)
+		}
+	}
+
+	_, err := NewUpdateInfo(updateWithAction(&omaha.Action{
+		Deadline: "tomorrow",
+	}))
+	if ee, ok := err.(ErrorEvent); !ok ||
+		ee.ErrorEvent().ErrorCode != int(ExitCodeOmahaResponseInvalid) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestForceAfterDeadline(t *testing.T) {
+	c, err := New("http://localhost", "client-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac, _ := c.NewAppClient("app-id", "1.0.0")
+	ac.AddPolicy(&MeteredPolicy{IsMetered: func() bool { return true }})
+
+	update := updateWithAction(&omaha.Action{Deadline: "now"})
+	if err := ac.CheckPolicy(StageDownload, update); err == nil {
+		t.Fatal("download was not deferred")
+	}
+
+	ac.SetForceAfterDeadline(true)
+	if err := ac.CheckPolicy(StageDownload, update); err != nil {
+		t.Fatalf("download deferred after deadline: %v", err)
+	}
+
+	update = updateWithAction(nil)
+	if err := ac.CheckPolicy(StageDownload, update); err == nil {
+		t.Fatal("download without a deadline was not deferred")
+	}
+}
+
+func TestRunPrompt(t *testing.T) {
+	r, s := newRecordingServer(t, &omaha.Update{
+		Manifest: omaha.Manifest{
+			Version: "1.1.1",
+			Actions: []*omaha.Action{{
+				Event:    "postinstall",
+				Prompt:   true,
+				MoreInfo: "https://example.com/1.1.1",
+			}},
+		},
+	})
+	defer s.Destroy()
+
+	url := "http://" + s.Addr().String()
+	ac, err := NewAppClient(url, "client-id", "app-id", "0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var moreInfo string
+	ac.OnPrompt(func(ac *AppClient, info *UpdateInfo) bool {
+		moreInfo = info.MoreInfo
+		cancel()
+		return false
+	})
+	ac.OnUpdate(func(ac *AppClient, update *omaha.UpdateResponse) error {
+		t.Error("update handler called")
+		return nil
+	})
+
+	ac.CheckNow()
+	if err := ac.Run(ctx); err != context.Canceled {
+		t.Fatalf("Run returned %v", err)
+	}
+
+	if moreInfo != "https://example.com/1.1.1" {
+		t.Errorf("unexpected more info: %q", moreInfo)
+	}
+
+	if len(r.events) != 2 ||
+		r.events[1].ErrorCode != int(ExitCodeOmahaUpdateDeferredPerPolicy) {
+		t.Fatalf("unexpected events: %#v", r.events)
+	}
+}
+
+func TestNewUpdateInfoInvalid(t *testing.T) {
+	pkg := &omaha.Package{
+		Name:   "update.gz",
+		SHA256: "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+		Size:   100,
+	}
+
+	for _, tt := range []struct {
+		act  *omaha.Action
+		code ExitCode
+	}{
+		{&omaha.Action{SHA256: "bogus"}, ExitCodeOmahaResponseInvalid},
+		{&omaha.Action{SHA256: "EqYfThc/s6EcBdZHH3Ryj3YjG0pfzZZnzvOvh6OuTcI="}, ExitCodePayloadHashMismatchError},
+		{&omaha.Action{MetadataSignatureRsa: "!!"}, ExitCodeDownloadInvalidMetadataSignature},
+		{&omaha.Action{MetadataSize: "-1"}, ExitCodeDownloadInvalidMetadataSize},
+		{&omaha.Action{MetadataSize: "101"}, ExitCodeDownloadInvalidMetadataSize},
+	} {
+		update := updateWithAction(tt.act)
+		update.Manifest.Packages = append(update.Manifest.Packages, pkg)
+
+		_, err := NewUpdateInfo(update)
+		ee, ok := err.(ErrorEvent)
+		if !ok {
+			t.Errorf("%#v: unexpected error: %v", tt.act, err)
+			continue
+		}
+		if code := ExitCode(ee.ErrorEvent().ErrorCode); code != tt.code {
+			t.Errorf("%#v: got %s, not %s", tt.act, code, tt.code)
+		}
+	}
+}
@@ -155,6 +155,7 @@ const (
 
 	// Extra error values
 	AppInvalidVersion AppStatus = "error-invalidVersion"
+	AppInvalidRequest AppStatus = "error-invalidRequest"
 	AppInternalError  AppStatus = "error-internal"
 )
 
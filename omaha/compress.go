@@ -0,0 +1,150 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MaxDocumentSize is the largest request or response accepted. It
+// applies after decompression so small compressed bodies cannot expand
+// into huge documents.
+const MaxDocumentSize = 1024 * 1024
+
+// AcceptEncoding lists the content encodings supported, for use in an
+// Accept-Encoding header.
+const AcceptEncoding = "gzip, deflate"
+
+var UnsupportedEncodingError = errors.New("omaha: unsupported content encoding")
+
+// DecodeBody returns a reader of body decompressed according to the
+// given Content-Encoding header. Closing it closes body.
+func DecodeBody(encoding string, body io.ReadCloser) (io.ReadCloser, error) {
+	var r io.ReadCloser
+	var err error
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(body)
+	case "deflate":
+		r, err = zlib.NewReader(body)
+	default:
+		return nil, UnsupportedEncodingError
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, body}, nil
+}
+
+// EncodeBody compresses body with the given encoding, gzip or deflate.
+func EncodeBody(encoding string, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := newEncoder(encoding, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func newEncoder(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "deflate":
+		return zlib.NewWriter(w), nil
+	default:
+		return nil, UnsupportedEncodingError
+	}
+}
+
+// NegotiateEncoding picks the encoding to use for a response given the
+// request's Accept-Encoding header, preferring gzip. A blank result
+// means the response should not be compressed.
+func NegotiateEncoding(accept string) string {
+	q := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name == "" {
+			continue
+		}
+		value := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					value = v
+				}
+			}
+		}
+		q[name] = value
+	}
+
+	for _, enc := range []string{"gzip", "deflate"} {
+		if v, ok := q[enc]; ok {
+			if v > 0 {
+				return enc
+			}
+		} else if v, ok := q["*"]; ok && v > 0 {
+			return enc
+		}
+	}
+	return ""
+}
+
+// compressWriter compresses everything written to a response.
+type compressWriter struct {
+	http.ResponseWriter
+	w io.WriteCloser
+}
+
+func newCompressWriter(w http.ResponseWriter, encoding string) *compressWriter {
+	enc, _ := newEncoder(encoding, w)
+	w.Header().Set("Content-Encoding", encoding)
+	w.Header().Add("Vary", "Accept-Encoding")
+	return &compressWriter{ResponseWriter: w, w: enc}
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	cw.Header().Del("Content-Length")
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	return cw.w.Write(b)
+}
+
+func (cw *compressWriter) Close() error {
+	return cw.w.Close()
+}
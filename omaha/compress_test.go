@@ -0,0 +1,145 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEncodeBody(t *testing.T) {
+	data := []byte(strings.Repeat("omaha ", 100))
+	for _, enc := range []string{"gzip", "deflate"} {
+		compressed, err := EncodeBody(enc, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(compressed) >= len(data) {
+			t.Errorf("%s: not compressed", enc)
+		}
+
+		r, err := DecodeBody(enc, ioutil.NopCloser(bytes.NewReader(compressed)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(out, data) {
+			t.Errorf("%s: round trip failed: %v", enc, err)
+		}
+	}
+
+	if _, err := EncodeBody("br", data); err != UnsupportedEncodingError {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := DecodeBody("br", ioutil.NopCloser(bytes.NewReader(data))); err != UnsupportedEncodingError {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := DecodeBody("gzip", ioutil.NopCloser(bytes.NewReader(data))); err == nil {
+		t.Error("invalid gzip accepted")
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, tt := range []struct {
+		accept string
+		expect string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"deflate, gzip", "gzip"},
+		{"GZIP;q=0.5", "gzip"},
+		{"gzip;q=0, deflate", "deflate"},
+		{"br, *", "gzip"},
+		{"*;q=0", ""},
+		{"gzip;q=0, *", "deflate"},
+	} {
+		if got := NegotiateEncoding(tt.accept); got != tt.expect {
+			t.Errorf("%q: expected %q, got %q", tt.accept, tt.expect, got)
+		}
+	}
+}
+
+func TestHandleCompression(t *testing.T) {
+	handler := &OmahaHandler{Updater: UpdaterStub{}}
+	body, err := xml.Marshal(nilRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := EncodeBody("gzip", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/v1/update/", bytes.NewReader(gz))
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept-Encoding", "deflate")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	if enc := w.Header().Get("Content-Encoding"); enc != "deflate" {
+		t.Fatalf("unexpected encoding %q", enc)
+	}
+
+	r, err := DecodeBody("deflate", ioutil.NopCloser(w.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ParseResponse(w.Header().Get("Content-Type"), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := compareXML(nilResponse, resp); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleCompressionErrors(t *testing.T) {
+	handler := &OmahaHandler{Updater: UpdaterStub{}}
+
+	// Expands well past the limit.
+	bomb := []byte(`<request protocol="3.0"><!--` +
+		strings.Repeat(" ", 2*MaxDocumentSize) + `--></request>`)
+	gz, err := EncodeBody("gzip", bomb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		encoding string
+		body     []byte
+		code     int
+	}{
+		{"gzip", gz, http.StatusBadRequest},
+		{"gzip", []byte("not gzip"), http.StatusBadRequest},
+		{"br", []byte("whatever"), http.StatusUnsupportedMediaType},
+	} {
+		req := httptest.NewRequest("POST", "/v1/update/", bytes.NewReader(tt.body))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: expected %d, got %d", tt.encoding, tt.code, w.Code)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventRecord is an event reported by a client, along with who sent it.
+// ErrorCode is the update_engine exit code, see client.ExitCode.
+type EventRecord struct {
+	Time            time.Time   `json:"time"`
+	AppID           string      `json:"app_id"`
+	MachineID       string      `json:"machine_id,omitempty"`
+	Version         string      `json:"version"`
+	Track           string      `json:"track,omitempty"`
+	Type            EventType   `json:"type"`
+	Result          EventResult `json:"result"`
+	ErrorCode       int         `json:"error_code,omitempty"`
+	PreviousVersion string      `json:"previous_version,omitempty"`
+	NextVersion     string      `json:"next_version,omitempty"`
+}
+
+func NewEventRecord(req *Request, app *AppRequest, event *EventRequest) *EventRecord {
+	return &EventRecord{
+		Time:            time.Now(),
+		AppID:           app.ID,
+		MachineID:       machineID(req, app),
+		Version:         app.Version,
+		Track:           app.Track,
+		Type:            event.Type,
+		Result:          event.Result,
+		ErrorCode:       event.ErrorCode,
+		PreviousVersion: event.PreviousVersion,
+		NextVersion:     event.NextVersion,
+	}
+}
+
+// Failed reports if the event is an error.
+func (r *EventRecord) Failed() bool {
+	return r.Result == EventResultError ||
+		r.Result == EventResultErrorInstallerMSI ||
+		r.Result == EventResultErrorInstallerOther ||
+		r.Result == EventResultHandoffError
+}
+
+// EventBus fans out client events to any number of subscribers. Publish
+// never blocks: a subscriber that falls behind misses events instead of
+// holding up responses to clients.
+type EventBus struct {
+	mu    sync.RWMutex
+	subs  map[*Subscription]bool
+	sinks sync.WaitGroup
+	errMu sync.Mutex
+	err   error
+}
+
+// Subscription receives published events on C until it is closed.
+type Subscription struct {
+	C <-chan *EventRecord
+
+	c       chan *EventRecord
+	bus     *EventBus
+	dropped uint64
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[*Subscription]bool)}
+}
+
+// Publish sends an event to every subscriber with room for it.
+func (b *EventBus) Publish(rec *EventRecord) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for sub := range b.subs {
+		select {
+		case sub.c <- rec:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// Subscribe returns a new subscription buffering up to size events.
+func (b *EventBus) Subscribe(size int) *Subscription {
+	c := make(chan *EventRecord, size)
+	sub := &Subscription{C: c, c: c, bus: b}
+
+	b.mu.Lock()
+	b.subs[sub] = true
+	b.mu.Unlock()
+
+	return sub
+}
+
+// Close stops the subscription, closing C once buffered events are read.
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	if s.bus.subs[s] {
+		delete(s.bus.subs, s)
+		close(s.c)
+	}
+}
+
+// Dropped returns the number of events missed because C was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// EventSink is a destination for events, see AddSink.
+type EventSink interface {
+	WriteEvent(rec *EventRecord) error
+	Close() error
+}
+
+// AddSink subscribes a sink to the bus, writing events to it from its
+// own goroutine. Write errors are logged and the event discarded.
+func (b *EventBus) AddSink(sink EventSink, size int) {
+	sub := b.Subscribe(size)
+
+	b.sinks.Add(1)
+	go func() {
+		defer b.sinks.Done()
+		for rec := range sub.C {
+			if err := sink.WriteEvent(rec); err != nil {
+				log.Printf("omaha: Failed writing event: %v", err)
+			}
+		}
+		if err := sink.Close(); err != nil {
+			b.errMu.Lock()
+			if b.err == nil {
+				b.err = err
+			}
+			b.errMu.Unlock()
+		}
+	}()
+}
+
+// Close ends all subscriptions and waits for sinks to finish writing,
+// returning the first error from closing a sink.
+func (b *EventBus) Close() error {
+	b.mu.Lock()
+	for sub := range b.subs {
+		delete(b.subs, sub)
+		close(sub.c)
+	}
+	b.mu.Unlock()
+
+	b.sinks.Wait()
+
+	b.errMu.Lock()
+	defer b.errMu.Unlock()
+	return b.err
+}
@@ -0,0 +1,314 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func mkEventRecord(result EventResult) *EventRecord {
+	return &EventRecord{
+		AppID:   testAppID,
+		Version: testAppVer,
+		Type:    EventTypeUpdateComplete,
+		Result:  result,
+	}
+}
+
+func TestEventBusSubscribe(t *testing.T) {
+	bus := NewEventBus()
+	a := bus.Subscribe(1)
+	b := bus.Subscribe(2)
+
+	for i := 0; i < 2; i++ {
+		bus.Publish(mkEventRecord(EventResultSuccess))
+	}
+
+	if a.Dropped() != 1 || b.Dropped() != 0 {
+		t.Errorf("unexpected drops %d %d", a.Dropped(), b.Dropped())
+	}
+	if len(a.C) != 1 || len(b.C) != 2 {
+		t.Errorf("unexpected buffered events %d %d", len(a.C), len(b.C))
+	}
+
+	a.Close()
+	a.Close()
+	bus.Publish(mkEventRecord(EventResultSuccess))
+	if _, ok := <-a.C; !ok {
+		t.Error("buffered event lost on close")
+	}
+	if _, ok := <-a.C; ok {
+		t.Error("closed subscription received an event")
+	}
+
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for range b.C {
+		n++
+	}
+	if n != 2 {
+		t.Errorf("expected 2 events, got %d", n)
+	}
+}
+
+func TestHandleEvents(t *testing.T) {
+	bus := NewEventBus()
+	sub := bus.Subscribe(10)
+	handler := OmahaHandler{Updater: UpdaterStub{}, Events: bus}
+
+	req := NewRequest()
+	req.UserID = "machine"
+	app := req.AddApp(testAppID, testAppVer)
+	app.Track = "stable"
+	event := app.AddEvent()
+	event.Type = EventTypeUpdateComplete
+	event.Result = EventResultError
+	event.ErrorCode = 15
+
+	handler.serveApp(NewResponse(), nil, req, app)
+
+	select {
+	case rec := <-sub.C:
+		if rec.AppID != testAppID || rec.MachineID != "machine" ||
+			rec.Track != "stable" || rec.ErrorCode != 15 || !rec.Failed() {
+			t.Errorf("unexpected record %#v", rec)
+		}
+	default:
+		t.Error("no event published")
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-omaha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.json")
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bus := NewEventBus()
+	bus.AddSink(sink, 10)
+	bus.Publish(mkEventRecord(EventResultSuccess))
+	bus.Publish(mkEventRecord(EventResultError))
+	if err := bus.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var results []EventResult
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec EventRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, rec.Result)
+	}
+	if len(results) != 2 || results[0] != EventResultSuccess || results[1] != EventResultError {
+		t.Errorf("unexpected events %v", results)
+	}
+}
+
+type testWebhook struct {
+	mu      sync.Mutex
+	fail    int
+	batches [][]*EventRecord
+}
+
+func (th *testWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+
+	if th.fail > 0 {
+		th.fail--
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+
+	var batch []*EventRecord
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	th.batches = append(th.batches, batch)
+}
+
+func (th *testWebhook) sizes() []int {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+
+	var sizes []int
+	for _, b := range th.batches {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+func TestWebhookSinkBatch(t *testing.T) {
+	hook := &testWebhook{fail: 2}
+	s := httptest.NewServer(hook)
+	defer s.Close()
+
+	sink := NewWebhookSink(s.URL)
+	sink.BatchSize = 2
+	sink.FlushInterval = 0
+	sink.RetryDelay = time.Millisecond
+
+	for i := 0; i < 3; i++ {
+		if err := sink.WriteEvent(mkEventRecord(EventResultSuccess)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if sizes := hook.sizes(); len(sizes) != 2 || sizes[0] != 2 || sizes[1] != 1 {
+		t.Errorf("unexpected batches %v", sizes)
+	}
+}
+
+func TestWebhookSinkInterval(t *testing.T) {
+	hook := &testWebhook{}
+	s := httptest.NewServer(hook)
+	defer s.Close()
+
+	sink := NewWebhookSink(s.URL)
+	sink.FlushInterval = 10 * time.Millisecond
+
+	if err := sink.WriteEvent(mkEventRecord(EventResultSuccess)); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(hook.sizes()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if sizes := hook.sizes(); len(sizes) != 1 || sizes[0] != 1 {
+		t.Errorf("unexpected batches %v", sizes)
+	}
+}
+
+func TestWebhookSinkGiveUp(t *testing.T) {
+	hook := &testWebhook{fail: 10}
+	s := httptest.NewServer(hook)
+	defer s.Close()
+
+	sink := NewWebhookSink(s.URL)
+	sink.BatchSize = 1
+	sink.MaxRetries = 2
+	sink.RetryDelay = time.Millisecond
+
+	if err := sink.WriteEvent(mkEventRecord(EventResultSuccess)); err == nil {
+		t.Error("expected an error")
+	}
+	if hook.fail != 7 {
+		t.Errorf("expected 3 attempts, got %d", 10-hook.fail)
+	}
+}
+
+func TestWebhookSinkTimeout(t *testing.T) {
+	release := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer s.Close()
+	defer close(release)
+
+	sink := NewWebhookSink(s.URL)
+	sink.FlushInterval = 0
+	sink.RetryDelay = time.Millisecond
+	sink.SendTimeout = 50 * time.Millisecond
+
+	if err := sink.WriteEvent(mkEventRecord(EventResultSuccess)); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan error)
+	go func() { closed <- sink.Close() }()
+
+	select {
+	case err := <-closed:
+		if err == nil {
+			t.Error("expected an error from the hung endpoint")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close hung on the endpoint")
+	}
+}
+
+func TestWebhookSinkClose(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	hook := &testWebhook{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		hook.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	sink := NewWebhookSink(s.URL)
+	sink.FlushInterval = 0
+
+	if err := sink.WriteEvent(mkEventRecord(EventResultSuccess)); err != nil {
+		t.Fatal(err)
+	}
+	go sink.Flush()
+	<-started
+
+	closed := make(chan error)
+	go func() { closed <- sink.Close() }()
+
+	select {
+	case err := <-closed:
+		close(release)
+		t.Fatalf("closed during a send: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	if sizes := hook.sizes(); len(sizes) != 1 || sizes[0] != 1 {
+		t.Errorf("unexpected batches %v", sizes)
+	}
+
+	if err := sink.WriteEvent(mkEventRecord(EventResultSuccess)); err == nil {
+		t.Error("closed sink accepted an event")
+	}
+}
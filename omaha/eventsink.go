@@ -0,0 +1,217 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileSink appends events to a file as newline delimited JSON.
+type FileSink struct {
+	f   *os.File
+	enc *json.Encoder
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSink{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (fs *FileSink) WriteEvent(rec *EventRecord) error {
+	return fs.enc.Encode(rec)
+}
+
+func (fs *FileSink) Close() error {
+	return fs.f.Close()
+}
+
+// WebhookSink POSTs batches of events to a URL as a JSON array. A batch
+// is sent once it is full or the oldest event in it has waited for
+// FlushInterval. Failed requests are retried with exponential backoff;
+// a batch that still fails is logged and dropped. Batches are sent one
+// at a time in the order their events were written.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxRetries    int
+	RetryDelay    time.Duration
+
+	// SendTimeout bounds sending a batch, including retries, so a hung
+	// endpoint can not hold up later batches or Close. Zero is no limit.
+	SendTimeout time.Duration
+
+	// sendMu is held while taking and sending a batch so batches can
+	// not overtake each other, mu guards the batch being filled.
+	sendMu sync.Mutex
+	mu     sync.Mutex
+	batch  []*EventRecord
+	timer  *time.Timer
+	closed bool
+}
+
+var errWebhookClosed = errors.New("omaha: webhook sink is closed")
+
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{
+		URL:           url,
+		Client:        &http.Client{Timeout: 30 * time.Second},
+		BatchSize:     100,
+		FlushInterval: 5 * time.Second,
+		MaxRetries:    5,
+		RetryDelay:    time.Second,
+		SendTimeout:   time.Minute,
+	}
+}
+
+func (ws *WebhookSink) WriteEvent(rec *EventRecord) error {
+	ws.mu.Lock()
+	if ws.closed {
+		ws.mu.Unlock()
+		return errWebhookClosed
+	}
+	ws.batch = append(ws.batch, rec)
+	if len(ws.batch) == 1 && ws.FlushInterval > 0 {
+		ws.timer = time.AfterFunc(ws.FlushInterval, ws.flushLogged)
+	}
+	full := len(ws.batch) >= ws.BatchSize
+	ws.mu.Unlock()
+
+	if full {
+		return ws.Flush()
+	}
+	return nil
+}
+
+// Flush sends any pending events now, after any batch already being
+// sent.
+func (ws *WebhookSink) Flush() error {
+	// Taking the batch under sendMu keeps batches in order.
+	ws.sendMu.Lock()
+	defer ws.sendMu.Unlock()
+
+	ws.mu.Lock()
+	batch := ws.batch
+	ws.batch = nil
+	ws.stopTimer()
+	ws.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+	return ws.send(batch)
+}
+
+// stopTimer cancels any pending flush. mu must be held.
+func (ws *WebhookSink) stopTimer() {
+	if ws.timer != nil {
+		ws.timer.Stop()
+		ws.timer = nil
+	}
+}
+
+func (ws *WebhookSink) flushLogged() {
+	if err := ws.Flush(); err != nil {
+		log.Printf("omaha: Failed sending events: %v", err)
+	}
+}
+
+// Close stops accepting events and sends any pending ones, waiting for
+// a batch already being sent.
+func (ws *WebhookSink) Close() error {
+	ws.mu.Lock()
+	ws.closed = true
+	ws.stopTimer()
+	ws.mu.Unlock()
+
+	return ws.Flush()
+}
+
+func (ws *WebhookSink) send(batch []*EventRecord) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if ws.SendTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ws.SendTimeout)
+		defer cancel()
+	}
+
+	delay := ws.RetryDelay
+tries:
+	for try := 0; ; try++ {
+		var retry bool
+		retry, err = ws.post(ctx, body)
+		if err == nil || !retry || try >= ws.MaxRetries {
+			break
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			break tries
+		}
+		delay *= 2
+	}
+
+	if err != nil {
+		return fmt.Errorf("omaha: webhook dropped %d events: %v", len(batch), err)
+	}
+	return nil
+}
+
+// post sends one request, reporting if a failure may be retried.
+func (ws *WebhookSink) post(ctx context.Context, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", ws.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ws.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook returned %s", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+}
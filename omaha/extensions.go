@@ -0,0 +1,71 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"encoding/xml"
+)
+
+// Extensions holds the attributes and child elements of a document
+// element that this package does not otherwise understand, such as
+// vendor extensions. They are preserved when the document is encoded
+// again so proxies do not silently drop data.
+type Extensions struct {
+	ExtraAttrs    []xml.Attr `xml:",any,attr" json:",omitempty"`
+	ExtraElements []*Element `xml:",any" json:",omitempty"`
+}
+
+// Element is an unknown XML element, kept verbatim.
+type Element struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr" json:",omitempty"`
+	Content string     `xml:",innerxml" json:",omitempty"`
+}
+
+// Attr returns the value of an unknown attribute and whether it is set.
+// Attributes this package does understand are never included, use the
+// corresponding struct field instead.
+func (e *Extensions) Attr(name string) (string, bool) {
+	for _, a := range e.ExtraAttrs {
+		if a.Name.Local == name {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// SetAttr sets an extra attribute, replacing any existing value.
+func (e *Extensions) SetAttr(name, value string) {
+	for i, a := range e.ExtraAttrs {
+		if a.Name.Local == name {
+			e.ExtraAttrs[i].Value = value
+			return
+		}
+	}
+	e.ExtraAttrs = append(e.ExtraAttrs, xml.Attr{
+		Name:  xml.Name{Local: name},
+		Value: value,
+	})
+}
+
+// Element returns the first unknown child element with the given name.
+func (e *Extensions) Element(name string) *Element {
+	for _, el := range e.ExtraElements {
+		if el.XMLName.Local == name {
+			return el
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"encoding/xml"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExtensionsRequest(t *testing.T) {
+	f, err := os.Open("../fixtures/update-engine/update/request.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	req, err := ParseRequest("", f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := req.Apps[0]
+	if v, ok := app.Attr("hardware_class"); !ok || v != "" {
+		t.Errorf("hardware_class not preserved: %q %t", v, ok)
+	}
+	if v, ok := app.Attr("lang"); ok {
+		t.Errorf("known attribute lang reported as unknown: %q", v)
+	}
+
+	out, err := xml.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), `hardware_class=""`) {
+		t.Errorf("hardware_class not encoded: %s", out)
+	}
+}
+
+func TestExtensionsResponse(t *testing.T) {
+	f, err := os.Open("../fixtures/update-engine/update/response.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	resp, err := ParseResponse("", f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	act := resp.Apps[0].UpdateCheck.PostinstallAction()
+	if v, _ := act.Attr("ChromeOSVersion"); v != "9999.0.0" {
+		t.Errorf("unexpected ChromeOSVersion %q", v)
+	}
+	if v, _ := act.Attr("IsDelta"); v != "True" {
+		t.Errorf("unexpected IsDelta %q", v)
+	}
+
+	// Encoding and parsing again must not lose anything.
+	out, err := xml.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := ParseResponse("", strings.NewReader(string(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := compareXML(resp, again); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExtensionsElements(t *testing.T) {
+	doc := `<request protocol="3.0">
+<app appid="{87efface-864d-49a5-9bb3-4b050a7c227a}" version="1.0.0">
+<data name="install" index="verboselogging"><![CDATA[x]]></data>
+</app>
+</request>`
+
+	req, err := ParseRequest("", strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := req.Apps[0].Element("data")
+	if data == nil {
+		t.Fatal("data element not preserved")
+	}
+	if len(data.Attrs) != 2 || data.Content != "<![CDATA[x]]>" {
+		t.Errorf("unexpected data element: %#v", data)
+	}
+
+	app := req.Apps[0]
+	app.SetAttr("cohort", "1:2:")
+	app.SetAttr("cohort", "1:3:")
+	if v, _ := app.Attr("cohort"); v != "1:3:" || len(app.ExtraAttrs) != 1 {
+		t.Errorf("unexpected attributes: %#v", app.ExtraAttrs)
+	}
+
+	out, err := xml.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`cohort="1:3:"`, `<data name="install" index="verboselogging"><![CDATA[x]]></data>`} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("%s missing from %s", want, out)
+		}
+	}
+}
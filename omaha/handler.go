@@ -15,24 +15,126 @@
 package omaha
 
 import (
+	"bytes"
 	"encoding/xml"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type OmahaHandler struct {
 	Updater
+
+	// Recorder, if not nil, records every request and response.
+	Recorder *Recorder
+
+	// Strictness of request validation. Apps failing validation are
+	// answered with an error status and never reach the Updater.
+	Strictness Strictness
+
+	// Events, if not nil, has every event reported by clients
+	// published to it after the Updater has seen it.
+	Events *EventBus
+
+	// Auth, if not nil, is required to accept a request's credentials.
+	// Apps the credentials do not cover are answered with
+	// AppRestricted and never reach the Updater.
+	Auth Authenticator
+
+	// Limiter, if not nil, rejects requests over its limits before
+	// they reach the Updater.
+	Limiter *Limiter
 }
 
 func (o *OmahaHandler) ServeHTTP(w http.ResponseWriter, httpReq *http.Request) {
+	// Compression is handled first so the rest only sees plain XML.
+	body, err := DecodeBody(httpReq.Header.Get("Content-Encoding"), httpReq.Body)
+	if err == UnsupportedEncodingError {
+		http.Error(w, "Unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+		return
+	} else if err != nil {
+		log.Printf("omaha: Failed decompressing request: %v", err)
+		http.Error(w, "Bad Omaha Request", http.StatusBadRequest)
+		return
+	}
+	httpReq.Body = body
+
+	if enc := NegotiateEncoding(httpReq.Header.Get("Accept-Encoding")); enc != "" {
+		cw := newCompressWriter(w, enc)
+		defer func() {
+			if err := cw.Close(); err != nil && !isClosed(err) {
+				log.Printf("omaha: Failed compressing response: %v", err)
+			}
+		}()
+		w = cw
+	}
+
+	if o.Recorder != nil {
+		o.serveRecorded(w, httpReq)
+		return
+	}
+	o.serveHTTP(w, httpReq)
+}
+
+// serveRecorded captures the raw request and response for the Recorder.
+func (o *OmahaHandler) serveRecorded(w http.ResponseWriter, httpReq *http.Request) {
+	var reqBody bytes.Buffer
+	httpReq.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(httpReq.Body, &reqBody), httpReq.Body}
+
+	rw := &recordingWriter{ResponseWriter: w}
+	o.serveHTTP(rw, httpReq)
+
+	err := o.Recorder.Record(&Record{
+		URL:      httpReq.URL.String(),
+		Status:   rw.status,
+		Request:  reqBody.String(),
+		Response: rw.body.String(),
+	})
+	if err != nil {
+		log.Printf("omaha: Failed recording request: %v", err)
+	}
+}
+
+func (o *OmahaHandler) serveHTTP(w http.ResponseWriter, httpReq *http.Request) {
 	if httpReq.Method != "POST" {
 		log.Printf("omaha: Unexpected HTTP method: %s", httpReq.Method)
 		http.Error(w, "Expected a POST", http.StatusBadRequest)
 		return
 	}
 
+	host, _, err := net.SplitHostPort(httpReq.RemoteAddr)
+	if err != nil {
+		host = httpReq.RemoteAddr
+	}
+
+	if o.Limiter != nil {
+		if ok, wait := o.Limiter.allowIP(host); !ok {
+			tooManyRequests(w, wait)
+			return
+		}
+	}
+
 	// A request over 1M in size is certainly bogus.
-	reader := http.MaxBytesReader(w, httpReq.Body, 1024*1024)
+	var reader io.Reader = http.MaxBytesReader(w, httpReq.Body, MaxDocumentSize)
+
+	// Credentials may cover the raw body so keep a copy.
+	var body []byte
+	if o.Auth != nil {
+		if body, err = ioutil.ReadAll(reader); err != nil {
+			log.Printf("omaha: Failed reading request: %v", err)
+			http.Error(w, "Bad Omaha Request", http.StatusBadRequest)
+			return
+		}
+		reader = bytes.NewReader(body)
+	}
+
 	contentType := httpReq.Header.Get("Content-Type")
 	omahaReq, err := ParseRequest(contentType, reader)
 	if err != nil {
@@ -41,6 +143,26 @@ func (o *OmahaHandler) ServeHTTP(w http.ResponseWriter, httpReq *http.Request) {
 		return
 	}
 
+	if o.Auth != nil {
+		omahaReq.Identity, err = o.Auth.Authenticate(httpReq, body)
+		if err != nil {
+			log.Printf("omaha: Unauthenticated request from %s: %v", httpReq.RemoteAddr, err)
+		}
+	}
+
+	omahaReq.RemoteAddr = host
+
+	if o.Limiter != nil {
+		if ok, oversized, wait := o.Limiter.allowRequest(omahaReq, o.Auth != nil); oversized {
+			log.Printf("omaha: Oversized request from %s", httpReq.RemoteAddr)
+			http.Error(w, "Too Many Apps Or Events", http.StatusRequestEntityTooLarge)
+			return
+		} else if !ok {
+			tooManyRequests(w, wait)
+			return
+		}
+	}
+
 	httpStatus := 0
 	omahaResp := NewResponse()
 	for _, appReq := range omahaReq.Apps {
@@ -52,6 +174,8 @@ func (o *OmahaHandler) ServeHTTP(w http.ResponseWriter, httpReq *http.Request) {
 			// If no app is ok HTTP will use the first error.
 			if appResp.Status == AppInternalError {
 				httpStatus = http.StatusInternalServerError
+			} else if appResp.Status == AppRestricted {
+				httpStatus = http.StatusForbidden
 			} else {
 				httpStatus = http.StatusBadRequest
 			}
@@ -78,6 +202,15 @@ func (o *OmahaHandler) ServeHTTP(w http.ResponseWriter, httpReq *http.Request) {
 }
 
 func (o *OmahaHandler) serveApp(omahaResp *Response, httpReq *http.Request, omahaReq *Request, appReq *AppRequest) *AppResponse {
+	if err := omahaReq.ValidateApp(appReq, o.Strictness); err != nil {
+		log.Printf("omaha: %v", err)
+		return omahaResp.AddApp(appReq.ID, err.(*ValidationError).Status)
+	}
+
+	if o.Auth != nil && !omahaReq.Identity.Allows(omahaReq, appReq) {
+		return omahaResp.AddApp(appReq.ID, AppRestricted)
+	}
+
 	if err := o.CheckApp(omahaReq, appReq); err != nil {
 		if appStatus, ok := err.(AppStatus); ok {
 			return omahaResp.AddApp(appReq.ID, appStatus)
@@ -98,6 +231,9 @@ func (o *OmahaHandler) serveApp(omahaResp *Response, httpReq *http.Request, omah
 
 	for _, event := range appReq.Events {
 		o.Event(omahaReq, appReq, event)
+		if o.Events != nil {
+			o.Events.Publish(NewEventRecord(omahaReq, appReq, event))
+		}
 		appResp.AddEvent()
 	}
 
@@ -121,7 +257,17 @@ func (o *OmahaHandler) checkUpdate(appResp *AppResponse, httpReq *http.Request,
 	}
 }
 
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	secs := int64((wait + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+}
+
 func fillUpdate(u *UpdateResponse, update *Update, httpReq *http.Request) {
 	u.URLs = update.URLs([]string{"http://" + httpReq.Host})
 	u.Manifest = &update.Manifest
+	u.Rollback = update.Rollback
 }
@@ -15,8 +15,10 @@
 package omaha
 
 import (
+	"bytes"
 	"encoding/xml"
 	"fmt"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/kylelemons/godebug/diff"
@@ -59,10 +61,63 @@ func compareXML(a, b interface{}) error {
 }
 
 func TestHandleNilRequest(t *testing.T) {
-	handler := OmahaHandler{UpdaterStub{}}
+	handler := OmahaHandler{Updater: UpdaterStub{}}
 	response := NewResponse()
 	handler.serveApp(response, nil, nilRequest, nilRequest.Apps[0])
 	if err := compareXML(nilResponse, response); err != nil {
 		t.Error(err)
 	}
 }
+
+func TestHandleInvalidApps(t *testing.T) {
+	handler := OmahaHandler{
+		Updater:    UpdaterStub{},
+		Strictness: ValidateStrict,
+	}
+
+	req := NewRequest()
+	req.AddApp(testAppID, testAppVer)
+	req.AddApp(testAppID, testAppVer)
+	req.AddApp("", testAppVer)
+	req.AddApp("{00000000-0000-0000-0000-000000000000}", "ForcedUpdate")
+
+	response := NewResponse()
+	for _, app := range req.Apps {
+		handler.serveApp(response, nil, req, app)
+	}
+
+	expected := []AppStatus{AppOK, AppInvalidID, AppInvalidID, AppInvalidVersion}
+	for i, app := range response.Apps {
+		if app.Status != expected[i] {
+			t.Errorf("app %d: expected %s, got %s", i, expected[i], app.Status)
+		}
+	}
+}
+
+type remoteAddrUpdater struct {
+	UpdaterStub
+	addr string
+}
+
+func (u *remoteAddrUpdater) CheckApp(req *Request, app *AppRequest) error {
+	u.addr = req.RemoteAddr
+	return nil
+}
+
+func TestHandleRemoteAddr(t *testing.T) {
+	u := &remoteAddrUpdater{}
+	handler := &OmahaHandler{Updater: u}
+
+	body, err := xml.Marshal(nilRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/v1/update/", bytes.NewReader(body))
+	req.RemoteAddr = "192.0.2.1:1234"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if u.addr != "192.0.2.1" {
+		t.Errorf("unexpected remote address %q", u.addr)
+	}
+}
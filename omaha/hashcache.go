@@ -0,0 +1,239 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// HashCache remembers the hashes of package files so large payloads are
+// not read again each time a server starts or a catalog is reloaded.
+// Entries are keyed on the file's path and only used while its size,
+// modification time and inode are unchanged.
+type HashCache struct {
+	// ChunkSize enables reading files in chunks of this many bytes
+	// while the SHA-1 and SHA-256 sums are computed concurrently,
+	// which roughly halves the time to hash a large file on a
+	// machine with spare cores. Zero hashes sequentially.
+	ChunkSize int
+
+	mu      sync.Mutex
+	path    string
+	entries map[string]hashCacheEntry
+}
+
+type hashCacheEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Inode   uint64 `json:"inode"`
+	SHA1    string `json:"sha1"`
+	SHA256  string `json:"sha256"`
+}
+
+// NewHashCache creates a cache persisted to the given sidecar file,
+// loading any entries it already holds. A blank path keeps the cache
+// in memory only.
+func NewHashCache(path string) (*HashCache, error) {
+	hc := &HashCache{
+		path:    path,
+		entries: make(map[string]hashCacheEntry),
+	}
+
+	if path == "" {
+		return hc, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return hc, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &hc.entries); err != nil {
+		// A corrupt cache is only a performance problem.
+		hc.entries = make(map[string]hashCacheEntry)
+	}
+
+	return hc, nil
+}
+
+// FromPath fills in the package the same as Package.FromPath, using the
+// cached hashes if the file has not changed. A nil cache always hashes
+// the file.
+func (hc *HashCache) FromPath(p *Package, name string) error {
+	if hc == nil {
+		return p.FromPath(name)
+	}
+
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	before, err := hc.stat(f)
+	if err != nil {
+		return err
+	}
+
+	hc.mu.Lock()
+	entry, ok := hc.entries[abs]
+	hc.mu.Unlock()
+
+	if !ok || !entry.matches(before) {
+		entry = before
+		if entry.SHA1, entry.SHA256, err = hc.hash(f); err != nil {
+			return err
+		}
+
+		// Only remember hashes of a file that held still.
+		after, err := hc.stat(f)
+		if err != nil {
+			return err
+		}
+		if after.matches(before) {
+			if err := hc.store(abs, entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	p.SHA1 = entry.SHA1
+	p.SHA256 = entry.SHA256
+	p.Size = uint64(entry.Size)
+	p.Name = filepath.Base(name)
+	return nil
+}
+
+func (hc *HashCache) stat(f *os.File) (hashCacheEntry, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return hashCacheEntry{}, err
+	}
+
+	return hashCacheEntry{
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().UnixNano(),
+		Inode:   fileInode(fi),
+	}, nil
+}
+
+func (e hashCacheEntry) matches(o hashCacheEntry) bool {
+	return e.Size == o.Size && e.ModTime == o.ModTime && e.Inode == o.Inode
+}
+
+func (hc *HashCache) hash(r io.Reader) (sha1b64, sha256b64 string, err error) {
+	if hc.ChunkSize <= 0 {
+		sha1b64, sha256b64, _, err = multihash(r)
+		return
+	}
+
+	h1 := sha1.New()
+	h256 := sha256.New()
+	if err = parallelHash(r, hc.ChunkSize, h1, h256); err != nil {
+		return
+	}
+
+	sha1b64 = base64.StdEncoding.EncodeToString(h1.Sum(nil))
+	sha256b64 = base64.StdEncoding.EncodeToString(h256.Sum(nil))
+	return
+}
+
+// parallelHash feeds each chunk read from r to all of the hashes at
+// once, each in its own goroutine, while the next chunk is read.
+func parallelHash(r io.Reader, size int, hashes ...hash.Hash) error {
+	var wg sync.WaitGroup
+	chans := make([]chan []byte, len(hashes))
+	for i, h := range hashes {
+		chans[i] = make(chan []byte, 1)
+		wg.Add(1)
+		go func(h hash.Hash, c chan []byte) {
+			defer wg.Done()
+			for buf := range c {
+				h.Write(buf)
+			}
+		}(h, chans[i])
+	}
+
+	var err error
+	for {
+		buf := make([]byte, size)
+		var n int
+		n, err = io.ReadFull(r, buf)
+		if n > 0 {
+			for _, c := range chans {
+				c <- buf[:n]
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+			break
+		} else if err != nil {
+			break
+		}
+	}
+
+	for _, c := range chans {
+		close(c)
+	}
+	wg.Wait()
+	return err
+}
+
+func (hc *HashCache) store(abs string, entry hashCacheEntry) error {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	hc.entries[abs] = entry
+	if hc.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(hc.entries)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(hc.path), ".hashcache-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), hc.path)
+}
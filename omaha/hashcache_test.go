@@ -0,0 +1,115 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHashCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-omaha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "update.gz")
+	sidecar := filepath.Join(dir, "hashes.json")
+	if err := ioutil.WriteFile(file, []byte("test"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hc, err := NewHashCache(sidecar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m Manifest
+	pkg, err := m.AddPackageFromPathCached(file, hc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Name != "update.gz" || pkg.Size != 4 || pkg.SHA1 != "qUqP5cyxm6YcTAhz05Hph5gvu9M=" {
+		t.Errorf("unexpected package %#v", pkg)
+	}
+
+	// Poison the persisted entry to prove it is used by a new cache.
+	hc2, err := NewHashCache(sidecar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs, _ := filepath.Abs(file)
+	entry, ok := hc2.entries[abs]
+	if !ok {
+		t.Fatalf("entry not persisted: %v", hc2.entries)
+	}
+	entry.SHA1 = "cached"
+	hc2.entries[abs] = entry
+
+	p := &Package{}
+	if err := hc2.FromPath(p, file); err != nil {
+		t.Fatal(err)
+	}
+	if p.SHA1 != "cached" {
+		t.Errorf("cache not used: %#v", p)
+	}
+
+	// Any change to the file invalidates the entry.
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(file, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if err := hc2.FromPath(p, file); err != nil {
+		t.Fatal(err)
+	}
+	if p.SHA1 != pkg.SHA1 {
+		t.Errorf("stale entry used: %#v", p)
+	}
+}
+
+func TestHashCacheNil(t *testing.T) {
+	var hc *HashCache
+	p := &Package{}
+	if err := hc.FromPath(p, "/dev/null"); err != nil {
+		t.Fatal(err)
+	}
+	if p.Size != 0 || p.SHA1 != "2jmj7l5rSw0yVb/vlWAYkK/YBwk=" {
+		t.Errorf("unexpected package %#v", p)
+	}
+}
+
+func TestHashCacheChunked(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	expect := &Package{}
+	if err := expect.FromReader(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{1, 7, 1000, 10000, 20000} {
+		hc := &HashCache{ChunkSize: size}
+		sha1b64, sha256b64, err := hc.hash(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sha1b64 != expect.SHA1 || sha256b64 != expect.SHA256 {
+			t.Errorf("chunk size %d: got %s %s", size, sha1b64, sha256b64)
+		}
+	}
+}
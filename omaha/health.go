@@ -0,0 +1,396 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// update_engine exit codes, see the client package's ExitCode.
+const (
+	exitCodeOmahaRequestError            = 2
+	exitCodeOmahaResponseHandlerError    = 3
+	exitCodeOmahaRequestEmptyResponse    = 30
+	exitCodeOmahaRequestXMLParseError    = 31
+	exitCodeOmahaResponseInvalid         = 34
+	exitCodeOmahaUpdateIgnoredPerPolicy  = 35
+	exitCodeOmahaUpdateDeferredPerPolicy = 36
+	exitCodeOmahaErrorInHTTPResponse     = 37
+	exitCodeOmahaUpdateDeferredBackoff   = 40
+	exitCodeOmahaRequestHTTPResponse     = 2000 // + HTTP status code
+)
+
+const (
+	// Machines that stop reporting on their update are forgotten
+	// after updateExpiry, checked at most every updateSweepInterval.
+	updateExpiry        = 7 * 24 * time.Hour
+	updateSweepInterval = time.Hour
+)
+
+// ReleaseStats summarizes how an update to one version of an app on one
+// track is going. Each machine counts once, by the latest outcome it
+// reported, so a machine that fails and then succeeds on retry counts
+// as a success.
+type ReleaseStats struct {
+	AppID   string `json:"app_id"`
+	Version string `json:"version"`
+	Track   string `json:"track"`
+
+	Events       int     `json:"events"`
+	Succeeded    int     `json:"succeeded"`
+	Failed       int     `json:"failed"`
+	FailureRatio float64 `json:"failure_ratio"`
+
+	// ErrorCodes counts failure events by update_engine exit code.
+	ErrorCodes map[int]int `json:"error_codes"`
+
+	// Time from a machine starting the update to reporting success.
+	Completed           int     `json:"completed"`
+	MeanCompleteSeconds float64 `json:"mean_time_to_complete_seconds"`
+	MaxCompleteSeconds  float64 `json:"max_time_to_complete_seconds"`
+
+	// Halted is set once the release fails the HealthPolicy.
+	Halted bool `json:"halted"`
+}
+
+// HealthPolicy decides when a release is unhealthy: once at least
+// MinMachines have reported an outcome and more than MaxFailureRatio of
+// them failed.
+type HealthPolicy struct {
+	MinMachines     int
+	MaxFailureRatio float64
+}
+
+// HealthAggregator scores releases from client events. It is an
+// EventSink so it is usually fed by an EventBus:
+//
+//	bus.AddSink(health, 1000)
+//
+// Events about an update are attributed to the version being installed:
+// their nextversion attribute if set, as the client package does, or
+// else the version a machine's earlier events about the update were
+// attributed to, starting with the download. Failures that can't be
+// attributed, updates deferred by policy and failed update checks are
+// ignored, the latter so an unreliable network can't halt a release.
+// A machine's update is forgotten if it reports nothing for a week.
+//
+// An update succeeds when the new version reports completion with the
+// previousversion it was updated from, which update_engine only sends
+// with the first check after rebooting. The completion sent with every
+// other check carries no previousversion and is ignored, so it does not
+// hide an earlier failure.
+type HealthAggregator struct {
+	// Policy and OnHalt, if set, are checked after each event. OnHalt
+	// is called once per release, without locks held, when it first
+	// fails the policy.
+	Policy *HealthPolicy
+	OnHalt func(stats *ReleaseStats)
+
+	mu        sync.Mutex
+	releases  map[releaseKey]*releaseHealth
+	updates   map[catalogPin]*machineUpdate
+	lastSweep time.Time
+}
+
+// machineUpdate is an update a machine is installing.
+type machineUpdate struct {
+	version string
+	started time.Time
+	seen    time.Time
+}
+
+type releaseKey struct {
+	appID   string
+	version string
+	track   string
+}
+
+type releaseHealth struct {
+	stats    ReleaseStats
+	outcomes map[string]bool
+	total    time.Duration
+	max      time.Duration
+}
+
+func NewHealthAggregator() *HealthAggregator {
+	return &HealthAggregator{
+		releases: make(map[releaseKey]*releaseHealth),
+		updates:  make(map[catalogPin]*machineUpdate),
+	}
+}
+
+// HaltCatalog returns an OnHalt function halting the release's version
+// on its track, see Catalog.Halt.
+func HaltCatalog(c *Catalog) func(stats *ReleaseStats) {
+	return func(stats *ReleaseStats) {
+		log.Printf("omaha: Halting %s %s on track %q: %d of %d machines failed",
+			stats.AppID, stats.Version, stats.Track,
+			stats.Failed, stats.Failed+stats.Succeeded)
+		if err := c.Halt(stats.AppID, stats.Track, stats.Version); err != nil {
+			log.Printf("omaha: Failed halting release: %v", err)
+		}
+	}
+}
+
+func (ha *HealthAggregator) WriteEvent(rec *EventRecord) error {
+	ha.Observe(rec)
+	return nil
+}
+
+func (ha *HealthAggregator) Close() error {
+	return nil
+}
+
+// Observe adds an event to the release it belongs to, if any.
+func (ha *HealthAggregator) Observe(rec *EventRecord) {
+	if isCheckIn(rec) || isDeferred(rec) || isCheckFailure(rec) {
+		return
+	}
+
+	ha.mu.Lock()
+	machine := catalogPin{rec.AppID, rec.MachineID}
+	update := ha.updates[machine]
+
+	var version string
+	switch {
+	case isUpdateSuccess(rec):
+		version = rec.Version
+	case rec.NextVersion != "":
+		version = rec.NextVersion
+	case update != nil:
+		version = update.version
+	default:
+		ha.mu.Unlock()
+		return
+	}
+
+	key := releaseKey{rec.AppID, version, rec.Track}
+	rh, ok := ha.releases[key]
+	if !ok {
+		rh = &releaseHealth{
+			stats: ReleaseStats{
+				AppID:      rec.AppID,
+				Version:    version,
+				Track:      rec.Track,
+				ErrorCodes: make(map[int]int),
+			},
+			outcomes: make(map[string]bool),
+		}
+		ha.releases[key] = rh
+	}
+
+	rh.stats.Events++
+
+	switch {
+	case rec.Failed():
+		rh.stats.ErrorCodes[rec.ErrorCode]++
+		rh.outcome(rec.MachineID, false)
+		delete(ha.updates, machine)
+	case isUpdateSuccess(rec):
+		rh.outcome(rec.MachineID, true)
+		if update != nil && update.version == version && !update.started.IsZero() {
+			rh.completed(rec.Time.Sub(update.started))
+		}
+		delete(ha.updates, machine)
+	case rec.MachineID == "":
+		// Progress of anonymous machines can't be followed.
+	case update == nil || update.version != version:
+		ha.sweep(rec.Time)
+		update = &machineUpdate{version: version}
+		ha.updates[machine] = update
+		fallthrough
+	default:
+		if isUpdateStart(rec) && update.started.IsZero() {
+			update.started = rec.Time
+		}
+		update.seen = rec.Time
+	}
+
+	var halt *ReleaseStats
+	if ha.Policy != nil && !rh.stats.Halted && ha.Policy.unhealthy(&rh.stats) {
+		rh.stats.Halted = true
+		halt = rh.snapshot()
+	}
+	ha.mu.Unlock()
+
+	if halt != nil && ha.OnHalt != nil {
+		ha.OnHalt(halt)
+	}
+}
+
+// sweep forgets updates not heard from in updateExpiry. mu must be held.
+func (ha *HealthAggregator) sweep(now time.Time) {
+	if now.Sub(ha.lastSweep) < updateSweepInterval {
+		return
+	}
+	ha.lastSweep = now
+
+	for machine, update := range ha.updates {
+		if now.Sub(update.seen) > updateExpiry {
+			delete(ha.updates, machine)
+		}
+	}
+}
+
+// Release returns the stats for one release, or nil if no events have
+// been seen for it.
+func (ha *HealthAggregator) Release(appID, version, track string) *ReleaseStats {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+
+	rh, ok := ha.releases[releaseKey{appID, version, track}]
+	if !ok {
+		return nil
+	}
+	return rh.snapshot()
+}
+
+// Releases returns the stats for every release of an app, or of all apps
+// if appID is blank, sorted by app, track and version.
+func (ha *HealthAggregator) Releases(appID string) []*ReleaseStats {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+
+	releases := []*ReleaseStats{}
+	for key, rh := range ha.releases {
+		if appID == "" || key.appID == appID {
+			releases = append(releases, rh.snapshot())
+		}
+	}
+	sort.Slice(releases, func(i, j int) bool {
+		a, b := releases[i], releases[j]
+		if a.AppID != b.AppID {
+			return a.AppID < b.AppID
+		}
+		if a.Track != b.Track {
+			return a.Track < b.Track
+		}
+		return a.Version < b.Version
+	})
+	return releases
+}
+
+// outcome records a machine's latest result. Anonymous events count
+// individually since they can't be told apart.
+func (rh *releaseHealth) outcome(machineID string, ok bool) {
+	if machineID != "" {
+		if prev, seen := rh.outcomes[machineID]; seen {
+			if prev == ok {
+				return
+			}
+			if prev {
+				rh.stats.Succeeded--
+			} else {
+				rh.stats.Failed--
+			}
+		}
+		rh.outcomes[machineID] = ok
+	}
+
+	if ok {
+		rh.stats.Succeeded++
+	} else {
+		rh.stats.Failed++
+	}
+	rh.stats.FailureRatio = float64(rh.stats.Failed) /
+		float64(rh.stats.Failed+rh.stats.Succeeded)
+}
+
+func (rh *releaseHealth) completed(d time.Duration) {
+	if d < 0 {
+		return
+	}
+	rh.stats.Completed++
+	rh.total += d
+	if d > rh.max {
+		rh.max = d
+	}
+	rh.stats.MeanCompleteSeconds = (rh.total / time.Duration(rh.stats.Completed)).Seconds()
+	rh.stats.MaxCompleteSeconds = rh.max.Seconds()
+}
+
+func (rh *releaseHealth) snapshot() *ReleaseStats {
+	stats := rh.stats
+	stats.ErrorCodes = make(map[int]int, len(rh.stats.ErrorCodes))
+	for code, n := range rh.stats.ErrorCodes {
+		stats.ErrorCodes[code] = n
+	}
+	return &stats
+}
+
+func (hp *HealthPolicy) unhealthy(stats *ReleaseStats) bool {
+	machines := stats.Succeeded + stats.Failed
+	return machines > 0 && machines >= hp.MinMachines &&
+		stats.FailureRatio > hp.MaxFailureRatio
+}
+
+func isUpdateStart(rec *EventRecord) bool {
+	switch rec.Type {
+	case EventTypeUpdateDownloadStarted, EventTypeDownloadStarted:
+		return rec.Result == EventResultSuccess
+	}
+	return false
+}
+
+// isUpdateSuccess matches the update_engine event sent after rebooting
+// into the new version.
+func isUpdateSuccess(rec *EventRecord) bool {
+	return rec.Type == EventTypeUpdateComplete &&
+		rec.Result == EventResultSuccessReboot &&
+		rec.PreviousVersion != "" && rec.PreviousVersion != rec.Version
+}
+
+// isCheckIn matches the completion event update_engine sends with every
+// update check that does not follow an update.
+func isCheckIn(rec *EventRecord) bool {
+	return rec.Type == EventTypeUpdateComplete &&
+		rec.Result == EventResultSuccessReboot && !isUpdateSuccess(rec)
+}
+
+// isDeferred matches update_engine's errors for updates ignored or
+// postponed by policy rather than failing.
+func isDeferred(rec *EventRecord) bool {
+	if !rec.Failed() {
+		return false
+	}
+	switch rec.ErrorCode {
+	case exitCodeOmahaUpdateIgnoredPerPolicy,
+		exitCodeOmahaUpdateDeferredPerPolicy,
+		exitCodeOmahaUpdateDeferredBackoff:
+		return true
+	}
+	return false
+}
+
+// isCheckFailure matches errors talking to the Omaha server, which say
+// nothing about the update being installed.
+func isCheckFailure(rec *EventRecord) bool {
+	if !rec.Failed() {
+		return false
+	}
+	switch rec.ErrorCode {
+	case exitCodeOmahaRequestError,
+		exitCodeOmahaResponseHandlerError,
+		exitCodeOmahaRequestEmptyResponse,
+		exitCodeOmahaRequestXMLParseError,
+		exitCodeOmahaResponseInvalid,
+		exitCodeOmahaErrorInHTTPResponse:
+		return true
+	}
+	return rec.ErrorCode > exitCodeOmahaRequestHTTPResponse
+}
@@ -0,0 +1,259 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var healthEpoch = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func mkHealthRecord(machine string, offset time.Duration, t EventType, r EventResult) *EventRecord {
+	return &EventRecord{
+		Time:        healthEpoch.Add(offset),
+		AppID:       testAppID,
+		MachineID:   machine,
+		Version:     testAppVer,
+		Track:       "stable",
+		Type:        t,
+		Result:      r,
+		NextVersion: "1.1.0",
+	}
+}
+
+func mkHealthFailure(machine string, code int) *EventRecord {
+	rec := mkHealthRecord(machine, 0, EventTypeUpdateComplete, EventResultError)
+	rec.ErrorCode = code
+	return rec
+}
+
+// mkHealthSuccess is the completion sent by the new version after a
+// reboot, which no longer carries nextversion.
+func mkHealthSuccess(machine string, offset time.Duration) *EventRecord {
+	rec := mkHealthRecord(machine, offset, EventTypeUpdateComplete, EventResultSuccessReboot)
+	rec.Version = "1.1.0"
+	rec.PreviousVersion = testAppVer
+	rec.NextVersion = ""
+	return rec
+}
+
+func TestHealthAggregator(t *testing.T) {
+	ha := NewHealthAggregator()
+	for _, rec := range []*EventRecord{
+		mkHealthRecord("a", 0, EventTypeUpdateDownloadStarted, EventResultSuccess),
+		mkHealthRecord("b", 0, EventTypeUpdateDownloadStarted, EventResultSuccess),
+		mkHealthRecord("c", 0, EventTypeUpdateDownloadStarted, EventResultSuccess),
+		mkHealthSuccess("a", time.Minute),
+		mkHealthSuccess("b", 3*time.Minute),
+		mkHealthFailure("c", 20),
+		mkHealthFailure("d", 20),
+		mkHealthFailure("e", 7),
+		// retrying successfully replaces the earlier failure
+		mkHealthSuccess("e", 0),
+	} {
+		if err := ha.WriteEvent(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := ha.Release(testAppID, "1.1.0", "stable")
+	if stats == nil {
+		t.Fatal("release not found")
+	}
+	if stats.Events != 9 || stats.Succeeded != 3 || stats.Failed != 2 {
+		t.Errorf("unexpected counts %+v", stats)
+	}
+	if stats.FailureRatio != 0.4 {
+		t.Errorf("unexpected failure ratio %v", stats.FailureRatio)
+	}
+	if stats.ErrorCodes[20] != 2 || stats.ErrorCodes[7] != 1 {
+		t.Errorf("unexpected error codes %v", stats.ErrorCodes)
+	}
+	if stats.Completed != 2 || stats.MeanCompleteSeconds != 120 ||
+		stats.MaxCompleteSeconds != 180 {
+		t.Errorf("unexpected completion times %+v", stats)
+	}
+
+	if ha.Release(testAppID, testAppVer, "stable") != nil {
+		t.Error("events attributed to the old version")
+	}
+	if len(ha.Releases("")) != 1 || len(ha.Releases("other")) != 0 {
+		t.Error("unexpected releases")
+	}
+
+	// Snapshots must not alias internal state.
+	stats.ErrorCodes[20] = 100
+	if ha.Release(testAppID, "1.1.0", "stable").ErrorCodes[20] != 2 {
+		t.Error("snapshot modified aggregator")
+	}
+}
+
+func TestHealthHaltCatalog(t *testing.T) {
+	c := NewCatalog()
+	if err := c.AddUpdate("stable", mkCatalogUpdate("1.1.0", "", false)); err != nil {
+		t.Fatal(err)
+	}
+
+	halts := 0
+	halt := HaltCatalog(c)
+	ha := NewHealthAggregator()
+	ha.Policy = &HealthPolicy{MinMachines: 3, MaxFailureRatio: 0.5}
+	ha.OnHalt = func(stats *ReleaseStats) {
+		halts++
+		halt(stats)
+	}
+
+	ha.Observe(mkHealthFailure("a", 20))
+	ha.Observe(mkHealthFailure("b", 20))
+	if halts != 0 {
+		t.Fatal("halted before MinMachines reported")
+	}
+	ha.Observe(mkHealthSuccess("c", 0))
+	ha.Observe(mkHealthFailure("d", 20))
+	ha.Observe(mkHealthFailure("e", 20))
+	if halts != 1 {
+		t.Fatalf("expected 1 halt, got %d", halts)
+	}
+	if !ha.Release(testAppID, "1.1.0", "stable").Halted {
+		t.Error("release not marked halted")
+	}
+
+	app := c.App(testAppID)
+	if app == nil || len(app.Tracks) != 1 || app.Tracks[0].Paused ||
+		len(app.Tracks[0].Halted) != 1 || app.Tracks[0].Halted[0] != "1.1.0" {
+		t.Errorf("version not halted: %#v", app)
+	}
+}
+
+func TestHealthLifecycle(t *testing.T) {
+	// Events without nextversion, as update_engine sends them.
+	mkRecord := func(machine string, offset time.Duration, t EventType, r EventResult) *EventRecord {
+		rec := mkHealthRecord(machine, offset, t, r)
+		rec.NextVersion = ""
+		return rec
+	}
+	checkIn := func(machine, version string) *EventRecord {
+		rec := mkRecord(machine, 0, EventTypeUpdateComplete, EventResultSuccessReboot)
+		rec.Version = version
+		return rec
+	}
+	failure := func(machine string, code int) *EventRecord {
+		rec := mkRecord(machine, 0, EventTypeUpdateComplete, EventResultError)
+		rec.ErrorCode = code
+		return rec
+	}
+
+	ha := NewHealthAggregator()
+	for _, rec := range []*EventRecord{
+		// Routine check ins belong to no release.
+		checkIn("a", testAppVer),
+		checkIn("b", testAppVer),
+		// Nor do failures before any update started, or deferrals.
+		failure("a", 2),
+		mkHealthFailure("c", 36),
+		// a learns its target from a download with nextversion and
+		// fails installing it.
+		mkHealthRecord("a", 0, EventTypeUpdateDownloadStarted, EventResultSuccess),
+		failure("a", 15),
+		checkIn("a", testAppVer),
+		// b never says what it is downloading, only what it
+		// completed.
+		mkRecord("b", 0, EventTypeUpdateDownloadStarted, EventResultSuccess),
+		mkHealthSuccess("b", 0),
+		checkIn("b", "1.1.0"),
+		// c's progress is timed from the download starting.
+		mkHealthRecord("c", time.Minute, EventTypeUpdateDownloadStarted, EventResultSuccess),
+		mkRecord("c", 2*time.Minute, EventTypeUpdateDownloadFinished, EventResultSuccess),
+		mkRecord("c", 3*time.Minute, EventTypeUpdateComplete, EventResultSuccess),
+		mkHealthSuccess("c", 11*time.Minute),
+	} {
+		ha.Observe(rec)
+	}
+
+	if r := ha.Releases(""); len(r) != 1 {
+		t.Fatalf("unexpected releases %+v", r)
+	}
+	stats := ha.Release(testAppID, "1.1.0", "stable")
+	if stats.Events != 7 || stats.Succeeded != 2 || stats.Failed != 1 ||
+		stats.ErrorCodes[15] != 1 || len(stats.ErrorCodes) != 1 {
+		t.Errorf("unexpected outcomes %+v", stats)
+	}
+	if stats.Completed != 1 || stats.MeanCompleteSeconds != 600 {
+		t.Errorf("unexpected completion times %+v", stats)
+	}
+}
+
+func TestHealthCheckFailures(t *testing.T) {
+	failure := func(machine string, offset time.Duration, code int) *EventRecord {
+		rec := mkHealthRecord(machine, offset, EventTypeUpdateComplete, EventResultError)
+		rec.NextVersion = ""
+		rec.ErrorCode = code
+		return rec
+	}
+
+	ha := NewHealthAggregator()
+	for _, rec := range []*EventRecord{
+		// Failed update checks during a's update don't end it.
+		mkHealthRecord("a", 0, EventTypeUpdateDownloadStarted, EventResultSuccess),
+		failure("a", time.Minute, 2),
+		failure("a", 2*time.Minute, 2503),
+		mkHealthSuccess("a", 10*time.Minute),
+		// b goes quiet for longer than updateExpiry and is forgotten
+		// by the time c starts, so its failure can't be attributed.
+		mkHealthRecord("b", 0, EventTypeUpdateDownloadStarted, EventResultSuccess),
+		mkHealthRecord("c", updateExpiry+time.Hour, EventTypeUpdateDownloadStarted, EventResultSuccess),
+		failure("b", updateExpiry+2*time.Hour, 15),
+	} {
+		ha.Observe(rec)
+	}
+
+	stats := ha.Release(testAppID, "1.1.0", "stable")
+	if stats.Events != 4 || stats.Succeeded != 1 || stats.Failed != 0 || len(stats.ErrorCodes) != 0 {
+		t.Errorf("unexpected outcomes %+v", stats)
+	}
+	if stats.Completed != 1 || stats.MeanCompleteSeconds != 600 {
+		t.Errorf("unexpected completion times %+v", stats)
+	}
+	if len(ha.updates) != 1 {
+		t.Errorf("unexpected updates in progress %v", ha.updates)
+	}
+}
+
+func TestAdminHealth(t *testing.T) {
+	c := NewCatalog()
+	if err := c.AddApp(testAppID); err != nil {
+		t.Fatal(err)
+	}
+	h := NewAdminHandler(c, testAdminToken)
+	if w := adminDo(h, testAdminToken, "GET", "health", ""); w.Code != http.StatusNotFound {
+		t.Errorf("health served without an aggregator: %d", w.Code)
+	}
+
+	h.Health = NewHealthAggregator()
+	h.Health.Observe(mkHealthFailure("a", 20))
+	for _, path := range []string{"health", "apps/" + testAppID + "/health"} {
+		w := adminDo(h, testAdminToken, "GET", path, "")
+		var resp []*ReleaseStats
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if len(resp) != 1 || resp[0].Failed != 1 || resp[0].ErrorCodes[20] != 1 {
+			t.Errorf("%s: unexpected response %s", path, w.Body)
+		}
+	}
+}
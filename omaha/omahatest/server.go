@@ -0,0 +1,278 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package omahatest provides an in-process omaha server for testing
+// update clients. Replies are scripted ahead of time and every request
+// and event the server receives is recorded for later assertions.
+package omahatest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+)
+
+// Reply scripts the server's answer to a single update check.
+type Reply struct {
+	// Update is offered to every app in the request that checks for
+	// an update. Without an Update or Err the reply is noupdate.
+	Update *omaha.Update
+
+	// Err is returned from the updater. An omaha.AppStatus fails the
+	// app check, anything else fails the update check, so an
+	// omaha.UpdateStatus sets the update check status.
+	Err error
+
+	// Status, if not zero, is sent as a plain HTTP error instead of
+	// an omaha response.
+	Status int
+
+	// Body, if not nil, is sent as is instead of an omaha response.
+	// Useful for testing malformed XML.
+	Body []byte
+
+	// Delay before replying, to test client timeouts.
+	Delay time.Duration
+}
+
+// Event is an event received by the server.
+type Event struct {
+	AppID   string
+	Version string
+	*omaha.EventRequest
+}
+
+// Server is an omaha server running on the local loopback interface.
+// Requests checking for updates are answered with the queued replies in
+// order and with noupdate once the queue is empty. Other requests, such
+// as events clients send in the background, never use a queued reply so
+// they cannot take the reply meant for the next update check.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	replies  []*Reply
+	requests []*omaha.Request
+	events   []Event
+}
+
+// NewServer starts a server. The caller should call Close when done.
+// The server's URL may be used directly as a client's server URL.
+func NewServer() *Server {
+	s := &Server{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Push queues replies to the following requests.
+func (s *Server) Push(replies ...*Reply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replies = append(s.replies, replies...)
+}
+
+// PushUpdate queues a reply offering the update.
+func (s *Server) PushUpdate(update *omaha.Update) {
+	s.Push(&Reply{Update: update})
+}
+
+// Pending returns the number of replies not yet sent.
+func (s *Server) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.replies)
+}
+
+// Requests returns all requests received so far that could be parsed.
+func (s *Server) Requests() []*omaha.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*omaha.Request(nil), s.requests...)
+}
+
+// Events returns all events received so far in the order received.
+// Events are only recorded for requests answered with an omaha response.
+func (s *Server) Events() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Event(nil), s.events...)
+}
+
+// Reset clears queued replies and recorded requests and events.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replies = nil
+	s.requests = nil
+	s.events = nil
+}
+
+// ExpectRequests fails the test unless exactly n requests were received.
+func (s *Server) ExpectRequests(t testing.TB, n int) {
+	t.Helper()
+	if reqs := s.Requests(); len(reqs) != n {
+		t.Errorf("omahatest: expected %d requests, got %d", n, len(reqs))
+	}
+}
+
+// ExpectEvent fails the test unless an event of the given type and
+// result was received for the app.
+func (s *Server) ExpectEvent(t testing.TB, appID string, eventType omaha.EventType, result omaha.EventResult) *Event {
+	t.Helper()
+	events := s.Events()
+	for i := range events {
+		e := &events[i]
+		if e.AppID == appID && e.Type == eventType && e.Result == result {
+			return e
+		}
+	}
+	t.Errorf("omahatest: no %s:%s event for app %s in %d events",
+		eventType, result, appID, len(events))
+	return nil
+}
+
+// WaitEvent waits up to timeout for an event of the given type and
+// result for the app, failing the test if none arrives. Useful for
+// events clients send in the background.
+func (s *Server) WaitEvent(t testing.TB, appID string, eventType omaha.EventType, result omaha.EventResult, timeout time.Duration) *Event {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		events := s.Events()
+		for i := range events {
+			e := &events[i]
+			if e.AppID == appID && e.Type == eventType && e.Result == result {
+				return e
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("omahatest: no %s:%s event for app %s after %s",
+				eventType, result, appID, timeout)
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// ExpectNoPending fails the test if any queued reply was not sent.
+func (s *Server) ExpectNoPending(t testing.TB) {
+	t.Helper()
+	if n := s.Pending(); n != 0 {
+		t.Errorf("omahatest: %d replies not sent", n)
+	}
+}
+
+// next returns the reply for a request, only taking a queued reply if
+// the request checks for updates.
+func (s *Server) next(req *omaha.Request) *Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req != nil {
+		s.requests = append(s.requests, req)
+	}
+	if len(s.replies) == 0 || !isUpdateCheck(req) {
+		return &Reply{}
+	}
+	r := s.replies[0]
+	s.replies = s.replies[1:]
+	return r
+}
+
+func isUpdateCheck(req *omaha.Request) bool {
+	if req == nil {
+		return false
+	}
+	for _, app := range req.Apps {
+		if app.UpdateCheck != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	// Record the request before OmahaHandler consumes the body.
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1024*1024))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := omaha.ParseRequest(r.Header.Get("Content-Type"), bytes.NewReader(body))
+	if err != nil {
+		req = nil
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	reply := s.next(req)
+	if reply.Delay != 0 {
+		select {
+		case <-time.After(reply.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	switch {
+	case reply.Status != 0:
+		http.Error(w, http.StatusText(reply.Status), reply.Status)
+	case reply.Body != nil:
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		w.Write(reply.Body)
+	default:
+		h := &omaha.OmahaHandler{Updater: &scriptedUpdater{s, reply}}
+		h.ServeHTTP(w, r)
+	}
+}
+
+// scriptedUpdater answers a single request according to a Reply.
+type scriptedUpdater struct {
+	s     *Server
+	reply *Reply
+}
+
+func (u *scriptedUpdater) CheckApp(req *omaha.Request, app *omaha.AppRequest) error {
+	if status, ok := u.reply.Err.(omaha.AppStatus); ok {
+		return status
+	}
+	return nil
+}
+
+func (u *scriptedUpdater) CheckUpdate(req *omaha.Request, app *omaha.AppRequest) (*omaha.Update, error) {
+	if u.reply.Err != nil {
+		return nil, u.reply.Err
+	}
+	if u.reply.Update == nil {
+		return nil, omaha.NoUpdate
+	}
+	return u.reply.Update, nil
+}
+
+func (u *scriptedUpdater) Event(req *omaha.Request, app *omaha.AppRequest, event *omaha.EventRequest) {
+	u.s.mu.Lock()
+	defer u.s.mu.Unlock()
+	u.s.events = append(u.s.events, Event{
+		AppID:        app.ID,
+		Version:      app.Version,
+		EventRequest: event,
+	})
+}
+
+func (u *scriptedUpdater) Ping(req *omaha.Request, app *omaha.AppRequest) {}
@@ -0,0 +1,148 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omahatest
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-omaha/omaha"
+	"github.com/coreos/go-omaha/omaha/client"
+)
+
+const testAppID = "{27BD862E-8AE8-4886-A055-F7F1A6460627}"
+
+func newClient(t *testing.T, s *Server) *client.AppClient {
+	ac, err := client.NewAppClient(s.URL, "machine-id", testAppID, "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ac
+}
+
+func TestServerScript(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	s.PushUpdate(&omaha.Update{
+		Manifest: omaha.Manifest{Version: "1.1.0"},
+	})
+	s.Push(&Reply{Err: omaha.AppUnknownID})
+
+	ac := newClient(t, s)
+	update, err := ac.UpdateCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update.Status != omaha.UpdateOK || update.Manifest.Version != "1.1.0" {
+		t.Errorf("unexpected update: %#v", update)
+	}
+	if len(update.URLs) != 1 || !strings.HasPrefix(update.URLs[0].CodeBase, s.URL) {
+		t.Errorf("unexpected update URLs: %#v", update.URLs)
+	}
+
+	if _, err := ac.UpdateCheck(); err == nil {
+		t.Error("unknown app status not reported")
+	}
+
+	// Queue is empty so the default is noupdate.
+	if _, err := ac.UpdateCheck(); err != omaha.NoUpdate {
+		t.Errorf("expected noupdate, got %v", err)
+	}
+
+	s.ExpectNoPending(t)
+	s.ExpectEvent(t, testAppID, omaha.EventTypeUpdateComplete, omaha.EventResultSuccessReboot)
+
+	// The handler answers the unknown app with HTTP 400, which the
+	// client reports with an error event (code 2400) sent in the
+	// background, so only count the update checks.
+	reqs := s.Requests()
+	checks := 0
+	for _, req := range reqs {
+		if req.Apps[0].UpdateCheck != nil {
+			checks++
+		}
+	}
+	if checks != 3 {
+		t.Errorf("expected 3 update checks, got %d", checks)
+	}
+	if app := reqs[0].Apps[0]; app.ID != testAppID || app.MachineID != "machine-id" {
+		t.Errorf("unexpected app request: %#v", app)
+	}
+
+	s.Reset()
+	s.ExpectRequests(t, 0)
+}
+
+func TestServerHTTPError(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	s.Push(&Reply{Status: http.StatusForbidden})
+	ac := newClient(t, s)
+	if _, err := ac.UpdateCheck(); err == nil {
+		t.Error("http error not reported")
+	}
+
+	// The client reports the failure in the background, which must
+	// not take the reply meant for the next update check.
+	s.Push(&Reply{Update: &omaha.Update{
+		Manifest: omaha.Manifest{Version: "1.1.0"},
+	}})
+	e := s.WaitEvent(t, testAppID, omaha.EventTypeUpdateComplete, omaha.EventResultError, 5*time.Second)
+	if e != nil && e.ErrorCode != int(client.ExitCodeOmahaRequestHTTPResponseBase)+http.StatusForbidden {
+		t.Errorf("unexpected error code %d", e.ErrorCode)
+	}
+
+	update, err := ac.UpdateCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update.Manifest.Version != "1.1.0" {
+		t.Errorf("unexpected update: %#v", update)
+	}
+	s.ExpectNoPending(t)
+	s.ExpectRequests(t, 3)
+}
+
+func TestServerMalformed(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	s.Push(&Reply{Body: []byte("<response protocol=")})
+	ac := newClient(t, s)
+	if _, err := ac.UpdateCheck(); err == nil {
+		t.Error("malformed response accepted")
+	}
+}
+
+func TestServerDelay(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	delay := 50 * time.Millisecond
+	s.Push(&Reply{Delay: delay})
+	ac := newClient(t, s)
+
+	start := time.Now()
+	if _, err := ac.UpdateCheck(); err != omaha.NoUpdate {
+		t.Errorf("expected noupdate, got %v", err)
+	}
+	if d := time.Since(start); d < delay {
+		t.Errorf("reply not delayed: %s", d)
+	}
+}
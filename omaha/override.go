@@ -0,0 +1,228 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+type OverrideAction string
+
+const (
+	// OverridePin limits matching machines to versions starting with
+	// Version, the same as if they sent it as targetversionprefix.
+	OverridePin OverrideAction = "pin"
+	// OverrideBlock offers matching machines no updates.
+	OverrideBlock OverrideAction = "block"
+	// OverrideTrack checks matching machines against Track instead of
+	// the track they asked for.
+	OverrideTrack OverrideAction = "track"
+)
+
+// Override changes how a group of machines is updated. Exactly one of
+// MachineID, CIDR, Board or OEM selects the machines. MachineID matches
+// the machineid attribute or the userid of clients that do not send one.
+// A blank AppID applies the override to every application.
+type Override struct {
+	Name      string `json:"name"`
+	AppID     string `json:"app_id,omitempty"`
+	MachineID string `json:"machine_id,omitempty"`
+	CIDR      string `json:"cidr,omitempty"`
+	Board     string `json:"board,omitempty"`
+	OEM       string `json:"oem,omitempty"`
+
+	Action  OverrideAction `json:"action"`
+	Version string         `json:"version,omitempty"`
+	Track   string         `json:"track,omitempty"`
+
+	network *net.IPNet
+}
+
+// OverrideUpdater applies overrides to requests before passing them on
+// to another Updater. When several overrides match a machine the most
+// specific one wins: machine ID, then CIDR with the longest prefix
+// first, then board, then OEM. Overrides may be changed while serving.
+type OverrideUpdater struct {
+	Updater
+
+	mu        sync.RWMutex
+	overrides []*Override
+}
+
+func NewOverrideUpdater(u Updater) *OverrideUpdater {
+	return &OverrideUpdater{Updater: u}
+}
+
+// Set adds an override, replacing any existing one with the same name.
+func (ou *OverrideUpdater) Set(o Override) error {
+	if o.Name == "" {
+		return errors.New("omaha: override has no name")
+	}
+
+	keys := 0
+	for _, k := range []string{o.MachineID, o.CIDR, o.Board, o.OEM} {
+		if k != "" {
+			keys++
+		}
+	}
+	if keys != 1 {
+		return fmt.Errorf("omaha: override %q must set exactly one of machine id, cidr, board or oem", o.Name)
+	}
+
+	if o.CIDR != "" {
+		_, network, err := net.ParseCIDR(o.CIDR)
+		if err != nil {
+			return fmt.Errorf("omaha: override %q: %v", o.Name, err)
+		}
+		o.network = network
+	}
+
+	switch o.Action {
+	case OverridePin:
+		if o.Version == "" {
+			return fmt.Errorf("omaha: override %q has no version to pin", o.Name)
+		}
+	case OverrideBlock:
+	case OverrideTrack:
+		if o.Track == "" {
+			return fmt.Errorf("omaha: override %q has no track", o.Name)
+		}
+	default:
+		return fmt.Errorf("omaha: override %q has unknown action %q", o.Name, o.Action)
+	}
+
+	ou.mu.Lock()
+	defer ou.mu.Unlock()
+
+	overrides := make([]*Override, 0, len(ou.overrides)+1)
+	for _, old := range ou.overrides {
+		if old.Name != o.Name {
+			overrides = append(overrides, old)
+		}
+	}
+	overrides = append(overrides, &o)
+	sort.SliceStable(overrides, func(i, j int) bool {
+		return overrides[i].precedence() > overrides[j].precedence()
+	})
+
+	ou.overrides = overrides
+	return nil
+}
+
+// Remove deletes an override, reporting if it existed.
+func (ou *OverrideUpdater) Remove(name string) bool {
+	ou.mu.Lock()
+	defer ou.mu.Unlock()
+
+	for i, o := range ou.overrides {
+		if o.Name == name {
+			ou.overrides = append(ou.overrides[:i:i], ou.overrides[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Overrides returns the current overrides in the order they are tried.
+func (ou *OverrideUpdater) Overrides() []Override {
+	ou.mu.RLock()
+	defer ou.mu.RUnlock()
+
+	overrides := make([]Override, len(ou.overrides))
+	for i, o := range ou.overrides {
+		overrides[i] = *o
+	}
+	return overrides
+}
+
+// Match returns the override that applies to an app, or nil if none do.
+func (ou *OverrideUpdater) Match(req *Request, app *AppRequest) *Override {
+	ou.mu.RLock()
+	defer ou.mu.RUnlock()
+
+	for _, o := range ou.overrides {
+		if o.matches(req, app) {
+			match := *o
+			return &match
+		}
+	}
+	return nil
+}
+
+func (ou *OverrideUpdater) CheckUpdate(req *Request, app *AppRequest) (*Update, error) {
+	o := ou.Match(req, app)
+	if o == nil {
+		return ou.Updater.CheckUpdate(req, app)
+	}
+
+	// Leave the original request alone for events and pings.
+	override := *app
+	if app.UpdateCheck != nil {
+		uc := *app.UpdateCheck
+		override.UpdateCheck = &uc
+	} else {
+		override.UpdateCheck = &UpdateRequest{}
+	}
+
+	switch o.Action {
+	case OverrideBlock:
+		return nil, NoUpdate
+	case OverridePin:
+		override.UpdateCheck.TargetVersionPrefix = o.Version
+	case OverrideTrack:
+		override.Track = o.Track
+	}
+
+	return ou.Updater.CheckUpdate(req, &override)
+}
+
+func (o *Override) precedence() int {
+	switch {
+	case o.MachineID != "":
+		return 1000
+	case o.network != nil:
+		ones, _ := o.network.Mask.Size()
+		return 100 + ones
+	case o.Board != "":
+		return 10
+	default:
+		return 1
+	}
+}
+
+func (o *Override) matches(req *Request, app *AppRequest) bool {
+	if o.AppID != "" && o.AppID != app.ID {
+		return false
+	}
+
+	switch {
+	case o.MachineID != "":
+		return o.MachineID == machineID(req, app)
+	case o.network != nil:
+		if req == nil {
+			return false
+		}
+		ip := net.ParseIP(req.RemoteAddr)
+		return ip != nil && o.network.Contains(ip)
+	case o.Board != "":
+		return o.Board == app.Board
+	default:
+		return o.OEM == app.OEM
+	}
+}
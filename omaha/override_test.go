@@ -0,0 +1,173 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"net/http"
+	"testing"
+)
+
+func mkOverrideCatalog(t *testing.T) *OverrideUpdater {
+	c := NewCatalog()
+	for _, tt := range []struct{ track, version string }{
+		{"stable", "1.1.0"},
+		{"stable", "1.2.0"},
+		{"beta", "2.0.0"},
+	} {
+		if err := c.AddUpdate(tt.track, mkCatalogUpdate(tt.version, "", false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.SetVersion(testAppID, "stable", "1.2.0"); err != nil {
+		t.Fatal(err)
+	}
+	return NewOverrideUpdater(c)
+}
+
+func checkOverride(ou *OverrideUpdater, addr, machine, board, oem string) string {
+	req := &Request{RemoteAddr: addr}
+	app := mkCatalogApp("1.0.0", false)
+	app.MachineID = machine
+	app.Board = board
+	app.OEM = oem
+	u, err := ou.CheckUpdate(req, app)
+	if err == NoUpdate {
+		return "noupdate"
+	} else if err != nil {
+		return err.Error()
+	}
+	return u.Manifest.Version
+}
+
+func TestOverrideUpdater(t *testing.T) {
+	ou := mkOverrideCatalog(t)
+	for _, o := range []Override{
+		{Name: "oem", OEM: "ami", Action: OverridePin, Version: "1.1"},
+		{Name: "board", Board: "arm64-usr", Action: OverrideBlock},
+		{Name: "lab", CIDR: "10.0.0.0/8", Action: OverrideTrack, Track: "beta"},
+		{Name: "lab-hold", CIDR: "10.1.0.0/16", Action: OverrideBlock},
+		{Name: "tester", MachineID: "tester", Action: OverrideTrack, Track: "beta"},
+		{Name: "other-app", AppID: "{00000000-0000-0000-0000-000000000000}",
+			OEM: "gce", Action: OverrideBlock},
+	} {
+		if err := ou.Set(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		addr, machine, board, oem string
+		expect                    string
+	}{
+		{"192.168.0.1", "", "", "", "1.2.0"},
+		{"192.168.0.1", "", "", "ami", "1.1.0"},
+		{"192.168.0.1", "", "arm64-usr", "ami", "noupdate"},
+		{"10.0.0.1", "", "arm64-usr", "", "2.0.0"},
+		{"10.1.0.1", "", "", "", "noupdate"},
+		{"10.1.0.1", "tester", "", "", "2.0.0"},
+		{"192.168.0.1", "", "", "gce", "1.2.0"},
+	} {
+		got := checkOverride(ou, tt.addr, tt.machine, tt.board, tt.oem)
+		if got != tt.expect {
+			t.Errorf("%+v: got %s", tt, got)
+		}
+	}
+
+	if !ou.Remove("board") || ou.Remove("board") {
+		t.Error("unexpected remove result")
+	}
+	if got := checkOverride(ou, "192.168.0.1", "", "arm64-usr", ""); got != "1.2.0" {
+		t.Errorf("removed override still applied: %s", got)
+	}
+
+	// Replacing keeps the name unique.
+	if err := ou.Set(Override{Name: "oem", OEM: "ami", Action: OverrideBlock}); err != nil {
+		t.Fatal(err)
+	}
+	if got := checkOverride(ou, "192.168.0.1", "", "", "ami"); got != "noupdate" {
+		t.Errorf("replaced override not applied: %s", got)
+	}
+	if n := len(ou.Overrides()); n != 5 {
+		t.Errorf("expected 5 overrides, got %d", n)
+	}
+}
+
+func TestOverrideUpdaterInvalid(t *testing.T) {
+	ou := NewOverrideUpdater(UpdaterStub{})
+	for _, o := range []Override{
+		{OEM: "ami", Action: OverrideBlock},
+		{Name: "none", Action: OverrideBlock},
+		{Name: "two", OEM: "ami", Board: "amd64-usr", Action: OverrideBlock},
+		{Name: "cidr", CIDR: "10.0.0.1", Action: OverrideBlock},
+		{Name: "pin", OEM: "ami", Action: OverridePin},
+		{Name: "track", OEM: "ami", Action: OverrideTrack},
+		{Name: "bogus", OEM: "ami", Action: "bogus"},
+	} {
+		if err := ou.Set(o); err == nil {
+			t.Errorf("invalid override accepted: %+v", o)
+		}
+	}
+}
+
+func TestOverrideUpdaterUnchanged(t *testing.T) {
+	ou := mkOverrideCatalog(t)
+	if err := ou.Set(Override{Name: "pin", OEM: "ami", Action: OverridePin, Version: "1.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	app := mkCatalogApp("1.0.0", false)
+	app.OEM = "ami"
+	if _, err := ou.CheckUpdate(nil, app); err != nil {
+		t.Fatal(err)
+	}
+	if app.UpdateCheck.TargetVersionPrefix != "" {
+		t.Error("override modified the original request")
+	}
+}
+
+func TestAdminOverrides(t *testing.T) {
+	ou := mkOverrideCatalog(t)
+	h := NewAdminHandler(NewCatalog(), testAdminToken)
+	h.Overrides = ou
+
+	for _, tt := range []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"GET", "overrides", "", http.StatusOK},
+		{"PUT", "overrides/lab", `{"cidr": "10.0.0.0/8", "action": "block"}`, http.StatusOK},
+		{"PUT", "overrides/bad", `{"cidr": "10.0.0.0/8", "action": "pin"}`, http.StatusBadRequest},
+		{"DELETE", "overrides/nope", "", http.StatusNotFound},
+		{"POST", "overrides/lab", "", http.StatusMethodNotAllowed},
+	} {
+		w := adminDo(h, testAdminToken, tt.method, tt.path, tt.body)
+		if w.Code != tt.code {
+			t.Errorf("%s %s: expected %d, got %d: %s", tt.method, tt.path, tt.code, w.Code, w.Body)
+		}
+	}
+
+	if got := checkOverride(ou, "10.0.0.1", "", "", ""); got != "noupdate" {
+		t.Errorf("override not applied: %s", got)
+	}
+
+	if w := adminDo(h, testAdminToken, "DELETE", "overrides/lab", ""); w.Code != http.StatusNoContent {
+		t.Errorf("delete failed: %d %s", w.Code, w.Body)
+	}
+	if n := len(ou.Overrides()); n != 0 {
+		t.Errorf("expected no overrides, got %d", n)
+	}
+}
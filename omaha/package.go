@@ -36,6 +36,8 @@ type Package struct {
 	SHA256   string `xml:"hash_sha256,attr,omitempty"`
 	Size     uint64 `xml:"size,attr"`
 	Required bool   `xml:"required,attr"`
+
+	Extensions
 }
 
 func (p *Package) FromPath(name string) error {
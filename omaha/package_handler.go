@@ -0,0 +1,164 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PackageHandler serves a single package file. Range requests are
+// supported so clients can resume interrupted downloads. If Package is
+// set its hashes are sent as a strong ETag and as Digest and
+// Content-Digest headers.
+type PackageHandler struct {
+	Path    string
+	Package *Package
+
+	// CacheControl, if not blank, is sent as the Cache-Control header.
+	CacheControl string
+
+	// RateLimit limits each download to this many bytes per second.
+	// Zero is unlimited.
+	RateLimit int64
+}
+
+func NewPackageHandler(path string, pkg *Package) *PackageHandler {
+	return &PackageHandler{Path: path, Package: pkg}
+}
+
+func (ph *PackageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if ph.Path == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Expected a GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	f, err := os.Open(ph.Path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	ph.serve(w, r, filepath.Base(ph.Path), fi.ModTime(), f)
+}
+
+// serve sends content with the handler's headers and rate limit.
+func (ph *PackageHandler) serve(w http.ResponseWriter, r *http.Request, name string, modtime time.Time, content io.ReadSeeker) {
+	h := w.Header()
+	if ph.CacheControl != "" {
+		h.Set("Cache-Control", ph.CacheControl)
+	}
+	if ph.Package != nil {
+		ph.setDigests(h, r.Header.Get("Range") == "")
+	}
+
+	if ph.RateLimit > 0 {
+		w = &rateLimitedWriter{
+			ResponseWriter: w,
+			rate:           ph.RateLimit,
+			start:          time.Now(),
+		}
+	}
+
+	// ServeContent handles ranges and conditional requests using the
+	// ETag set above.
+	http.ServeContent(w, r, name, modtime, content)
+}
+
+// setDigests adds the package's hashes to the headers. Content-Digest
+// describes the response body so it is only sent for full responses,
+// Digest describes the whole file and is always valid.
+func (ph *PackageHandler) setDigests(h http.Header, full bool) {
+	var digests []string
+	if sum, err := base64.StdEncoding.DecodeString(ph.Package.SHA256); err == nil && len(sum) != 0 {
+		h.Set("ETag", `"`+hex.EncodeToString(sum)+`"`)
+		digests = append(digests, "sha-256="+ph.Package.SHA256)
+		if full {
+			h.Set("Content-Digest", "sha-256=:"+ph.Package.SHA256+":")
+		}
+	}
+	if ph.Package.SHA1 != "" {
+		digests = append(digests, "sha="+ph.Package.SHA1)
+	}
+	if len(digests) != 0 {
+		h.Set("Digest", strings.Join(digests, ","))
+	}
+}
+
+// rateLimitedWriter slows writes to the given bytes per second.
+type rateLimitedWriter struct {
+	http.ResponseWriter
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+func (w *rateLimitedWriter) Write(b []byte) (int, error) {
+	// Write in small chunks so the rate is smooth rather than bursty.
+	chunk := int(w.rate / 10)
+	if chunk < 1 {
+		chunk = 1
+	}
+
+	total := 0
+	for len(b) != 0 {
+		n := chunk
+		if n > len(b) {
+			n = len(b)
+		}
+
+		n, err := w.ResponseWriter.Write(b[:n])
+		total += n
+		w.written += int64(n)
+		if err != nil {
+			return total, err
+		}
+		b = b[n:]
+
+		due := w.start.Add(rateDuration(w.written, w.rate))
+		if d := time.Until(due); d > 0 {
+			time.Sleep(d)
+		}
+	}
+
+	return total, nil
+}
+
+// rateDuration is how long sending n bytes at rate bytes per second
+// takes. Whole seconds are split off first so n * time.Second cannot
+// overflow for payloads over about 9GB.
+func rateDuration(n, rate int64) time.Duration {
+	return time.Duration(n/rate)*time.Second +
+		time.Duration(n%rate)*time.Second/time.Duration(rate)
+}
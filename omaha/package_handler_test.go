@@ -0,0 +1,167 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestPackageHandler(t *testing.T, data []byte) (*PackageHandler, func()) {
+	f, err := ioutil.TempFile("", "go-omaha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		t.Fatal(err)
+	}
+
+	pkg := &Package{}
+	if err := pkg.FromPath(f.Name()); err != nil {
+		os.Remove(f.Name())
+		t.Fatal(err)
+	}
+
+	return NewPackageHandler(f.Name(), pkg), func() { os.Remove(f.Name()) }
+}
+
+func servePackage(h http.Handler, method string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/packages/update.gz", nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestPackageHandlerHeaders(t *testing.T) {
+	h, cleanup := newTestPackageHandler(t, []byte("test"))
+	defer cleanup()
+	h.CacheControl = "public, max-age=60"
+
+	w := servePackage(h, "GET", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "test" {
+		t.Fatalf("unexpected response: %d %q", w.Code, w.Body.String())
+	}
+
+	// sha256("test")
+	hexsum := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	for header, want := range map[string]string{
+		"ETag":           `"` + hexsum + `"`,
+		"Digest":         "sha-256=" + h.Package.SHA256 + ",sha=" + h.Package.SHA1,
+		"Content-Digest": "sha-256=:" + h.Package.SHA256 + ":",
+		"Cache-Control":  "public, max-age=60",
+		"Accept-Ranges":  "bytes",
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("%s: expected %q, got %q", header, want, got)
+		}
+	}
+
+	w = servePackage(h, "GET", http.Header{"If-None-Match": {`"` + hexsum + `"`}})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("expected 304, got %d", w.Code)
+	}
+
+	w = servePackage(h, "HEAD", nil)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("unexpected HEAD response: %d %q", w.Code, w.Body.String())
+	}
+
+	w = servePackage(h, "POST", nil)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", w.Code)
+	}
+}
+
+func TestPackageHandlerRange(t *testing.T) {
+	h, cleanup := newTestPackageHandler(t, []byte("0123456789"))
+	defer cleanup()
+
+	w := servePackage(h, "GET", http.Header{"Range": {"bytes=4-"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "456789" {
+		t.Fatalf("unexpected response: %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Digest") != "" {
+		t.Error("Content-Digest sent with a partial response")
+	}
+	if !strings.HasPrefix(w.Header().Get("Digest"), "sha-256=") {
+		t.Error("Digest missing from a partial response")
+	}
+
+	// Resuming against a different file must start over.
+	w = servePackage(h, "GET", http.Header{
+		"Range":    {"bytes=4-"},
+		"If-Range": {`"0000"`},
+	})
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Errorf("unexpected response: %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestPackageHandlerNotFound(t *testing.T) {
+	for _, h := range []*PackageHandler{
+		{},
+		{Path: "/does/not/exist"},
+	} {
+		if w := servePackage(h, "GET", nil); w.Code != http.StatusNotFound {
+			t.Errorf("%q: expected 404, got %d", h.Path, w.Code)
+		}
+	}
+}
+
+func TestPackageHandlerRateLimit(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 2000)
+	h, cleanup := newTestPackageHandler(t, data)
+	defer cleanup()
+	h.RateLimit = 10000
+
+	start := time.Now()
+	w := servePackage(h, "GET", nil)
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatal("unexpected body")
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Errorf("2000 bytes at 10000 B/s took only %s", d)
+	}
+}
+
+func TestRateDuration(t *testing.T) {
+	for _, tt := range []struct {
+		n, rate int64
+		d       time.Duration
+	}{
+		{0, 1000, 0},
+		{500, 1000, 500 * time.Millisecond},
+		{2500, 1000, 2500 * time.Millisecond},
+		// n * time.Second overflows int64 past ~9.2GB
+		{20 << 30, 1 << 20, 20480 * time.Second},
+		{20<<30 + 1<<19, 1 << 20, 20480*time.Second + 500*time.Millisecond},
+	} {
+		if d := rateDuration(tt.n, tt.rate); d != tt.d {
+			t.Errorf("%d bytes at %d B/s: expected %s, got %s", tt.n, tt.rate, tt.d, d)
+		}
+	}
+}
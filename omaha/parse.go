@@ -63,7 +63,8 @@ func parseReqOrResp(r io.Reader, v interface{}) error {
 		panic(fmt.Errorf("unexpected type %T", v))
 	}
 
-	if protocol != "3.0" {
+	// 3.1 is a compatible extension of 3.0, adding rollback support.
+	if protocol != "3.0" && protocol != "3.1" {
 		return fmt.Errorf("unsupported omaha protocol: %q", protocol)
 	}
 
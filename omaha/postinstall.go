@@ -0,0 +1,151 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var (
+	NoPostinstallError = errors.New("omaha: manifest has no postinstall action")
+	NoManifestError    = errors.New("omaha: update has no manifest")
+)
+
+// ActionError reports an invalid attribute in an update_engine style
+// postinstall action. Attr is the XML attribute name.
+type ActionError struct {
+	Attr string
+	Err  error
+}
+
+func (e *ActionError) Error() string {
+	return fmt.Sprintf("omaha: invalid postinstall %s: %v", e.Attr, e.Err)
+}
+
+// PostinstallAction returns the action update_engine uses to extend the
+// manifest with extra package metadata, or nil if there is none.
+func (m *Manifest) PostinstallAction() *Action {
+	for _, a := range m.Actions {
+		if a.Event == "postinstall" {
+			return a
+		}
+	}
+	return nil
+}
+
+// PostinstallAction returns the manifest's postinstall action, if any.
+func (u *UpdateResponse) PostinstallAction() *Action {
+	if u.Manifest == nil {
+		return nil
+	}
+	return u.Manifest.PostinstallAction()
+}
+
+// DecodeSHA256 decodes the base64 encoded SHA-256 hash of the payload.
+// A missing hash is returned as nil.
+func (a *Action) DecodeSHA256() ([]byte, error) {
+	if a.SHA256 == "" {
+		return nil, nil
+	}
+	sum, err := base64.StdEncoding.DecodeString(a.SHA256)
+	if err != nil {
+		return nil, &ActionError{"sha256", err}
+	}
+	if len(sum) != sha256.Size {
+		return nil, &ActionError{"sha256", fmt.Errorf("hash is %d bytes, not %d", len(sum), sha256.Size)}
+	}
+	return sum, nil
+}
+
+// DecodeMetadataSignature decodes the base64 encoded payload metadata
+// signature. A missing signature is returned as nil.
+func (a *Action) DecodeMetadataSignature() ([]byte, error) {
+	if a.MetadataSignatureRsa == "" {
+		return nil, nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(a.MetadataSignatureRsa)
+	if err != nil {
+		return nil, &ActionError{"MetadataSignatureRsa", err}
+	}
+	return sig, nil
+}
+
+// DecodeMetadataSize parses the size of the payload metadata.
+// A missing size is returned as 0.
+func (a *Action) DecodeMetadataSize() (uint64, error) {
+	if a.MetadataSize == "" {
+		return 0, nil
+	}
+	size, err := strconv.ParseUint(a.MetadataSize, 10, 64)
+	if err != nil {
+		return 0, &ActionError{"MetadataSize", err}
+	}
+	return size, nil
+}
+
+// ValidatePostinstall checks that the postinstall action can be decoded
+// and agrees with the manifest's first package, the update payload.
+func (m *Manifest) ValidatePostinstall() error {
+	act := m.PostinstallAction()
+	if act == nil {
+		return NoPostinstallError
+	}
+
+	sum, err := act.DecodeSHA256()
+	if err != nil {
+		return err
+	}
+
+	if _, err := act.DecodeMetadataSignature(); err != nil {
+		return err
+	}
+
+	if _, err := act.PayloadSignature(); err != nil {
+		return err
+	}
+
+	size, err := act.DecodeMetadataSize()
+	if err != nil {
+		return err
+	}
+
+	if len(m.Packages) == 0 {
+		return nil
+	}
+	pkg := m.Packages[0]
+
+	if sum != nil && pkg.SHA256 != "" &&
+		pkg.SHA256 != base64.StdEncoding.EncodeToString(sum) {
+		return &ActionError{"sha256", PackageHashMismatchError}
+	}
+
+	if size > pkg.Size {
+		return &ActionError{"MetadataSize", PackageSizeMismatchError}
+	}
+
+	return nil
+}
+
+// ValidatePostinstall checks the manifest's postinstall action.
+func (u *UpdateResponse) ValidatePostinstall() error {
+	if u.Manifest == nil {
+		return NoManifestError
+	}
+	return u.Manifest.ValidatePostinstall()
+}
@@ -0,0 +1,122 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestPostinstallAction(t *testing.T) {
+	r, err := ParseResponse("", strings.NewReader(sampleResponse))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := r.Apps[0].UpdateCheck
+	act := u.PostinstallAction()
+	if act == nil {
+		t.Fatal("postinstall action not found")
+	}
+
+	sum, err := act.DecodeSHA256()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base64.StdEncoding.EncodeToString(sum) != act.SHA256 {
+		t.Errorf("decoded hash %x does not match %s", sum, act.SHA256)
+	}
+
+	if err := u.ValidatePostinstall(); err != nil {
+		t.Error(err)
+	}
+
+	if (&UpdateResponse{}).PostinstallAction() != nil {
+		t.Error("found postinstall action without a manifest")
+	}
+}
+
+func TestActionDecode(t *testing.T) {
+	act := &Action{
+		Event:                "postinstall",
+		MetadataSignatureRsa: "c2lnbmF0dXJl",
+		MetadataSize:         "1234",
+	}
+
+	if sum, err := act.DecodeSHA256(); sum != nil || err != nil {
+		t.Errorf("missing hash decoded as %x, %v", sum, err)
+	}
+
+	sig, err := act.DecodeMetadataSignature()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sig, []byte("signature")) {
+		t.Errorf("unexpected signature %q", sig)
+	}
+
+	size, err := act.DecodeMetadataSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 1234 {
+		t.Errorf("unexpected size %d", size)
+	}
+
+	act.SHA256 = "c2hvcnQ="
+	if _, err := act.DecodeSHA256(); err == nil {
+		t.Error("short hash was accepted")
+	}
+}
+
+func TestValidatePostinstall(t *testing.T) {
+	m := &Manifest{Version: "1.0.0"}
+	if err := m.ValidatePostinstall(); err != NoPostinstallError {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	pkg, err := m.AddPackageFromPath("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	act := m.AddAction("postinstall")
+	act.SHA256 = pkg.SHA256
+	if err := m.ValidatePostinstall(); err != nil {
+		t.Error(err)
+	}
+
+	act.SHA256 = "EqYfThc/s6EcBdZHH3Ryj3YjG0pfzZZnzvOvh6OuTcI="
+	err = m.ValidatePostinstall()
+	if ae, ok := err.(*ActionError); !ok || ae.Err != PackageHashMismatchError {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	act.SHA256 = pkg.SHA256
+	act.MetadataSize = "1"
+	err = m.ValidatePostinstall()
+	if ae, ok := err.(*ActionError); !ok || ae.Err != PackageSizeMismatchError {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	act.MetadataSize = ""
+	act.SetAttr(PayloadSignatureAttr, "not base64!")
+	err = m.ValidatePostinstall()
+	if ae, ok := err.(*ActionError); !ok || ae.Attr != PayloadSignatureAttr {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
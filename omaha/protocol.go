@@ -43,6 +43,15 @@ type Request struct {
 
 	// update engine extension, duplicates the version attribute.
 	UpdaterVersion string `xml:"updaterversion,attr,omitempty"`
+
+	// RemoteAddr is the client's IP address, filled in by OmahaHandler.
+	RemoteAddr string `xml:"-"`
+
+	// Identity is the authenticated client, filled in by OmahaHandler
+	// if it has an Authenticator and the credentials are valid.
+	Identity *Identity `xml:"-"`
+
+	Extensions
 }
 
 func NewRequest() *Request {
@@ -111,6 +120,8 @@ type AppRequest struct {
 	MachineID    string `xml:"machineid,attr,omitempty"`
 	OEM          string `xml:"oem,attr,omitempty"`
 	OEMVersion   string `xml:"oemversion,attr,omitempty"`
+
+	Extensions
 }
 
 func (a *AppRequest) AddUpdateCheck() *UpdateRequest {
@@ -131,12 +142,19 @@ func (a *AppRequest) AddEvent() *EventRequest {
 
 type UpdateRequest struct {
 	TargetVersionPrefix string `xml:"targetversionprefix,attr,omitempty"`
+
+	// protocol 3.1, client accepts updates to older versions.
+	RollbackAllowed bool `xml:"rollback_allowed,attr,omitempty"`
+
+	Extensions
 }
 
 type PingRequest struct {
 	Active               int  `xml:"active,attr,omitempty"`
 	LastActiveReportDays *int `xml:"a,attr,omitempty"`
 	LastReportDays       int  `xml:"r,attr,omitempty"`
+
+	Extensions
 }
 
 type EventRequest struct {
@@ -145,6 +163,8 @@ type EventRequest struct {
 	ErrorCode       int         `xml:"errorcode,attr,omitempty"`
 	NextVersion     string      `xml:"nextversion,attr,omitempty"`
 	PreviousVersion string      `xml:"previousversion,attr,omitempty"`
+
+	Extensions
 }
 
 // Response sent by the Omaha server
@@ -154,6 +174,8 @@ type Response struct {
 	Apps     []*AppResponse `xml:"app"`
 	Protocol string         `xml:"protocol,attr"`
 	Server   string         `xml:"server,attr"`
+
+	Extensions
 }
 
 func NewResponse() *Response {
@@ -182,6 +204,8 @@ func ParseResponse(contentType string, body io.Reader) (*Response, error) {
 
 type DayStart struct {
 	ElapsedSeconds string `xml:"elapsed_seconds,attr"`
+
+	Extensions
 }
 
 func (r *Response) AddApp(id string, status AppStatus) *AppResponse {
@@ -205,6 +229,8 @@ type AppResponse struct {
 	Events      []*EventResponse `xml:"event" json:",omitempty"`
 	ID          string           `xml:"appid,attr,omitempty"`
 	Status      AppStatus        `xml:"status,attr,omitempty"`
+
+	Extensions
 }
 
 func (a *AppResponse) AddUpdateCheck(status UpdateStatus) *UpdateResponse {
@@ -213,12 +239,12 @@ func (a *AppResponse) AddUpdateCheck(status UpdateStatus) *UpdateResponse {
 }
 
 func (a *AppResponse) AddPing() *PingResponse {
-	a.Ping = &PingResponse{"ok"}
+	a.Ping = &PingResponse{Status: "ok"}
 	return a.Ping
 }
 
 func (a *AppResponse) AddEvent() *EventResponse {
-	event := &EventResponse{"ok"}
+	event := &EventResponse{Status: "ok"}
 	a.Events = append(a.Events, event)
 	return event
 }
@@ -227,6 +253,11 @@ type UpdateResponse struct {
 	URLs     []*URL       `xml:"urls>url" json:",omitempty"`
 	Manifest *Manifest    `xml:"manifest"`
 	Status   UpdateStatus `xml:"status,attr,omitempty"`
+
+	// update engine extension, the update is to an older version.
+	Rollback bool `xml:"_rollback,attr,omitempty"`
+
+	Extensions
 }
 
 func (u *UpdateResponse) AddURL(codebase string) *URL {
@@ -242,10 +273,14 @@ func (u *UpdateResponse) AddManifest(version string) *Manifest {
 
 type PingResponse struct {
 	Status string `xml:"status,attr"` // Always "ok".
+
+	Extensions
 }
 
 type EventResponse struct {
 	Status string `xml:"status,attr"` // Always "ok".
+
+	Extensions
 }
 
 type OS struct {
@@ -253,16 +288,22 @@ type OS struct {
 	Version     string `xml:"version,attr,omitempty"`
 	ServicePack string `xml:"sp,attr,omitempty"`
 	Arch        string `xml:"arch,attr,omitempty"`
+
+	Extensions
 }
 
 type URL struct {
 	CodeBase string `xml:"codebase,attr"`
+
+	Extensions
 }
 
 type Manifest struct {
 	Packages []*Package `xml:"packages>package"`
 	Actions  []*Action  `xml:"actions>action"`
 	Version  string     `xml:"version,attr"`
+
+	Extensions
 }
 
 func (m *Manifest) AddPackage() *Package {
@@ -272,8 +313,14 @@ func (m *Manifest) AddPackage() *Package {
 }
 
 func (m *Manifest) AddPackageFromPath(path string) (*Package, error) {
+	return m.AddPackageFromPathCached(path, nil)
+}
+
+// AddPackageFromPathCached is AddPackageFromPath using hashes remembered
+// by the cache, which may be nil.
+func (m *Manifest) AddPackageFromPathCached(path string, hc *HashCache) (*Package, error) {
 	p := &Package{}
-	if err := p.FromPath(path); err != nil {
+	if err := hc.FromPath(p, path); err != nil {
 		return nil, err
 	}
 	m.Packages = append(m.Packages, p)
@@ -301,4 +348,6 @@ type Action struct {
 	Deadline              string `xml:"deadline,attr,omitempty"`
 	MoreInfo              string `xml:"MoreInfo,attr,omitempty"`
 	Prompt                bool   `xml:"Prompt,attr,omitempty"`
+
+	Extensions
 }
@@ -120,7 +120,7 @@ func TestOmahaResponseWithUpdate(t *testing.T) {
 		Apps: []*AppResponse{&AppResponse{
 			ID:     "{87efface-864d-49a5-9bb3-4b050a7c227a}",
 			Status: AppOK,
-			Ping:   &PingResponse{"ok"},
+			Ping:   &PingResponse{Status: "ok"},
 			UpdateCheck: &UpdateResponse{
 				Status: UpdateOK,
 				URLs: []*URL{&URL{
@@ -146,7 +146,7 @@ func TestOmahaResponseWithUpdate(t *testing.T) {
 	}
 
 	if !reflect.DeepEqual(parsed, expected) {
-		t.Errorf("parsed != expected\n%s\n%s", parsed, expected)
+		t.Errorf("parsed != expected\n%#v\n%#v", parsed, expected)
 	}
 }
 
@@ -0,0 +1,217 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimit allows Rate requests per second on average with bursts of
+// up to Burst requests. A zero Rate is unlimited.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// Limits protects a server from misbehaving clients. Zero values are
+// unlimited.
+type Limits struct {
+	// PerIP limits requests from each remote address.
+	PerIP RateLimit `json:"per_ip"`
+
+	// PerMachine limits requests for each machine ID, or user ID
+	// for clients that do not send one. When clients must authenticate
+	// only machines the credentials allow are charged, anything else is
+	// charged to PerIP again so made up IDs cannot dodge it.
+	PerMachine RateLimit `json:"per_machine"`
+
+	// MaxApps limits the apps in a single request.
+	MaxApps int `json:"max_apps"`
+
+	// MaxEvents limits the events, over all apps, in a single request.
+	MaxEvents int `json:"max_events"`
+}
+
+// LimitStats counts requests accepted and rejected by a Limiter.
+type LimitStats struct {
+	Allowed         uint64 `json:"allowed"`
+	RejectedIP      uint64 `json:"rejected_ip"`
+	RejectedMachine uint64 `json:"rejected_machine"`
+	RejectedApps    uint64 `json:"rejected_apps"`
+	RejectedEvents  uint64 `json:"rejected_events"`
+}
+
+// Limiter enforces Limits for OmahaHandler.
+type Limiter struct {
+	limits   Limits
+	ips      *tokenBuckets
+	machines *tokenBuckets
+	stats    LimitStats
+}
+
+func NewLimiter(limits Limits) *Limiter {
+	return &Limiter{
+		limits:   limits,
+		ips:      newTokenBuckets(limits.PerIP),
+		machines: newTokenBuckets(limits.PerMachine),
+	}
+}
+
+// Limits returns the limits being enforced.
+func (l *Limiter) Limits() Limits {
+	return l.limits
+}
+
+// Stats returns the counts of accepted and rejected requests so far.
+func (l *Limiter) Stats() LimitStats {
+	return LimitStats{
+		Allowed:         atomic.LoadUint64(&l.stats.Allowed),
+		RejectedIP:      atomic.LoadUint64(&l.stats.RejectedIP),
+		RejectedMachine: atomic.LoadUint64(&l.stats.RejectedMachine),
+		RejectedApps:    atomic.LoadUint64(&l.stats.RejectedApps),
+		RejectedEvents:  atomic.LoadUint64(&l.stats.RejectedEvents),
+	}
+}
+
+// allowIP is checked before a request is parsed, reporting how long to
+// wait if it is rejected.
+func (l *Limiter) allowIP(ip string) (bool, time.Duration) {
+	ok, wait := l.ips.take(ip, time.Now())
+	if !ok {
+		atomic.AddUint64(&l.stats.RejectedIP, 1)
+	}
+	return ok, wait
+}
+
+// allowRequest checks a parsed request. If auth is set clients must
+// authenticate and only the machines their identity allows are charged.
+// Too many apps or events is reported as ok but oversized.
+func (l *Limiter) allowRequest(req *Request, auth bool) (ok, oversized bool, wait time.Duration) {
+	if l.limits.MaxApps > 0 && len(req.Apps) > l.limits.MaxApps {
+		atomic.AddUint64(&l.stats.RejectedApps, 1)
+		return false, true, 0
+	}
+
+	if l.limits.MaxEvents > 0 {
+		events := 0
+		for _, app := range req.Apps {
+			events += len(app.Events)
+		}
+		if events > l.limits.MaxEvents {
+			atomic.AddUint64(&l.stats.RejectedEvents, 1)
+			return false, true, 0
+		}
+	}
+
+	// Each machine is charged once per request. Unauthenticated
+	// clients choose their own IDs, so charge their address instead.
+	now := time.Now()
+	seen := make(map[string]bool)
+	for _, app := range req.Apps {
+		id := machineID(req, app)
+		if id == "" || seen[id] || (auth && !req.Identity.Allows(req, app)) {
+			continue
+		}
+		seen[id] = true
+		if ok, wait := l.machines.take(id, now); !ok {
+			atomic.AddUint64(&l.stats.RejectedMachine, 1)
+			return false, false, wait
+		}
+	}
+
+	if auth && len(seen) == 0 {
+		if ok, wait := l.ips.take(req.RemoteAddr, now); !ok {
+			atomic.AddUint64(&l.stats.RejectedIP, 1)
+			return false, false, wait
+		}
+	}
+
+	atomic.AddUint64(&l.stats.Allowed, 1)
+	return true, false, 0
+}
+
+// tokenBuckets is a set of token buckets sharing one RateLimit.
+type tokenBuckets struct {
+	limit RateLimit
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBuckets(limit RateLimit) *tokenBuckets {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &tokenBuckets{
+		limit:   limit,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// take removes a token from key's bucket, or reports how long until
+// one will be available.
+func (tb *tokenBuckets) take(key string, now time.Time) (bool, time.Duration) {
+	if tb.limit.Rate <= 0 {
+		return true, 0
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.sweep(now)
+
+	b, ok := tb.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(tb.limit.Burst), last: now}
+		tb.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(tb.limit.Burst),
+		b.tokens+now.Sub(b.last).Seconds()*tb.limit.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / tb.limit.Rate * float64(time.Second))
+		return false, wait
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets buckets that have refilled, since a new bucket is the
+// same as a full one. Runs at most once a minute.
+func (tb *tokenBuckets) sweep(now time.Time) {
+	if now.Sub(tb.lastSweep) < time.Minute {
+		return
+	}
+	tb.lastSweep = now
+
+	refill := time.Duration(float64(tb.limit.Burst) / tb.limit.Rate * float64(time.Second))
+	for key, b := range tb.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(tb.buckets, key)
+		}
+	}
+}
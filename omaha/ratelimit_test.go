@@ -0,0 +1,172 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBuckets(t *testing.T) {
+	tb := newTokenBuckets(RateLimit{Rate: 2, Burst: 3})
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := tb.take("a", now); !ok {
+			t.Fatalf("burst request %d rejected", i)
+		}
+	}
+	ok, wait := tb.take("a", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("expected rejection for 500ms, got %t %s", ok, wait)
+	}
+	if ok, _ := tb.take("b", now); !ok {
+		t.Error("other key rejected")
+	}
+
+	if ok, _ := tb.take("a", now.Add(500*time.Millisecond)); !ok {
+		t.Error("refilled token rejected")
+	}
+
+	// Idle buckets are forgotten.
+	tb.take("c", now.Add(time.Hour))
+	if len(tb.buckets) != 1 {
+		t.Errorf("expected 1 bucket, got %d", len(tb.buckets))
+	}
+}
+
+func TestTokenBucketsUnlimited(t *testing.T) {
+	tb := newTokenBuckets(RateLimit{})
+	for i := 0; i < 100; i++ {
+		if ok, _ := tb.take("a", time.Now()); !ok {
+			t.Fatal("unlimited request rejected")
+		}
+	}
+}
+
+func serveLimited(h http.Handler, addr string, req *Request) *httptest.ResponseRecorder {
+	body, _ := xml.Marshal(req)
+	httpReq := httptest.NewRequest("POST", "/v1/update/", bytes.NewReader(body))
+	httpReq.RemoteAddr = addr
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httpReq)
+	return w
+}
+
+func mkLimitedRequest(machineID string, apps, events int) *Request {
+	req := NewRequest()
+	req.UserID = machineID
+	for i := 0; i < apps; i++ {
+		app := req.AddApp(testAppID, testAppVer)
+		for j := 0; j < events; j++ {
+			app.AddEvent()
+		}
+	}
+	return req
+}
+
+func TestHandleLimits(t *testing.T) {
+	limiter := NewLimiter(Limits{
+		PerIP:      RateLimit{Rate: 0.001, Burst: 3},
+		PerMachine: RateLimit{Rate: 0.001, Burst: 1},
+		MaxApps:    2,
+		MaxEvents:  2,
+	})
+	handler := &OmahaHandler{Updater: UpdaterStub{}, Limiter: limiter}
+
+	for _, tt := range []struct {
+		addr string
+		req  *Request
+		code int
+	}{
+		{"192.0.2.1:1", mkLimitedRequest("m1", 1, 1), http.StatusOK},
+		{"192.0.2.1:2", mkLimitedRequest("m1", 1, 1), http.StatusTooManyRequests},
+		{"192.0.2.1:3", mkLimitedRequest("m2", 3, 0), http.StatusRequestEntityTooLarge},
+		{"192.0.2.1:4", mkLimitedRequest("m2", 1, 1), http.StatusTooManyRequests},
+		{"192.0.2.2:1", mkLimitedRequest("m2", 2, 2), http.StatusRequestEntityTooLarge},
+		{"192.0.2.2:2", mkLimitedRequest("m2", 2, 0), http.StatusOK},
+	} {
+		w := serveLimited(handler, tt.addr, tt.req)
+		if w.Code != tt.code {
+			t.Errorf("%s %s: expected %d, got %d", tt.addr, tt.req.UserID, tt.code, w.Code)
+		}
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: no Retry-After", tt.addr)
+		}
+	}
+
+	expect := LimitStats{
+		Allowed:         2,
+		RejectedIP:      1,
+		RejectedMachine: 1,
+		RejectedApps:    1,
+		RejectedEvents:  1,
+	}
+	if stats := limiter.Stats(); stats != expect {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestHandleLimitsAuth(t *testing.T) {
+	limiter := NewLimiter(Limits{
+		PerIP:      RateLimit{Rate: 0.001, Burst: 4},
+		PerMachine: RateLimit{Rate: 0.001, Burst: 1},
+	})
+	handler := &OmahaHandler{
+		Updater: UpdaterStub{},
+		Auth:    NewTokenAuth("secret"),
+		Limiter: limiter,
+	}
+
+	for _, tt := range []struct {
+		addr  string
+		token string
+		id    string
+		code  int
+	}{
+		// Unauthenticated requests are charged to their address
+		// twice, not to the machine IDs they claim.
+		{"192.0.2.1:1", "", "m1", http.StatusForbidden},
+		{"192.0.2.2:1", "secret", "m1", http.StatusOK},
+		{"192.0.2.2:2", "secret", "m1", http.StatusTooManyRequests},
+		{"192.0.2.1:2", "wrong", "m2", http.StatusForbidden},
+		{"192.0.2.1:3", "", "m3", http.StatusTooManyRequests},
+	} {
+		body, _ := xml.Marshal(mkLimitedRequest(tt.id, 1, 0))
+		httpReq := httptest.NewRequest("POST", "/v1/update/", bytes.NewReader(body))
+		httpReq.RemoteAddr = tt.addr
+		if tt.token != "" {
+			httpReq.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httpReq)
+		if w.Code != tt.code {
+			t.Errorf("%s %s: expected %d, got %d", tt.addr, tt.id, tt.code, w.Code)
+		}
+	}
+
+	expect := LimitStats{
+		Allowed:         3,
+		RejectedIP:      1,
+		RejectedMachine: 1,
+	}
+	if stats := limiter.Stats(); stats != expect {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Record is a single request and response exchanged with a server. The
+// XML documents are kept exactly as sent so malformed traffic can be
+// recorded too.
+type Record struct {
+	Time     time.Time `json:"time"`
+	URL      string    `json:"url,omitempty"`
+	Status   int       `json:"status,omitempty"`
+	Request  string    `json:"request"`
+	Response string    `json:"response,omitempty"`
+	// Error describes a failure to get any response at all.
+	Error string `json:"error,omitempty"`
+}
+
+// ParseRequest parses the recorded request.
+func (r *Record) ParseRequest() (*Request, error) {
+	return ParseRequest("", bytes.NewReader([]byte(r.Request)))
+}
+
+// ParseResponse parses the recorded response.
+func (r *Record) ParseResponse() (*Response, error) {
+	return ParseResponse("", bytes.NewReader([]byte(r.Response)))
+}
+
+// Recorder writes records as newline delimited JSON. It is safe for
+// concurrent use.
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	enc := json.NewEncoder(w)
+	// Keep the XML readable.
+	enc.SetEscapeHTML(false)
+	return &Recorder{enc: enc}
+}
+
+// Record writes a single record, setting its time if not already set.
+func (r *Recorder) Record(rec *Record) error {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(rec)
+}
+
+// ReadRecords reads all records written by a Recorder.
+func ReadRecords(r io.Reader) ([]*Record, error) {
+	var records []*Record
+	scanner := bufio.NewScanner(r)
+	// Allow for a 1M request and response plus escaping.
+	scanner.Buffer(nil, 8*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		rec := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			return nil, fmt.Errorf("omaha: record %d: %v", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+// LoadFixture reads a record from a directory holding request.xml and,
+// optionally, response.xml as in the repository's fixtures directory.
+func LoadFixture(dir string) (*Record, error) {
+	req, err := ioutil.ReadFile(filepath.Join(dir, "request.xml"))
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &Record{Request: string(req)}
+	resp, err := ioutil.ReadFile(filepath.Join(dir, "response.xml"))
+	if err == nil {
+		rec.Response = string(resp)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+// WriteFixture saves the record as request.xml and response.xml in dir,
+// creating it if needed.
+func (r *Record) WriteFixture(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "request.xml"), []byte(r.Request), 0644); err != nil {
+		return err
+	}
+	if r.Response == "" {
+		return nil
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "response.xml"), []byte(r.Response), 0644)
+}
+
+// Replay feeds the record's request to an OmahaHandler for updater,
+// returning a new record with the response it produced.
+func Replay(updater Updater, rec *Record) *Record {
+	url := rec.URL
+	if url == "" {
+		url = "http://localhost/v1/update/"
+	}
+
+	httpReq := httptest.NewRequest("POST", url, bytes.NewReader([]byte(rec.Request)))
+	httpReq.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	w := httptest.NewRecorder()
+	handler := &OmahaHandler{Updater: updater}
+	handler.ServeHTTP(w, httpReq)
+
+	return &Record{
+		Time:     time.Now().UTC(),
+		URL:      url,
+		Status:   w.Code,
+		Request:  rec.Request,
+		Response: w.Body.String(),
+	}
+}
+
+// recordingWriter captures the response sent by OmahaHandler.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,139 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	r := NewRecorder(&buf)
+	for _, rec := range []*Record{
+		{Request: sampleRequest, Response: "<response/>\n", Status: 200},
+		{Request: "<request", Error: "connection refused"},
+	} {
+		if err := r.Record(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := strings.Count(buf.String(), "\n"); n != 2 {
+		t.Fatalf("expected 2 lines, got %d", n)
+	}
+
+	records, err := ReadRecords(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if records[0].Request != sampleRequest || records[0].Time.IsZero() {
+		t.Errorf("unexpected record: %#v", records[0])
+	}
+	if records[1].Error != "connection refused" {
+		t.Errorf("unexpected record: %#v", records[1])
+	}
+
+	if _, err := ReadRecords(strings.NewReader("{bogus\n")); err == nil {
+		t.Error("bogus record accepted")
+	}
+}
+
+func TestRecordFixture(t *testing.T) {
+	rec, err := LoadFixture("../fixtures/update-engine/update")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := rec.ParseRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rec.ParseResponse(); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := Replay(UpdaterStub{}, rec)
+	if replayed.Status != http.StatusOK {
+		t.Fatalf("replay failed: %d %s", replayed.Status, replayed.Response)
+	}
+	resp, err := replayed.ParseResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Apps) != 1 || resp.Apps[0].ID != req.Apps[0].ID ||
+		resp.Apps[0].UpdateCheck.Status != NoUpdate {
+		t.Errorf("unexpected replay response: %s", replayed.Response)
+	}
+
+	dir, err := ioutil.TempDir("", "go-omaha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fixture := filepath.Join(dir, "replayed")
+	if err := replayed.WriteFixture(fixture); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadFixture(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Request != replayed.Request || loaded.Response != replayed.Response {
+		t.Error("fixture did not round trip")
+	}
+}
+
+func TestHandlerRecorder(t *testing.T) {
+	var buf bytes.Buffer
+	handler := &OmahaHandler{
+		Updater:  UpdaterStub{},
+		Recorder: NewRecorder(&buf),
+	}
+
+	for _, body := range []string{sampleRequest, "<bogus"} {
+		req := httptest.NewRequest("POST", "/v1/update/", strings.NewReader(body))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	records, err := ReadRecords(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+
+	if records[0].Request != sampleRequest || records[0].Status != http.StatusOK {
+		t.Errorf("unexpected record: %#v", records[0])
+	}
+	if _, err := records[0].ParseResponse(); err != nil {
+		t.Errorf("recorded response: %v", err)
+	}
+
+	if records[1].Request != "<bogus" || records[1].Status != http.StatusBadRequest {
+		t.Errorf("unexpected record: %#v", records[1])
+	}
+}
@@ -15,6 +15,7 @@
 package omaha
 
 import (
+	"crypto/tls"
 	"net"
 	"net/http"
 )
@@ -39,9 +40,9 @@ func NewServer(addr string, updater Updater) (*Server, error) {
 		srv:     srv,
 	}
 
-	h := &OmahaHandler{s}
-	mux.Handle("/v1/update", h)
-	mux.Handle("/v1/update/", h)
+	s.handler = &OmahaHandler{Updater: s}
+	mux.Handle("/v1/update", s.handler)
+	mux.Handle("/v1/update/", s.handler)
 
 	return s, nil
 }
@@ -51,12 +52,65 @@ type Server struct {
 
 	Mux *http.ServeMux
 
-	l   net.Listener
-	srv *http.Server
+	l       net.Listener
+	srv     *http.Server
+	handler *OmahaHandler
+}
+
+// SetStrictness sets how strictly requests are validated. It must be
+// called before Serve.
+func (s *Server) SetStrictness(level Strictness) {
+	s.handler.Strictness = level
+}
+
+// SetRecorder records all omaha requests and responses. It must be
+// called before Serve.
+func (s *Server) SetRecorder(r *Recorder) {
+	s.handler.Recorder = r
+}
+
+// HandleAdmin serves the admin API for a catalog under AdminPrefix,
+// protected by the given bearer token. The catalog is usually the
+// server's Updater but may be wrapped by another. The handler is
+// returned for further configuration.
+func (s *Server) HandleAdmin(c *Catalog, token string) *AdminHandler {
+	ah := NewAdminHandler(c, token)
+	s.Mux.Handle(AdminPrefix, ah)
+	return ah
+}
+
+// SetAuthenticator requires clients to authenticate. It must be called
+// before Serve.
+func (s *Server) SetAuthenticator(a Authenticator) {
+	s.handler.Auth = a
+}
+
+// SetLimiter rejects requests over the limiter's limits. It must be
+// called before Serve.
+func (s *Server) SetLimiter(l *Limiter) {
+	s.handler.Limiter = l
+}
+
+// SetTLSConfig serves HTTPS with the given configuration, which must
+// include the server's certificate. Set ClientAuth and ClientCAs to
+// verify client certificates for TLSAuth. It must be called before Serve.
+func (s *Server) SetTLSConfig(cfg *tls.Config) {
+	s.srv.TLSConfig = cfg
+}
+
+// SetEventBus publishes all client events to the bus. It must be called
+// before Serve.
+func (s *Server) SetEventBus(b *EventBus) {
+	s.handler.Events = b
 }
 
 func (s *Server) Serve() error {
-	err := s.srv.Serve(s.l)
+	l := s.l
+	if s.srv.TLSConfig != nil {
+		l = tls.NewListener(l, s.srv.TLSConfig)
+	}
+
+	err := s.srv.Serve(l)
 	if isClosed(err) {
 		// gracefully quit
 		err = nil
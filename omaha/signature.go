@@ -0,0 +1,176 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Payload signatures are made over the SHA-256 hash of the whole payload
+// and carried in the postinstall action's PayloadSignature attribute.
+// update_engine's MetadataSignatureRsa attribute is left alone: it holds
+// a signature of the payload's metadata, which is a different thing, and
+// update_engine rejects updates where it does not verify. Unknown
+// attributes are ignored by update_engine so signed updates still work
+// with it. Both RSA (PKCS #1 v1.5) and Ed25519 keys are supported.
+
+// PayloadSignatureAttr is the postinstall action attribute holding the
+// base64 encoded payload signature.
+const PayloadSignatureAttr = "PayloadSignature"
+
+var (
+	SignatureMissingError = errors.New("package signature is missing")
+	SignatureInvalidError = errors.New("package signature is invalid")
+)
+
+// SignDigest signs the SHA-256 digest of a payload.
+func SignDigest(key crypto.Signer, digest []byte) ([]byte, error) {
+	switch key.Public().(type) {
+	case ed25519.PublicKey:
+		return key.Sign(rand.Reader, digest, crypto.Hash(0))
+	case *rsa.PublicKey:
+		return key.Sign(rand.Reader, digest, crypto.SHA256)
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", key.Public())
+	}
+}
+
+// VerifyDigest checks sig is a signature of the SHA-256 digest of a
+// payload made by any one of the given public keys.
+func VerifyDigest(keys []crypto.PublicKey, digest, sig []byte) error {
+	if len(sig) == 0 {
+		return SignatureMissingError
+	}
+
+	for _, key := range keys {
+		switch key := key.(type) {
+		case ed25519.PublicKey:
+			if ed25519.Verify(key, digest, sig) {
+				return nil
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig) == nil {
+				return nil
+			}
+		}
+	}
+
+	return SignatureInvalidError
+}
+
+// Sign signs the manifest's payload, the first package, storing the
+// signature in the postinstall action which is created if needed.
+func (m *Manifest) Sign(key crypto.Signer) error {
+	if len(m.Packages) == 0 {
+		return errors.New("omaha: manifest has no packages to sign")
+	}
+
+	digest, err := base64.StdEncoding.DecodeString(m.Packages[0].SHA256)
+	if err != nil || len(digest) == 0 {
+		return fmt.Errorf("omaha: package %q has an invalid SHA-256 hash", m.Packages[0].Name)
+	}
+
+	sig, err := SignDigest(key, digest)
+	if err != nil {
+		return fmt.Errorf("omaha: signing failed: %v", err)
+	}
+
+	act := m.PostinstallAction()
+	if act == nil {
+		act = m.AddAction("postinstall")
+	}
+	act.SetPayloadSignature(sig)
+
+	return nil
+}
+
+// PayloadSignature decodes the payload signature made by Manifest.Sign.
+// A missing signature is returned as nil.
+func (a *Action) PayloadSignature() ([]byte, error) {
+	enc, ok := a.Attr(PayloadSignatureAttr)
+	if !ok || enc == "" {
+		return nil, nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, &ActionError{PayloadSignatureAttr, err}
+	}
+	return sig, nil
+}
+
+// SetPayloadSignature stores a payload signature in the action.
+func (a *Action) SetPayloadSignature(sig []byte) {
+	a.SetAttr(PayloadSignatureAttr, base64.StdEncoding.EncodeToString(sig))
+}
+
+// ParsePublicKey parses a PEM encoded PKIX public key.
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("omaha: no PEM data found")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("omaha: invalid public key: %v", err)
+	}
+
+	switch key.(type) {
+	case ed25519.PublicKey, *rsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("omaha: unsupported public key type %T", key)
+	}
+}
+
+// ParsePrivateKey parses a PEM encoded PKCS #8 private key.
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("omaha: no PEM data found")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("omaha: invalid private key: %v", err)
+	}
+
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		return key, nil
+	case *rsa.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("omaha: unsupported private key type %T", key)
+	}
+}
+
+// LoadPrivateKey reads a PEM encoded PKCS #8 private key from a file.
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrivateKey(data)
+}
@@ -0,0 +1,140 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+func testSigners(t *testing.T) []crypto.Signer {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []crypto.Signer{edKey, rsaKey}
+}
+
+func TestSignVerifyDigest(t *testing.T) {
+	digest := sha256.Sum256([]byte("testing\n"))
+	other := sha256.Sum256([]byte("other\n"))
+	signers := testSigners(t)
+
+	for i, key := range signers {
+		sig, err := SignDigest(key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys := []crypto.PublicKey{key.Public()}
+		if err := VerifyDigest(keys, digest[:], sig); err != nil {
+			t.Errorf("%T: %v", key, err)
+		}
+		if err := VerifyDigest(keys, other[:], sig); err != SignatureInvalidError {
+			t.Errorf("%T: wrong digest: %v", key, err)
+		}
+		if err := VerifyDigest(keys, digest[:], nil); err != SignatureMissingError {
+			t.Errorf("%T: missing signature: %v", key, err)
+		}
+
+		wrong := []crypto.PublicKey{signers[(i+1)%len(signers)].Public()}
+		if err := VerifyDigest(wrong, digest[:], sig); err != SignatureInvalidError {
+			t.Errorf("%T: wrong key: %v", key, err)
+		}
+	}
+}
+
+func TestManifestSign(t *testing.T) {
+	key := testSigners(t)[0]
+
+	m := &Manifest{}
+	if err := m.Sign(key); err == nil {
+		t.Error("signed a manifest without packages")
+	}
+
+	pkg, err := m.AddPackageFromPath("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+
+	act := m.PostinstallAction()
+	if act == nil {
+		t.Fatal("postinstall action not created")
+	}
+
+	if act.MetadataSignatureRsa != "" {
+		t.Error("payload signature stored as update_engine's metadata signature")
+	}
+
+	sig, err := act.PayloadSignature()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256(nil)
+	keys := []crypto.PublicKey{key.Public()}
+	if err := VerifyDigest(keys, digest[:], sig); err != nil {
+		t.Errorf("signature of %s: %v", pkg.Name, err)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	for _, key := range testSigners(t) {
+		privDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubDER, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		priv, err := ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}))
+		if err != nil {
+			t.Fatalf("%T: %v", key, err)
+		}
+		pub, err := ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}))
+		if err != nil {
+			t.Fatalf("%T: %v", key, err)
+		}
+
+		digest := sha256.Sum256(nil)
+		sig, err := SignDigest(priv, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyDigest([]crypto.PublicKey{pub}, digest[:], sig); err != nil {
+			t.Errorf("%T: %v", key, err)
+		}
+	}
+
+	if _, err := ParsePublicKey([]byte("bogus")); err == nil {
+		t.Error("bogus public key accepted")
+	}
+}
@@ -15,8 +15,9 @@
 package omaha
 
 import (
+	"crypto"
 	"fmt"
-	"net/http"
+	"net/url"
 	"path"
 
 	"github.com/blang/semver"
@@ -35,6 +36,11 @@ func (tu *trivialUpdater) CheckUpdate(req *Request, app *AppRequest) (*Update, e
 		return nil, NoUpdate
 	}
 
+	if app.UpdateCheck != nil &&
+		!MatchVersionPrefix(tu.Manifest.Version, app.UpdateCheck.TargetVersionPrefix) {
+		return nil, NoUpdate
+	}
+
 	v1, err := semver.Make(app.Version)
 	if err != nil {
 		return nil, err
@@ -52,24 +58,18 @@ func (tu *trivialUpdater) CheckUpdate(req *Request, app *AppRequest) (*Update, e
 	return nil, NoUpdate
 }
 
-// trivialHandler serves up a single file.
-type trivialHandler struct {
-	Path string
-}
-
-func (th *trivialHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if th.Path == "" {
-		http.NotFound(w, r)
-	}
-	http.ServeFile(w, r, th.Path)
-}
-
 // TrivialServer is an extremely basic Omaha server that ignores all
 // incoming metadata, always responding with the same update response.
 // The update is constructed by calling AddPackage one or more times.
 type TrivialServer struct {
 	*Server
-	tu trivialUpdater
+	tu     trivialUpdater
+	key    crypto.Signer
+	hashes *HashCache
+
+	handlers     []*PackageHandler
+	cacheControl string
+	rateLimit    int64
 }
 
 func NewTrivialServer(addr string) (*TrivialServer, error) {
@@ -98,7 +98,7 @@ func (ts *TrivialServer) AddPackage(file, name string) error {
 		return fmt.Errorf("invalid package name %q", name)
 	}
 
-	pkg, err := ts.tu.Manifest.AddPackageFromPath(file)
+	pkg, err := ts.tu.Manifest.AddPackageFromPathCached(file, ts.hashes)
 	if err != nil {
 		return err
 	}
@@ -112,11 +112,111 @@ func (ts *TrivialServer) AddPackage(file, name string) error {
 		act.SHA256 = pkg.SHA256
 	}
 
-	ts.Mux.Handle(pkg_prefix+name, &trivialHandler{file})
+	if ts.key != nil && len(ts.tu.Manifest.Packages) == 1 {
+		if err := ts.tu.Manifest.Sign(ts.key); err != nil {
+			return err
+		}
+	}
+
+	h := NewPackageHandler(file, pkg)
+	h.CacheControl = ts.cacheControl
+	h.RateLimit = ts.rateLimit
+	ts.handlers = append(ts.handlers, h)
+	ts.Mux.Handle(pkg_prefix+name, h)
 	return nil
 }
 
+// SetHashCache sets a cache of package hashes used by AddPackage.
+func (ts *TrivialServer) SetHashCache(hc *HashCache) {
+	ts.hashes = hc
+}
+
+// SetCacheControl sets the Cache-Control header sent with packages.
+// It must be called before Serve.
+func (ts *TrivialServer) SetCacheControl(value string) {
+	ts.cacheControl = value
+	for _, h := range ts.handlers {
+		h.CacheControl = value
+	}
+}
+
+// SetRateLimit limits each package download to the given bytes per
+// second, zero is unlimited. It must be called before Serve.
+func (ts *TrivialServer) SetRateLimit(bytesPerSecond int64) {
+	ts.rateLimit = bytesPerSecond
+	for _, h := range ts.handlers {
+		h.RateLimit = bytesPerSecond
+	}
+}
+
 // SetVersion sets the manifest's version with the provided one.
 func (ts *TrivialServer) SetVersion(version string) {
 	ts.tu.Manifest.Version = version
 }
+
+// HandleAdmin replaces the trivial update response with a Catalog
+// offering it to appID on track, and serves the catalog's admin API
+// protected by token. Clients of other applications are then rejected.
+// Updates added through the API are signed with the signing key and
+// may only use packages this server serves, or a codebase elsewhere.
+// It must be called after the packages are added and before Serve.
+func (ts *TrivialServer) HandleAdmin(appID, track, token string) (*AdminHandler, error) {
+	if len(ts.tu.Manifest.Packages) == 0 {
+		return nil, fmt.Errorf("omaha: no packages added")
+	}
+
+	u := ts.tu.Update
+	u.ID = appID
+
+	c := NewCatalog()
+	if err := c.AddUpdate(track, &u); err != nil {
+		return nil, err
+	}
+
+	ts.Updater = c
+	ah := ts.Server.HandleAdmin(c, token)
+	ah.Key = ts.key
+	ah.Validate = ts.checkPackages
+	return ah, nil
+}
+
+// checkPackages rejects updates pointing at this server for packages it
+// does not have, their downloads would fail.
+func (ts *TrivialServer) checkPackages(u *Update) error {
+	codebase, err := url.Parse(u.URL.CodeBase)
+	if err != nil {
+		return fmt.Errorf("omaha: invalid codebase %q: %v", u.URL.CodeBase, err)
+	}
+	if codebase.Host != "" {
+		return nil
+	}
+	if codebase.Path != pkg_prefix {
+		return fmt.Errorf("omaha: codebase %q is not served, use %q or another host", u.URL.CodeBase, pkg_prefix)
+	}
+
+	for _, pkg := range u.Manifest.Packages {
+		if !ts.servesPackage(pkg) {
+			return fmt.Errorf("omaha: package %q with sha1 %q is not served", pkg.Name, pkg.SHA1)
+		}
+	}
+	return nil
+}
+
+func (ts *TrivialServer) servesPackage(pkg *Package) bool {
+	for _, h := range ts.handlers {
+		if h.Package.Name == pkg.Name && h.Package.SHA1 == pkg.SHA1 {
+			return true
+		}
+	}
+	return false
+}
+
+// SetSigningKey sets the key used to sign the update payload, the first
+// package added. The payload is signed immediately if already added.
+func (ts *TrivialServer) SetSigningKey(key crypto.Signer) error {
+	ts.key = key
+	if len(ts.tu.Manifest.Packages) == 0 {
+		return nil
+	}
+	return ts.tu.Manifest.Sign(key)
+}
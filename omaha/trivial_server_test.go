@@ -21,12 +21,14 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 	"testing"
 )
 
 func mkUpdateReq() (*bytes.Buffer, error) {
 	req := NewRequest()
 	app := req.AddApp(testAppID, testAppVer)
+	app.Track = "stable"
 	app.AddUpdateCheck()
 
 	buf := &bytes.Buffer{}
@@ -138,3 +140,121 @@ func TestTrivialServer(t *testing.T) {
 		t.Fatalf("unexpected package data: %q", string(pkgdata))
 	}
 }
+
+func TestTrivialServerAdmin(t *testing.T) {
+	tmp, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewTrivialServer(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Destroy()
+	if _, err := s.HandleAdmin(testAppID, "stable", testAdminToken); err == nil {
+		t.Error("admin API enabled without a package")
+	}
+	s.SetVersion("999.999.999")
+	if err := s.AddPackage(tmp.Name(), "update.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.HandleAdmin(testAppID, "stable", testAdminToken); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+
+	// The package is offered by a catalog.
+	buf, err := mkUpdateReq()
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := fmt.Sprintf("http://%s/v1/update/", s.Addr())
+	res, err := http.Post(endpoint, "text/xml", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &Response{}
+	err = xml.NewDecoder(res.Body).Decode(resp)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to parse body: %v", err)
+	}
+	if len(resp.Apps) != 1 ||
+		resp.Apps[0].UpdateCheck == nil ||
+		resp.Apps[0].UpdateCheck.Status != UpdateOK {
+		t.Fatalf("unexpected response: %#v", resp)
+	}
+
+	// And managed through the admin API.
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s%sapps/%s/tracks/stable/pause",
+		s.Addr(), AdminPrefix, testAppID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("failed to pause: %v", res.Status)
+	}
+
+	buf, err = mkUpdateReq()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = http.Post(endpoint, "text/xml", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = &Response{}
+	err = xml.NewDecoder(res.Body).Decode(resp)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to parse body: %v", err)
+	}
+	if len(resp.Apps) != 1 ||
+		resp.Apps[0].UpdateCheck == nil ||
+		resp.Apps[0].UpdateCheck.Status != NoUpdate {
+		t.Fatalf("paused track offered an update: %#v", resp)
+	}
+	// Updates may only use packages this server has.
+	for _, tt := range []struct {
+		codebase string
+		name     string
+		sha1     string
+		code     int
+	}{
+		{"/packages/", "update.gz", "qUqP5cyxm6YcTAhz05Hph5gvu9M=", http.StatusOK},
+		{"/packages/", "update.gz", "AAAA", http.StatusBadRequest},
+		{"/packages/", "other.gz", "qUqP5cyxm6YcTAhz05Hph5gvu9M=", http.StatusBadRequest},
+		{"/elsewhere/", "update.gz", "qUqP5cyxm6YcTAhz05Hph5gvu9M=", http.StatusBadRequest},
+		{"https://mirror.example.com/", "other.gz", "AAAA", http.StatusOK},
+	} {
+		body := fmt.Sprintf(`{"version": "999.999.999", "codebase": %q, "packages": [{"name": %q, "sha1": %q}]}`,
+			tt.codebase, tt.name, tt.sha1)
+		req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s%sapps/%s/tracks/stable/updates",
+			s.Addr(), AdminPrefix, testAppID), strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		res, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.code {
+			t.Errorf("%s%s: expected %d, got %v", tt.codebase, tt.name, tt.code, res.Status)
+		}
+	}
+}
@@ -16,6 +16,7 @@ package omaha
 
 import (
 	"encoding/xml"
+	"strings"
 )
 
 // Update is a manifest for a single omaha update response. It extends
@@ -32,6 +33,26 @@ type Update struct {
 
 	// The delta_okay request attribute is an update_engine extension.
 	RespectDeltaOK bool `xml:"respect_delta_okay,attr,omitempty"`
+
+	// Rollback marks an update to an older version than the client's,
+	// only offered to clients that allow rollback.
+	Rollback bool `xml:"rollback,attr,omitempty"`
+}
+
+// MatchVersionPrefix reports if version starts with the dot separated
+// components of prefix, as used by the targetversionprefix attribute.
+// For example "1.2" and "1.2." match "1.2.3" but not "1.20.0".
+// A blank prefix matches any version.
+func MatchVersionPrefix(version, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, ".")
+	if prefix == "" {
+		return true
+	}
+	if !strings.HasPrefix(version, prefix) {
+		return false
+	}
+	rest := version[len(prefix):]
+	return rest == "" || rest[0] == '.' || rest[0] == '-' || rest[0] == '+'
 }
 
 // The URL attribute in Update is currently assumed to be a relative
@@ -45,6 +66,13 @@ func (u *Update) URLs(prefixes []string) []*URL {
 	return urls
 }
 
+// IsDelta reports if the update's payload is a delta, as marked by the
+// update_engine IsDeltaPayload extension of the postinstall action.
+func (u *Update) IsDelta() bool {
+	act := u.Manifest.PostinstallAction()
+	return act != nil && act.IsDeltaPayload
+}
+
 // Updater provides a common interface for any backend that can respond to
 // update requests made to an Omaha server.
 type Updater interface {
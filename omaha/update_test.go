@@ -40,3 +40,25 @@ func TestUpdateURLs(t *testing.T) {
 		t.Error("Unexpected URL", urls[0].CodeBase)
 	}
 }
+
+func TestMatchVersionPrefix(t *testing.T) {
+	for _, tt := range []struct {
+		version string
+		prefix  string
+		match   bool
+	}{
+		{"1.2.3", "", true},
+		{"1.2.3", "1", true},
+		{"1.2.3", "1.2", true},
+		{"1.2.3", "1.2.", true},
+		{"1.2.3", "1.2.3", true},
+		{"1.2.3-rc1", "1.2.3", true},
+		{"1.20.0", "1.2", false},
+		{"1.2.3", "1.2.3.4", false},
+		{"2.0.0", "1", false},
+	} {
+		if m := MatchVersionPrefix(tt.version, tt.prefix); m != tt.match {
+			t.Errorf("MatchVersionPrefix(%q, %q) = %t", tt.version, tt.prefix, m)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/blang/semver"
+)
+
+// Strictness controls how thoroughly documents are validated.
+type Strictness int
+
+const (
+	// ValidateNone accepts anything the parser accepts.
+	ValidateNone Strictness = iota
+
+	// ValidateBasic rejects documents that cannot be acted on sensibly:
+	// missing or duplicate app IDs, missing versions, bogus ping days
+	// and update responses without a manifest or URLs.
+	ValidateBasic
+
+	// ValidateStrict additionally requires versions to be semver.
+	ValidateStrict
+)
+
+// ValidationError describes why a document failed validation. AppID is
+// blank for problems with the document as a whole. For requests Status
+// is the app status the server should reply with.
+type ValidationError struct {
+	AppID  string
+	Status AppStatus
+	Reason string
+}
+
+func (ve *ValidationError) Error() string {
+	if ve.AppID == "" {
+		return "omaha: invalid document: " + ve.Reason
+	}
+	return fmt.Sprintf("omaha: invalid app %s: %s", ve.AppID, ve.Reason)
+}
+
+// Validate checks the request and each of its apps, returning a
+// *ValidationError for the first problem found.
+func (r *Request) Validate(level Strictness) error {
+	if level == ValidateNone {
+		return nil
+	}
+
+	if len(r.Apps) == 0 {
+		return &ValidationError{Reason: "no apps"}
+	}
+
+	for _, app := range r.Apps {
+		if err := r.ValidateApp(app, level); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ValidateApp checks a single app of the request, returning a
+// *ValidationError with Status set to AppInvalidID, AppInvalidVersion or,
+// for other malformed parts of the app such as its ping, AppInvalidRequest.
+// Only the second and later apps with the same ID are duplicates.
+func (r *Request) ValidateApp(app *AppRequest, level Strictness) error {
+	if level == ValidateNone {
+		return nil
+	}
+
+	invalid := func(status AppStatus, format string, args ...interface{}) error {
+		return &ValidationError{
+			AppID:  app.ID,
+			Status: status,
+			Reason: fmt.Sprintf(format, args...),
+		}
+	}
+
+	if app.ID == "" {
+		return invalid(AppInvalidID, "empty app id")
+	}
+
+	for _, other := range r.Apps {
+		if other == app {
+			break
+		}
+		if strings.EqualFold(other.ID, app.ID) {
+			return invalid(AppInvalidID, "duplicate app id")
+		}
+	}
+
+	if app.Version == "" {
+		return invalid(AppInvalidVersion, "empty version")
+	}
+	if level >= ValidateStrict {
+		if _, err := semver.Make(app.Version); err != nil {
+			return invalid(AppInvalidVersion, "version %q: %v", app.Version, err)
+		}
+	}
+
+	// Days are -1 if unknown, anything lower is nonsense.
+	if p := app.Ping; p != nil {
+		if p.LastActiveReportDays != nil && *p.LastActiveReportDays < -1 {
+			return invalid(AppInvalidRequest, "negative ping active days %d", *p.LastActiveReportDays)
+		}
+		if p.LastReportDays < -1 {
+			return invalid(AppInvalidRequest, "negative ping days %d", p.LastReportDays)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the response, returning a *ValidationError for the
+// first problem found.
+func (r *Response) Validate(level Strictness) error {
+	if level == ValidateNone {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	for _, app := range r.Apps {
+		invalid := func(format string, args ...interface{}) error {
+			return &ValidationError{
+				AppID:  app.ID,
+				Reason: fmt.Sprintf(format, args...),
+			}
+		}
+
+		if app.ID == "" {
+			return invalid("empty app id")
+		}
+		id := strings.ToLower(app.ID)
+		if seen[id] {
+			return invalid("duplicate app id")
+		}
+		seen[id] = true
+
+		if app.Status == "" {
+			return invalid("empty status")
+		}
+
+		uc := app.UpdateCheck
+		if uc == nil || uc.Status != UpdateOK {
+			continue
+		}
+		if len(uc.URLs) == 0 {
+			return invalid("update without urls")
+		}
+		if uc.Manifest == nil {
+			return invalid("update without a manifest")
+		}
+		if uc.Manifest.Version == "" {
+			return invalid("update without a version")
+		}
+		if level >= ValidateStrict {
+			if _, err := semver.Make(uc.Manifest.Version); err != nil {
+				return invalid("version %q: %v", uc.Manifest.Version, err)
+			}
+		}
+		if len(uc.Manifest.Packages) == 0 {
+			return invalid("update without packages")
+		}
+		for _, pkg := range uc.Manifest.Packages {
+			if pkg.Name == "" {
+				return invalid("package without a name")
+			}
+		}
+	}
+
+	return nil
+}
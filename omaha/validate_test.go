@@ -0,0 +1,131 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omaha
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRequestValidate(t *testing.T) {
+	minusTwo := -2
+
+	for _, tt := range []struct {
+		name   string
+		modify func(r *Request)
+		level  Strictness
+		status AppStatus
+	}{
+		{"ok", func(r *Request) {}, ValidateStrict, ""},
+		{"empty id", func(r *Request) {
+			r.Apps[0].ID = ""
+		}, ValidateBasic, AppInvalidID},
+		{"duplicate", func(r *Request) {
+			r.AddApp(strings.ToLower(testAppID), testAppVer)
+		}, ValidateBasic, AppInvalidID},
+		{"empty version", func(r *Request) {
+			r.Apps[0].Version = ""
+		}, ValidateBasic, AppInvalidVersion},
+		{"non-semver basic", func(r *Request) {
+			r.Apps[0].Version = "ForcedUpdate"
+		}, ValidateBasic, ""},
+		{"non-semver strict", func(r *Request) {
+			r.Apps[0].Version = "ForcedUpdate"
+		}, ValidateStrict, AppInvalidVersion},
+		{"ping days", func(r *Request) {
+			r.Apps[0].AddPing().LastReportDays = -2
+		}, ValidateBasic, AppInvalidRequest},
+		{"ping active days", func(r *Request) {
+			r.Apps[0].AddPing().LastActiveReportDays = &minusTwo
+		}, ValidateBasic, AppInvalidRequest},
+		{"none", func(r *Request) {
+			r.Apps[0].ID = ""
+		}, ValidateNone, ""},
+	} {
+		req := NewRequest()
+		req.AddApp(testAppID, testAppVer).AddPing()
+		tt.modify(req)
+
+		err := req.Validate(tt.level)
+		if tt.status == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+
+		ve, ok := err.(*ValidationError)
+		if !ok {
+			t.Errorf("%s: expected a validation error, got %v", tt.name, err)
+		} else if ve.Status != tt.status {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.status, ve.Status)
+		}
+	}
+
+	if err := NewRequest().Validate(ValidateBasic); err == nil {
+		t.Error("request without apps accepted")
+	}
+}
+
+func TestResponseValidate(t *testing.T) {
+	newUpdate := func() *Response {
+		r := NewResponse()
+		u := r.AddApp(testAppID, AppOK).AddUpdateCheck(UpdateOK)
+		u.AddURL("http://localhost/")
+		u.AddManifest("1.1.0").AddPackage().Name = "update.gz"
+		return r
+	}
+
+	if err := newUpdate().Validate(ValidateStrict); err != nil {
+		t.Errorf("valid response rejected: %v", err)
+	}
+	if err := nilResponse.Validate(ValidateStrict); err != nil {
+		t.Errorf("valid response rejected: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		modify func(r *Response)
+		level  Strictness
+	}{
+		{"empty id", func(r *Response) {
+			r.Apps[0].ID = ""
+		}, ValidateBasic},
+		{"duplicate", func(r *Response) {
+			r.AddApp(testAppID, AppOK)
+		}, ValidateBasic},
+		{"no urls", func(r *Response) {
+			r.Apps[0].UpdateCheck.URLs = nil
+		}, ValidateBasic},
+		{"no manifest", func(r *Response) {
+			r.Apps[0].UpdateCheck.Manifest = nil
+		}, ValidateBasic},
+		{"no packages", func(r *Response) {
+			r.Apps[0].UpdateCheck.Manifest.Packages = nil
+		}, ValidateBasic},
+		{"non-semver", func(r *Response) {
+			r.Apps[0].UpdateCheck.Manifest.Version = "latest"
+		}, ValidateStrict},
+	} {
+		resp := newUpdate()
+		tt.modify(resp)
+		if err := resp.Validate(tt.level); err == nil {
+			t.Errorf("%s: invalid response accepted", tt.name)
+		}
+		if err := resp.Validate(ValidateNone); err != nil {
+			t.Errorf("%s: rejected without validation: %v", tt.name, err)
+		}
+	}
+}